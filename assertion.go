@@ -0,0 +1,192 @@
+package hero
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	errInvalidJWTClaim = errors.New("hero: the JWT has a missing or invalid claim")
+	errNoClientKeys    = errors.New("hero: the client has no registered keys")
+	errNoConsent       = errors.New("hero: the user has not consented to the client")
+
+	errUnauthorizedAuthMethod = errors.New("hero: the client may not use this authentication method")
+	errMalformedJWT           = errors.New("hero: malformed JWT")
+)
+
+// clientJWT parses the JWT signed by client, the signature is verified with the
+// public keys in the client's JWKS or, for HMAC signed tokens, the client's
+// JWTSecret.
+func clientJWT(client *Client, token string) (*jwt.Token, error) {
+	var keys []*jwk
+	if client.JWKS != "" {
+		var err error
+		keys, err = parseJWKS(client.JWKS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+			if client.JWTSecret == "" {
+				return nil, errNoClientKeys
+			}
+			return []byte(client.JWTSecret), nil
+		}
+		if len(keys) == 0 {
+			return nil, errNoClientKeys
+		}
+		kid, _ := t.Header["kid"].(string)
+		for _, k := range keys {
+			if kid != "" && k.Kid != kid {
+				continue
+			}
+			if !k.Allows(t.Method.Alg()) {
+				continue
+			}
+			return k.PublicKey()
+		}
+		return nil, errUnknownKey
+	})
+}
+
+// verifyClientJWT verifies the claims of the JWT the client presented to the token
+// endpoint as described in RFC 7523 section 3. It must be issued by the client, be
+// intended for this server, expire and have an id that was not seen before.
+func (s *Server) verifyClientJWT(client *Client, token *jwt.Token) error {
+	claims := token.Claims
+	if iss, _ := claims["iss"].(string); iss != client.UUID {
+		return errInvalidJWTClaim
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return errInvalidJWTClaim
+	}
+	if !s.validAudience(claims["aud"]) {
+		return errInvalidJWTClaim
+	}
+
+	// the expiry is checked when the token is parsed, only its presence is left.
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errInvalidJWTClaim
+	}
+	jti, _ := claims["jti"].(string)
+	return s.q.UseJTI(client.ID, jti, int64(exp))
+}
+
+// validAudience returns true if aud, the audience claim of a JWT, identifies this
+// server either by the issuer or the token endpoint url.
+func (s *Server) validAudience(aud interface{}) bool {
+	var audience []interface{}
+	switch v := aud.(type) {
+	case string:
+		audience = append(audience, v)
+	case []interface{}:
+		audience = v
+	}
+	for _, a := range audience {
+		switch a {
+		case s.cfg.Issuer, s.cfg.EndpointURL(s.cfg.TokenEndpoint):
+			return true
+		}
+	}
+	return false
+}
+
+// assertionClient authenticates the client with the JWT it presented as described
+// in RFC 7523 section 3. The subject of the JWT must be the client itself and the
+// signing algorithm must agree with the client's token endpoint auth method.
+func (s *Server) assertionClient(auth *assertionAuth) (*Client, error) {
+	id := auth.ClientID
+	if id == "" {
+		claims, err := unverifiedClaims(auth.Assertion)
+		if err != nil {
+			return nil, err
+		}
+		id, _ = claims["iss"].(string)
+		if id == "" {
+			return nil, errInvalidJWTClaim
+		}
+	}
+	client, err := s.q.ClientByCode(id)
+	if err != nil {
+		return nil, err
+	}
+	token, err := clientJWT(client, auth.Assertion)
+	if err != nil {
+		return nil, err
+	}
+	if sub, _ := token.Claims["sub"].(string); sub != client.UUID {
+		return nil, errInvalidJWTClaim
+	}
+	if err = s.verifyClientJWT(client, token); err != nil {
+		return nil, err
+	}
+	method := authMethod.PrivateKeyJWT
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		method = authMethod.SecretJWT
+	}
+	if !client.AllowsAuthMethod(method) {
+		return nil, errUnauthorizedAuthMethod
+	}
+	return client, nil
+}
+
+// unverifiedClaims decodes the claims of the JWT token without verifying its
+// signature, they must not be trusted until the token has been verified.
+func unverifiedClaims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedJWT
+	}
+	payload, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := make(map[string]interface{})
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// assertionUser returns the user that the client asserts to act for with the JWT
+// bearer assertion, as described in RFC 7523 section 2.1. The assertion alone does
+// not make the client trusted to act for the user, see assertionConsent.
+func (s *Server) assertionUser(client *Client, assertion string) (*User, error) {
+	token, err := clientJWT(client, assertion)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.verifyClientJWT(client, token); err != nil {
+		return nil, err
+	}
+	sub, _ := token.Claims["sub"].(string)
+	return s.userBySubject(sub)
+}
+
+// assertionConsent returns errNoConsent unless usr consented to client with scope,
+// clients only act for the users who authorized them through the browser before.
+func (s *Server) assertionConsent(usr *User, client *Client, scope string) error {
+	consent, err := s.q.ConsentByClient(usr.ID, client.ID)
+	if err != nil || !coversScope(consent.Scope, scope) {
+		return errNoConsent
+	}
+	return nil
+}
+
+// userBySubject returns the user identified by sub which is the user id, email or
+// username.
+func (s *Server) userBySubject(sub string) (*User, error) {
+	if id, err := strconv.ParseInt(sub, 10, 64); err == nil {
+		return s.q.UserByID(id)
+	}
+	if isEmail(sub) {
+		return s.q.UserByEmail(sub)
+	}
+	return s.q.UserByUserName(sub)
+}
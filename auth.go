@@ -1,6 +1,7 @@
 package hero
 
 import (
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"net/http"
@@ -12,13 +13,43 @@ import (
 type basicAuth struct {
 	UserName string
 	Password string
+
+	// Post is true when the credentials were sent in the request body rather than
+	// the Authorization header.
+	Post bool
 }
 
 //bererAuth stores the code for authenciating clients using bearer token.
 type bearerAuth struct {
 	Code string
+
+	// DPoP is true when the token was sent with the DPoP authorization scheme.
+	DPoP bool
+}
+
+// publicAuth identifies public clients, which only present their client_id.
+type publicAuth struct {
+	ClientID string
+}
+
+// assertionAuth stores the JWT a client authenticates with, as described in RFC 7523
+// section 2.2.
+type assertionAuth struct {
+	ClientID  string
+	Assertion string
+}
+
+// certAuth identifies a client by the TLS client certificate it presented, as
+// described in RFC 8705 section 2.
+type certAuth struct {
+	ClientID string
+	Cert     *x509.Certificate
+	Chain    []*x509.Certificate
 }
 
+// clientAssertionType is the only supported client_assertion_type.
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
 //getClientAuth returns the basic authentication details from the given request. if the allowParams is
 // set to true then the basic auth information will be extracted from the request query parameters.
 // Make sure you call r.Parse() before calling this, so as to make the query params available in r.Form
@@ -28,6 +59,7 @@ func getCLientAuth(r *http.Request, allowQueryParams bool) (*basicAuth, error) {
 	auth := &basicAuth{
 		UserName: r.Form.Get("client_id"),
 		Password: r.Form.Get("client_secret"),
+		Post:     true,
 	}
 	if allowQueryParams && auth.Password != "" && auth.UserName != "" {
 		return auth, nil
@@ -35,6 +67,31 @@ func getCLientAuth(r *http.Request, allowQueryParams bool) (*basicAuth, error) {
 	return checkBasicAuth(r)
 }
 
+// requestClientAuth returns the client authentication details from the request. When
+// no client secret is supplied the client_id is returned as *publicAuth, it is up
+// to the caller to make sure the client is really public, or as *certAuth when a
+// TLS client certificate was presented. Clients authenticating with a JWT are
+// returned as *assertionAuth.
+func requestClientAuth(r *http.Request) (interface{}, error) {
+	if assertion := r.Form.Get("client_assertion"); assertion != "" {
+		if r.Form.Get("client_assertion_type") != clientAssertionType {
+			return nil, errors.New("unsupported client assertion type")
+		}
+		return &assertionAuth{ClientID: r.Form.Get("client_id"), Assertion: assertion}, nil
+	}
+	auth, err := getCLientAuth(r, true)
+	if err == nil {
+		return auth, nil
+	}
+	if id := r.Form.Get("client_id"); id != "" && r.Form.Get("client_secret") == "" {
+		if cert := peerCertificate(r); cert != nil {
+			return &certAuth{ClientID: id, Cert: cert, Chain: r.TLS.PeerCertificates[1:]}, nil
+		}
+		return &publicAuth{ClientID: id}, nil
+	}
+	return nil, err
+}
+
 // checkBasiAuth returns basic client athentication  details from the given request. The information is
 // extracted from the request header.
 func checkBasicAuth(r *http.Request) (*basicAuth, error) {
@@ -59,7 +116,7 @@ func checkBasicAuth(r *http.Request) (*basicAuth, error) {
 	if len(keyPairs) != 2 {
 		return nil, errInvalidUthorizeHader
 	}
-	return &basicAuth{keyPairs[0], keyPairs[1]}, nil
+	return &basicAuth{UserName: keyPairs[0], Password: keyPairs[1]}, nil
 
 }
 
@@ -78,10 +135,14 @@ func checkBearerAuth(r *http.Request) *bearerAuth {
 	}
 	if authHeader != "" {
 		components := strings.SplitN(authHeader, " ", 2)
-		if (len(components) != 2 || components[0] != bearer) && authCode == "" {
+		if len(components) == 2 && (components[0] == bearer || components[0] == dpopHeader) {
+			return &bearerAuth{Code: components[1], DPoP: components[0] == dpopHeader}
+		}
+
+		// a header which is not a bearer token falls back to the code.
+		if authCode == "" {
 			return nil
 		}
-		authCode = components[1]
 	}
-	return &bearerAuth{authCode}
+	return &bearerAuth{Code: authCode}
 }
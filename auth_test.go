@@ -0,0 +1,37 @@
+package hero
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestCheckBearerAuth(t *testing.T) {
+	sample := []struct {
+		header, code string
+		expect       *bearerAuth
+	}{
+		{"", "", nil},
+		{"Bearer token", "", &bearerAuth{Code: "token"}},
+		{"DPoP token", "", &bearerAuth{Code: "token", DPoP: true}},
+		{"", "code", &bearerAuth{Code: "code"}},
+		{"Bearer token", "code", &bearerAuth{Code: "token"}},
+		{"Bearer", "", nil},
+		{"Bearer", "code", &bearerAuth{Code: "code"}},
+		{"Basic dXNlcjpwYXNz", "", nil},
+		{"Basic dXNlcjpwYXNz", "code", &bearerAuth{Code: "code"}},
+	}
+	for _, v := range sample {
+		r := &http.Request{Header: make(http.Header), Form: url.Values{}}
+		if v.header != "" {
+			r.Header.Set("Authorization", v.header)
+		}
+		if v.code != "" {
+			r.Form.Set("code", v.code)
+		}
+		b := checkBearerAuth(r)
+		if (b == nil) != (v.expect == nil) || (b != nil && *b != *v.expect) {
+			t.Errorf("%q %q: expected %v got %v", v.header, v.code, v.expect, b)
+		}
+	}
+}
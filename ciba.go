@@ -0,0 +1,435 @@
+package hero
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode"
+)
+
+// backchannelMode contains the ways clients get the result of backchannel
+// authentication requests, as described in CIBA section 5. Poll clients poll the
+// token endpoint, ping clients are told when to call it.
+var backchannelMode = struct {
+	Poll, Ping string
+}{
+	"poll", "ping",
+}
+
+// maxBindingMessage is the most characters of a binding message, it is shown on the
+// consumption and authentication devices so it must be short.
+const maxBindingMessage = 64
+
+var (
+	errUnknownUser           = errors.New("hero: the login hint does not identify a user")
+	errInvalidBindingMessage = errors.New("hero: invalid binding message")
+)
+
+// notificationClient delivers the notifications of ping mode clients, the
+// notification endpoints are given by clients so only public addresses are reached.
+var notificationClient = newPublicClient()
+
+// Notifier reaches users on their authentication device, to ask them to approve the
+// backchannel authentication requests made for them.
+type Notifier interface {
+
+	// Notify asks usr to approve the request of client, approveURL is the page
+	// where the user decides.
+	Notify(usr *User, client *Client, req *BackchannelRequest, approveURL string) error
+}
+
+// LogNotifier is a Notifier that writes the notifications to Log instead of sending
+// them, it stands in for a real channel in development and tests.
+type LogNotifier struct {
+	Log Logger
+}
+
+// Notify implements Notifier.
+func (n *LogNotifier) Notify(usr *User, client *Client, req *BackchannelRequest, approveURL string) error {
+	n.Log.Printf("ciba: %s asks %s to approve %q at %s\n", client.Name, usr.UserName, req.BindingMessage, approveURL)
+	return nil
+}
+
+// SetNotifier sets n as the way users are asked to approve backchannel
+// authentication requests, they are logged by default.
+func (s *Server) SetNotifier(n Notifier) {
+	s.notify = n
+}
+
+func (s *Server) notifier() Notifier {
+	if s.notify != nil {
+		return s.notify
+	}
+	return &LogNotifier{Log: s.log}
+}
+
+// BackchannelAuthentication provide the backchannel authentication endpoint of
+// OpenID Connect Client-Initiated Backchannel Authentication(CIBA).
+//
+// Clients authenticate and name the user with login_hint, either the username or
+// the email address. The user is notified to approve the request on their own
+// device while the client gets an auth_req_id which it exchanges at the token
+// endpoint once the user has decided.
+func (s *Server) BackchannelAuthentication(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(w)
+	ctx.StatusCode = http.StatusBadRequest
+	if r.Method != "POST" {
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		ctx.InternalError = errors.New("request must be POST")
+		_ = ctx.CommitJSON()
+		return
+	}
+	_ = r.ParseForm()
+
+	auth, err := requestClientAuth(r)
+	if err != nil {
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errorsKeys.InvalidClient, "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+	client := s.getClient(auth)
+	if client == nil || client.Public {
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errorsKeys.InvalidClient, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+	if !s.cfg.AccessAllowed(grantType.CIBA) || !client.AllowsGrant(grantType.CIBA) {
+		ctx.SetError(errorsKeys.UnauthorizedClient, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	scope, err := s.validScope(client, r.Form.Get(params.scope))
+	if err == nil && !hasScope(scope, oidcScope.OpenID) {
+		err = errInvalidScope
+	}
+	if err != nil {
+		ctx.SetError(scopeError(err), "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	// only login_hint is supported out of the hints of CIBA section 7.1.
+	if r.Form.Get("login_hint_token") != "" || r.Form.Get("id_token_hint") != "" {
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+	usr, err := s.hintedUser(r.Form.Get(params.loginHint))
+	if err != nil {
+		ctx.SetError(errorsKeys.UnknownUserID, "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+	message := r.Form.Get(params.bindingMessage)
+	if err = validBindingMessage(message); err != nil {
+		ctx.SetError(errorsKeys.InvalidBindingMessage, "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+	token := r.Form.Get(params.notifyToken)
+	if client.BackchannelMode == backchannelMode.Ping && token == "" {
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+	expire := s.cfg.CIBAExpire
+	if v := r.Form.Get(params.requestedExpiry); v != "" {
+		n, perr := strconv.ParseInt(v, 10, 64)
+		if perr != nil || n <= 0 {
+			ctx.SetError(errorsKeys.InvalidRequest, "")
+			ctx.InternalError = perr
+			_ = ctx.CommitJSON()
+			return
+		}
+		if n < expire {
+			expire = n
+		}
+	}
+
+	req := &BackchannelRequest{
+		AuthReqID:      s.gen.Generate(),
+		ClientID:       client.ID,
+		UserID:         usr.ID,
+		Scope:          scope,
+		BindingMessage: message,
+		NotifyToken:    token,
+		ExpiresIn:      expire,
+		Interval:       s.cfg.CIBAInterval,
+	}
+	if err = s.q.SaveBackchannelRequest(req); err != nil {
+		ctx.StatusCode = http.StatusInternalServerError
+		ctx.SetError(errorsKeys.ServerError, "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+	if err = s.notifier().Notify(usr, client, req, s.cfg.EndpointURL(s.cfg.CIBAVerifyPath)); err != nil {
+		if derr := s.q.DeleteBackchannelRequest(req); derr != nil {
+			s.log.Println(derr)
+		}
+		ctx.StatusCode = http.StatusInternalServerError
+		ctx.SetError(errorsKeys.ServerError, "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	ctx.StatusCode = http.StatusOK
+	ctx.SetData(params.authReqID, req.AuthReqID)
+	ctx.SetData(params.expiresIn, req.ExpiresIn)
+	ctx.SetData("interval", req.Interval)
+	_ = ctx.CommitJSON()
+}
+
+// hintedUser returns the user named by the login hint, either the username or the
+// email address.
+func (s *Server) hintedUser(hint string) (*User, error) {
+	if hint == "" {
+		return nil, errUnknownUser
+	}
+	if isEmail(hint) {
+		return s.q.UserByEmail(hint)
+	}
+	return s.q.UserByUserName(hint)
+}
+
+// validBindingMessage returns errInvalidBindingMessage if message can not be shown
+// to the user, it must be a short single line of text.
+func validBindingMessage(message string) error {
+	if len([]rune(message)) > maxBindingMessage {
+		return errInvalidBindingMessage
+	}
+	for _, c := range message {
+		if !unicode.IsPrint(c) {
+			return errInvalidBindingMessage
+		}
+	}
+	return nil
+}
+
+// backchannelAccess responds to client calling the token endpoint with the auth_req_id
+// of a backchannel authentication request. The access token is issued once the user
+// has approved the request.
+func (s *Server) backchannelAccess(client *Client, id string, ctx *context) {
+	req, err := s.q.BackchannelRequestByID(id)
+	if err != nil || req.ClientID != client.ID {
+		ctx.SetError(errorsKeys.InvalidGrant, "")
+		ctx.InternalError = err
+		return
+	}
+
+	var errID string
+	switch {
+	case req.IsExpired():
+		errID = errorsKeys.ExpiredToken
+	case req.Denied:
+		errID = errorsKeys.AccessDenied
+	}
+	if errID != "" || req.Approved {
+
+		// the request has concluded, it is claimed before anything is issued so
+		// the auth_req_id can not be used again, even by concurrent requests.
+		if err = s.q.ClaimBackchannelRequest(req.ID); err != nil {
+			ctx.StatusCode = http.StatusBadRequest
+			ctx.SetError(errorsKeys.InvalidGrant, "")
+			ctx.InternalError = err
+			return
+		}
+		if errID != "" {
+			ctx.StatusCode = http.StatusBadRequest
+			ctx.SetError(errID, "")
+			return
+		}
+		grant := &Grant{
+			Scope:    req.Scope,
+			ClientID: req.ClientID,
+			UserID:   req.UserID,
+			AuthTime: req.UpdatedAt.Unix(),
+		}
+		if _, err = s.finalizeAccess(grant, ctx); err != nil {
+			ctx.SetError(errorsKeys.ServerError, "")
+			ctx.InternalError = err
+		}
+		return
+	}
+
+	// clients polling faster than they were told to wait 5 more seconds from now on.
+	now := time.Now().Unix()
+	errID = errorsKeys.AuthorizationPending
+	if req.LastPoll != 0 && now-req.LastPoll < req.Interval {
+		req.Interval += 5
+		errID = errorsKeys.SlowDown
+	}
+	req.LastPoll = now
+	if err = s.q.PollBackchannelRequest(req); err != nil {
+		ctx.InternalError = err
+	}
+	ctx.StatusCode = http.StatusBadRequest
+	ctx.SetError(errID, "")
+}
+
+// BackchannelVerify is the page where logged in users see the backchannel
+// authentication requests made for them, and approve or deny them.
+func (s *Server) BackchannelVerify(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	data := make(map[string]interface{})
+	data["Config"] = s.cfg
+	data["Title"] = "ciba"
+	data["Action"] = s.cfg.CIBAVerifyPath
+
+	usr, ok := s.isSession(r)
+	if !ok && r.Method == "POST" {
+		usr = s.validUser(r, r.Form.Get(loginParams.username), r.Form.Get(loginParams.password))
+		if usr != nil {
+			if serr := s.SaveToSession(w, r, "UserID", usr.ID); serr != nil {
+				s.log.Println(serr)
+			}
+			ok = true
+		}
+	}
+	if !ok {
+		data["Title"] = "login"
+		data["Action"] = r.URL.String()
+		if err := s.view.Render(w, s.cfg.LoginTemplate, data); err != nil {
+			s.log.Println(err)
+		}
+		return
+	}
+
+	csrf, err := s.csrfToken(w, r)
+	if err != nil {
+		s.log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	data["User"] = usr
+	data["CSRF"] = csrf
+
+	if id := r.PostForm.Get("id"); id != "" && s.validCSRF(r) {
+		data[contextParams.Message] = s.decideBackchannel(usr, id, r.PostForm.Get(consentParams.decision))
+	}
+	pending, err := s.pendingBackchannel(usr)
+	if err != nil {
+		s.log.Println(err)
+	}
+	data["Requests"] = pending
+	if err = s.view.Render(w, s.cfg.CIBATemplate, data); err != nil {
+		s.log.Println(err)
+	}
+}
+
+// backchannelView is a backchannel authentication request as shown to the user.
+type backchannelView struct {
+	ID             int64
+	Client         *Client
+	Scopes         []Scope
+	BindingMessage string
+}
+
+// pendingBackchannel returns the backchannel authentication requests usr is yet to
+// decide on.
+func (s *Server) pendingBackchannel(usr *User) ([]backchannelView, error) {
+	reqs, err := s.q.BackchannelRequestsByUser(usr.ID)
+	if err != nil {
+		return nil, err
+	}
+	var pending []backchannelView
+	for i := range reqs {
+		req := &reqs[i]
+		if req.IsExpired() || req.Approved || req.Denied {
+			continue
+		}
+		client, err := s.q.ClientByID(req.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, backchannelView{
+			ID:             req.ID,
+			Client:         client,
+			Scopes:         s.describeScopes(req.Scope),
+			BindingMessage: req.BindingMessage,
+		})
+	}
+	return pending, nil
+}
+
+// decideBackchannel records the decision of usr about the backchannel authentication
+// request whose id is id, it returns the message shown to the user. Ping mode
+// clients are notified of the decision.
+func (s *Server) decideBackchannel(usr *User, id, decision string) string {
+	if decision != consentParams.allow && decision != consentParams.deny {
+		return ""
+	}
+	n, _ := strconv.ParseInt(id, 10, 64)
+	req, err := s.q.BackchannelRequestByUser(usr.ID, n)
+	if err != nil || req.IsExpired() || req.Approved || req.Denied {
+		return "The request is invalid or has expired."
+	}
+	client, err := s.q.ClientByID(req.ClientID)
+	if err != nil {
+		s.log.Println(err)
+		return "The request is invalid or has expired."
+	}
+	req.Approved = decision == consentParams.allow
+	req.Denied = !req.Approved
+	if err = s.q.DecideBackchannelRequest(req); err != nil {
+		if err == ErrNotFound {
+
+			// it was decided from another page meanwhile.
+			return "The request is invalid or has expired."
+		}
+		s.log.Println(err)
+		return "Something went wrong, please try again."
+	}
+	if client.BackchannelMode == backchannelMode.Ping {
+
+		// the user should not wait on the client's notification endpoint.
+		go func() {
+			if perr := pingClient(client, req); perr != nil {
+				s.log.Println(perr)
+			}
+		}()
+	}
+	if req.Denied {
+		return fmt.Sprintf("%s was denied access to your account.", client.Name)
+	}
+	if err = s.saveConsent(usr, client, req.Scope); err != nil {
+		s.log.Println(err)
+	}
+	return fmt.Sprintf("%s can now access your account.", client.Name)
+}
+
+// pingClient tells a ping mode client that the backchannel authentication request
+// req has concluded, as described in CIBA section 10.2.
+func pingClient(client *Client, req *BackchannelRequest) error {
+	body, err := json.Marshal(map[string]string{params.authReqID: req.AuthReqID})
+	if err != nil {
+		return err
+	}
+	hr, err := http.NewRequest("POST", client.BackchannelNotifyURI, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	hr.Header.Set("Authorization", "Bearer "+req.NotifyToken)
+	res, err := notificationClient.Do(hr)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("hero: client notification endpoint responded with %s", res.Status)
+	}
+	return nil
+}
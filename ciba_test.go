@@ -0,0 +1,18 @@
+package hero
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPingClient(t *testing.T) {
+	client := &Client{BackchannelNotifyURI: "https://127.0.0.1:1/notify"}
+	req := &BackchannelRequest{AuthReqID: "id", NotifyToken: "token"}
+
+	// notification endpoints are given by clients, the server never connects to
+	// its own network.
+	err := pingClient(client, req)
+	if err == nil || !strings.Contains(err.Error(), errNonPublicAddress.Error()) {
+		t.Errorf("expected %v got %v", errNonPublicAddress, err)
+	}
+}
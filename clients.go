@@ -0,0 +1,365 @@
+package hero
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var errNotJSON = errors.New("hero: request body must be JSON")
+
+// clientForm contains the settings users edit on their clients.
+type clientForm struct {
+	Name         string   `json:"client_name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	GrantTypes   []string `json:"grant_types"`
+	Scope        string   `json:"scope"`
+}
+
+// clientFormFrom returns the client settings submitted with the html form r,
+// redirect uris are separated by white space.
+func clientFormFrom(r *http.Request) *clientForm {
+	return &clientForm{
+		Name:         strings.TrimSpace(r.PostForm.Get("client_name")),
+		RedirectURIs: strings.Fields(r.PostForm.Get("redirect_uris")),
+		GrantTypes:   r.PostForm["grant_types"],
+		Scope:        r.PostForm.Get(params.scope),
+	}
+}
+
+// editClient validates f and sets it on client. The response types follow from the
+// grant types.
+func (s *Server) editClient(client *Client, f *clientForm) error {
+	if f.Name == "" || len(f.GrantTypes) == 0 {
+		return errInvalidClientMetadata
+	}
+	var responseTypes []string
+	for _, g := range f.GrantTypes {
+		switch g {
+		case grantType.AuthorizationCode:
+			responseTypes = append(responseTypes, requestType.Code)
+		case grantTypeImplicit:
+			responseTypes = append(responseTypes, requestType.Token)
+		}
+	}
+	if err := s.validGrantTypes(f.GrantTypes, responseTypes); err != nil {
+		return err
+	}
+	if err := s.validRedirectURIs(f.RedirectURIs, f.GrantTypes); err != nil {
+		return err
+	}
+	scope, err := s.validClientScope(client, f.Scope)
+	if err != nil {
+		return err
+	}
+	client.Name = f.Name
+	client.RedirectURL = strings.Join(f.RedirectURIs, s.cfg.RedirSeparator)
+	client.GrantTypes = strings.Join(f.GrantTypes, " ")
+	client.ResponseTypes = strings.Join(responseTypes, " ")
+	client.Scope = scope
+	return nil
+}
+
+// rotateSecret gives client a new secret, which is returned. Only the hash of the
+// secret is kept so it can not be shown again.
+func (s *Server) rotateSecret(client *Client) (string, error) {
+	if client.Public {
+		return "", errInvalidClientMetadata
+	}
+	secret, err := newClientSecret()
+	if err != nil {
+		return "", err
+	}
+	if client.Secret, err = hashString(secret); err != nil {
+		return "", err
+	}
+
+	// client_secret_jwt signs with the secret so it must be kept as is.
+	if client.JWTSecret != "" || client.TokenEndpointAuthMethod == authMethod.SecretJWT {
+		client.JWTSecret = secret
+	}
+	return secret, s.q.SaveClient(client)
+}
+
+// ownClient returns the client identified by the client_id route variable of r if
+// it belongs to usr.
+func (s *Server) ownClient(r *http.Request, usr *User) (*Client, error) {
+	client, err := s.q.ClientByCode(mux.Vars(r)[params.clientID])
+	if err != nil {
+		return nil, err
+	}
+	if usr.ID == 0 || client.UserID != usr.ID {
+		return nil, errors.New("hero: the client belongs to another user")
+	}
+	return client, nil
+}
+
+// setClientData adds client to the template data along with the values its edit
+// form is filled with.
+func (s *Server) setClientData(data map[string]interface{}, client *Client) {
+	selected := make(map[string]bool)
+	for _, g := range strings.Fields(client.GrantTypes) {
+		selected[g] = true
+	}
+	var uris []string
+	if client.RedirectURL != "" {
+		uris = splitURIs(client.RedirectURL, s.cfg.RedirSeparator)
+	}
+	data["Client"] = client
+	data["Selected"] = selected
+	data["RedirectURIs"] = strings.Join(uris, "\n")
+}
+
+// grantTypeOptions returns the grant types users can choose for their clients.
+func (s *Server) grantTypeOptions() []string {
+	return append([]string{grantTypeImplicit}, s.cfg.AllowedAccessType...)
+}
+
+// Client serves the pages where users manage their clients.
+//
+//	GET  ClientsPath                       lists the clients and a form to create one
+//	POST ClientsPath                       creates a client
+//	GET  ClientsPath/{client_id}           shows the client and a form to edit it
+//	POST ClientsPath/{client_id}           updates the client
+//	POST ClientsPath/{client_id}/secret    issues a new client secret
+//	POST ClientsPath/{client_id}/delete    deletes the client
+//
+// Users only see their own clients. Client secrets are generated by hero and shown
+// only on the page that follows their creation.
+func (s *Server) Client(w http.ResponseWriter, r *http.Request) {
+	data := make(map[string]interface{})
+	data[contextParams.Config] = s.cfg
+	render := func(code int) {
+		w.WriteHeader(code)
+		if err := s.view.Render(w, s.cfg.CLientTemplate, data); err != nil {
+			s.log.Println(err)
+		}
+	}
+	fail := func(code int, err error) {
+		data[contextParams.Message] = err.Error()
+		w.WriteHeader(code)
+		_ = s.view.Render(w, s.cfg.ErrorTemplate, data)
+	}
+
+	usr, ok := s.isSession(r)
+	if !ok {
+		http.Redirect(w, r, LoginPath, http.StatusFound)
+		return
+	}
+	csrf, err := s.csrfToken(w, r)
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	data["User"] = usr
+	data["CSRF"] = csrf
+	data["GrantTypes"] = s.grantTypeOptions()
+
+	_ = r.ParseForm()
+	if r.Method == "POST" && !s.validCSRF(r) {
+		fail(http.StatusForbidden, errors.New("invalid csrf token"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	if vars[params.clientID] == "" {
+		code := http.StatusOK
+		if r.Method == "POST" {
+			client := &Client{UUID: s.gen.Generate(), UserID: usr.ID}
+			if err = s.editClient(client, clientFormFrom(r)); err != nil {
+				data[contextParams.Message] = err.Error()
+				code = http.StatusBadRequest
+			} else {
+				var secret string
+				if secret, err = s.rotateSecret(client); err != nil {
+					fail(http.StatusInternalServerError, err)
+					return
+				}
+				s.setClientData(data, client)
+				data["Secret"] = secret
+				render(http.StatusCreated)
+				return
+			}
+		}
+		clients, err := s.q.ClientsByUser(usr.ID)
+		if err != nil {
+			fail(http.StatusInternalServerError, err)
+			return
+		}
+		data["Clients"] = clients
+		render(code)
+		return
+	}
+
+	client, err := s.ownClient(r, usr)
+	if err != nil {
+		fail(http.StatusNotFound, errors.New("client not found"))
+		return
+	}
+	s.setClientData(data, client)
+	if r.Method != "POST" {
+		render(http.StatusOK)
+		return
+	}
+	switch vars["action"] {
+	case "":
+		if err = s.editClient(client, clientFormFrom(r)); err != nil {
+			data[contextParams.Message] = err.Error()
+			render(http.StatusBadRequest)
+			return
+		}
+		if err = s.q.SaveClient(client); err != nil {
+			fail(http.StatusInternalServerError, err)
+			return
+		}
+		http.Redirect(w, r, ClientsPath+"/"+client.UUID, http.StatusFound)
+	case "secret":
+		secret, err := s.rotateSecret(client)
+		if err != nil {
+			data[contextParams.Message] = err.Error()
+			render(http.StatusBadRequest)
+			return
+		}
+		data["Secret"] = secret
+		render(http.StatusOK)
+	case "delete":
+		if err = s.q.DeleteClient(client); err != nil {
+			fail(http.StatusInternalServerError, err)
+			return
+		}
+		http.Redirect(w, r, ClientsPath, http.StatusFound)
+	}
+}
+
+// ClientAPI is the JSON counterpart of Client, it serves the same operations for the
+// user of the session.
+//
+//	GET    ClientsAPIPath                       lists the clients
+//	POST   ClientsAPIPath                       creates a client
+//	GET    ClientsAPIPath/{client_id}           reads the client
+//	PUT    ClientsAPIPath/{client_id}           updates the client
+//	DELETE ClientsAPIPath/{client_id}           deletes the client
+//	POST   ClientsAPIPath/{client_id}/secret    issues a new client secret
+//
+// Request bodies must be JSON, browsers do not send JSON across origins without
+// asking first so the session cookie can not be ridden by other sites.
+func (s *Server) ClientAPI(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(w)
+	commit := func(code int, errID string) {
+		ctx.StatusCode = code
+		if errID != "" {
+			ctx.SetError(errID, "")
+		}
+		_ = ctx.CommitJSON()
+	}
+
+	usr, ok := s.isSession(r)
+	if !ok {
+		commit(http.StatusUnauthorized, errorsKeys.AccessDenied)
+		return
+	}
+	if r.Method != "GET" && r.Method != "DELETE" {
+		typ, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if typ != "application/json" {
+			ctx.InternalError = errNotJSON
+			commit(http.StatusUnsupportedMediaType, errorsKeys.InvalidRequest)
+			return
+		}
+	}
+	decode := func(client *Client) bool {
+		f := &clientForm{}
+		if err := json.NewDecoder(r.Body).Decode(f); err != nil {
+			ctx.InternalError = err
+			commit(http.StatusBadRequest, errorsKeys.InvalidRequest)
+			return false
+		}
+		if err := s.editClient(client, f); err != nil {
+			registrationError(ctx, err)
+			_ = ctx.CommitJSON()
+			return false
+		}
+		return true
+	}
+
+	vars := mux.Vars(r)
+	if vars[params.clientID] == "" {
+		switch r.Method {
+		case "GET":
+			clients, err := s.q.ClientsByUser(usr.ID)
+			if err != nil {
+				ctx.InternalError = err
+				commit(http.StatusInternalServerError, errorsKeys.ServerError)
+				return
+			}
+			list := []map[string]interface{}{}
+			for i := range clients {
+				list = append(list, s.clientMetadataOf(&clients[i]))
+			}
+			ctx.SetData("clients", list)
+			commit(http.StatusOK, "")
+		case "POST":
+			client := &Client{UUID: s.gen.Generate(), UserID: usr.ID}
+			if !decode(client) {
+				return
+			}
+			secret, err := s.rotateSecret(client)
+			if err != nil {
+				ctx.InternalError = err
+				commit(http.StatusInternalServerError, errorsKeys.ServerError)
+				return
+			}
+			ctx.Data = s.clientMetadataOf(client)
+			ctx.SetData(params.clientSecret, secret)
+			commit(http.StatusCreated, "")
+		default:
+			commit(http.StatusMethodNotAllowed, errorsKeys.InvalidRequest)
+		}
+		return
+	}
+
+	client, err := s.ownClient(r, usr)
+	if err != nil {
+		ctx.InternalError = err
+		commit(http.StatusNotFound, errorsKeys.InvalidRequest)
+		return
+	}
+	switch {
+	case vars["action"] == "secret" && r.Method == "POST":
+		secret, err := s.rotateSecret(client)
+		if err != nil {
+			registrationError(ctx, err)
+			_ = ctx.CommitJSON()
+			return
+		}
+		ctx.SetData(params.clientID, client.UUID)
+		ctx.SetData(params.clientSecret, secret)
+		commit(http.StatusOK, "")
+	case r.Method == "GET":
+		ctx.Data = s.clientMetadataOf(client)
+		commit(http.StatusOK, "")
+	case r.Method == "PUT":
+		if !decode(client) {
+			return
+		}
+		if err = s.q.SaveClient(client); err != nil {
+			ctx.InternalError = err
+			commit(http.StatusInternalServerError, errorsKeys.ServerError)
+			return
+		}
+		ctx.Data = s.clientMetadataOf(client)
+		commit(http.StatusOK, "")
+	case r.Method == "DELETE":
+		if err = s.q.DeleteClient(client); err != nil {
+			ctx.InternalError = err
+			commit(http.StatusInternalServerError, errorsKeys.ServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		commit(http.StatusMethodNotAllowed, errorsKeys.InvalidRequest)
+	}
+}
@@ -0,0 +1,106 @@
+package hero
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// consentParams contains the consent form parameters.
+var consentParams = struct {
+	decision, allow, deny string
+
+	// prompt is the value of the prompt parameter that forces the consent screen
+	// even when the user has consented before.
+	prompt string
+}{
+	"consent", "allow", "deny",
+	"consent",
+}
+
+var errConsentDenied = errors.New("hero: the user denied consent")
+
+// consent returns true when usr has consented to client being granted scope and the
+// JSON encoded authorization details.
+//
+// Consent is remembered, the user is only asked again when the client requests
+// scopes that were not allowed before or prompt=consent is sent. Authorization
+// details describe a single transaction so they are always shown. While the user
+// is yet to decide, the consent screen is rendered to w and false is returned.
+// errConsentDenied is returned when the user declines.
+func (s *Server) consent(w http.ResponseWriter, r *http.Request, usr *User, client *Client, scope, details string) (bool, error) {
+	if r.Method == "POST" && s.validCSRF(r) {
+		switch r.PostForm.Get(consentParams.decision) {
+		case consentParams.allow:
+			if err := s.saveConsent(usr, client, scope); err != nil {
+				return false, err
+			}
+			return true, nil
+		case consentParams.deny:
+			return false, errConsentDenied
+		}
+	}
+
+	if details == "" && !hasPrompt(r.Form.Get(params.prompt), consentParams.prompt) {
+		c, err := s.q.ConsentByClient(usr.ID, client.ID)
+		if err == nil && coversScope(c.Scope, scope) {
+			return true, nil
+		}
+	}
+
+	csrf, err := s.csrfToken(w, r)
+	if err != nil {
+		return false, err
+	}
+
+	// parameters posted to the authorization endpoint are carried through the
+	// consent form, login credentials are left out.
+	carry := url.Values{}
+	for k, v := range r.PostForm {
+		switch k {
+		case loginParams.username, loginParams.password, params.csrfToken, consentParams.decision:
+			continue
+		}
+		carry[k] = v
+	}
+
+	data := make(map[string]interface{})
+	data["Config"] = s.cfg
+	data["Title"] = "consent"
+	data["Action"] = r.URL.String()
+	data["Params"] = carry
+	data["User"] = usr
+	data["Client"] = client
+	data["Scopes"] = s.describeScopes(scope)
+	data["Details"] = s.describeDetails(details)
+	data["CSRF"] = csrf
+	if err = s.view.Render(w, s.cfg.ConsentTemplate, data); err != nil {
+		s.log.Println(err)
+	}
+	return false, nil
+}
+
+// saveConsent remembers that usr allowed client to be granted scope, on top of what
+// was allowed before.
+func (s *Server) saveConsent(usr *User, client *Client, scope string) error {
+	c, err := s.q.ConsentByClient(usr.ID, client.ID)
+	if err != nil {
+		if err != ErrNotFound {
+			return err
+		}
+		c = &Consent{UserID: usr.ID, ClientID: client.ID}
+	}
+	c.Scope = mergeScopes(c.Scope, scope)
+	return s.q.SaveConsent(c)
+}
+
+// hasPrompt returns true if value is in the space delimited prompt list.
+func hasPrompt(prompt, value string) bool {
+	for _, v := range strings.Fields(prompt) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -50,6 +50,14 @@ type context struct {
 
 	RedirectInFragment bool
 
+	// CertThumbprint is the SHA-256 thumbprint of the TLS client certificate the
+	// access tokens are bound to.
+	CertThumbprint string
+
+	// DPoPThumbprint is the JWK thumbprint of the DPoP key the access tokens are
+	// bound to.
+	DPoPThumbprint string
+
 	Response http.ResponseWriter
 }
 
@@ -0,0 +1,42 @@
+package hero
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+// csrfKey is the session key of the csrf token.
+const csrfKey = "csrf_token"
+
+// csrfToken returns the csrf token of the user's session, a new one is saved to the
+// session if there is none yet. Forms that act on behalf of a logged in user must
+// include it in the csrf_token field.
+func (s *Server) csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	ss, err := s.store.Get(r, s.cfg.SessionName)
+	if err != nil {
+		s.log.Println(err)
+	}
+	if tok, ok := ss.Values[csrfKey].(string); ok && tok != "" {
+		return tok, nil
+	}
+	b, err := generateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	tok := base64.RawURLEncoding.EncodeToString(b)
+	ss.Values[csrfKey] = tok
+	return tok, ss.Save(r, w)
+}
+
+// validCSRF returns true if the csrf_token submitted with the form r matches the
+// one in the user's session.
+func (s *Server) validCSRF(r *http.Request) bool {
+	ss, _ := s.store.Get(r, s.cfg.SessionName)
+	tok, ok := ss.Values[csrfKey].(string)
+	if !ok || tok == "" {
+		return false
+	}
+	sent := r.PostForm.Get(params.csrfToken)
+	return subtle.ConstantTimeCompare([]byte(tok), []byte(sent)) == 1
+}
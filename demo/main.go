@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 
 	"github.com/gernest/hero"
@@ -27,11 +28,12 @@ func main() {
 		Secret: "mysecret",
 	}
 
-	heroCfg := hero.DefaultConfig()
-
 	heroURL := "http://localhost:8000"
 	demoserver := "http://localhost:8001"
 
+	heroCfg := hero.DefaultConfig()
+	heroCfg.Issuer = heroURL
+
 	s := hero.NewServer(heroCfg, &hero.SimpleTokenGen{}, nil)
 	s.DropAllTables()
 	s.Migrate()
@@ -40,12 +42,24 @@ func main() {
 	cUsr := usr
 	s.TestClient(&cUsr, &cCliet)
 
+	ln, err := net.Listen("tcp", ":8000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go http.Serve(ln, s)
+
+	// the endpoints are discovered from the authorization server metadata.
+	md, err := discover(heroURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	clientCfg := &client.Config{
 		ProviderName:        "hero",
 		ProviderDisplayName: "Hero",
-		AuthURL:             fmt.Sprintf("%s%s", heroURL, heroCfg.AuthEndpoint),
-		TokenURL:            fmt.Sprintf("%s%s", heroURL, heroCfg.TokenEndpoint),
-		ProfileURL:          heroURL + heroCfg.InfoEndpoint,
+		AuthURL:             md.AuthorizationEndpoint,
+		TokenURL:            md.TokenEndpoint,
+		ProfileURL:          md.UserinfoEndpoint,
 		CLientID:            genericClient.UUID,
 		CLientSecret:        genericClient.Secret,
 		DefaultScope:        "user",
@@ -132,7 +146,27 @@ func main() {
 		//return goweb.Respond.WithRedirect(ctx, afterUrl)
 	})
 
-	go http.ListenAndServe(":8000", s)
 	log.Println(" visit server at " + demoserver + "/login")
 	log.Fatal(http.ListenAndServe(":8001", demo))
 }
+
+// metadata is the part of the authorization server metadata used by the demo.
+type metadata struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// discover fetches the authorization server metadata of the issuer.
+func discover(issuer string) (*metadata, error) {
+	res, err := http.Get(issuer + hero.AuthServerMetadataPath)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("demo: fetching metadata failed with %s", res.Status)
+	}
+	md := &metadata{}
+	return md, json.NewDecoder(res.Body).Decode(md)
+}
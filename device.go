@@ -0,0 +1,354 @@
+package hero
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userCodeChars are the characters of user codes, vowels are left out so codes do
+// not spell words and there are no characters that look alike.
+const userCodeChars = "BCDFGHJKLMNPQRSTVWXZ"
+
+// userCodeLength is the number of characters in a user code.
+const userCodeLength = 8
+
+// newUserCode returns a random user code.
+func newUserCode() (string, error) {
+	max := big.NewInt(int64(len(userCodeChars)))
+	code := make([]byte, userCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeChars[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// formatUserCode returns code the way it is shown to users e.g WDJB-MJHT.
+func formatUserCode(code string) string {
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// normalizeUserCode returns the user code entered by a user the way it is stored,
+// dashes and spaces are removed and the case is ignored.
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
+
+// DeviceAuthorization provide the device authorization endpoint of RFC 8628. Clients
+// on devices that can not use a browser get a device code to poll the token endpoint
+// with, and a user code which the user enters on the verification page.
+func (s *Server) DeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(w)
+	if r.Method != "POST" {
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		ctx.InternalError = errors.New("request must be POST")
+		_ = ctx.CommitJSON()
+		return
+	}
+	_ = r.ParseForm()
+
+	auth, err := requestClientAuth(r)
+	if err != nil {
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errorsKeys.InvalidClient, "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+	client := s.getClient(auth)
+	if client == nil {
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errorsKeys.InvalidClient, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+	if !s.cfg.AccessAllowed(grantType.DeviceCode) || !client.AllowsGrant(grantType.DeviceCode) {
+		ctx.StatusCode = http.StatusBadRequest
+		ctx.SetError(errorsKeys.UnauthorizedClient, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	scope, err := s.validScope(client, r.Form.Get(params.scope))
+	if err != nil {
+		ctx.StatusCode = http.StatusBadRequest
+		ctx.SetError(scopeError(err), "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	userCode, err := newUserCode()
+	if err != nil {
+		ctx.StatusCode = http.StatusInternalServerError
+		ctx.SetError(errorsKeys.ServerError, "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+	d := &DeviceAuthorization{
+		DeviceCode: s.gen.Generate(),
+		UserCode:   userCode,
+		ClientID:   client.ID,
+		Scope:      scope,
+		ExpiresIn:  s.cfg.DeviceExpire,
+		Interval:   s.cfg.DeviceInterval,
+	}
+	if err = s.q.SaveDevice(d); err != nil {
+		ctx.StatusCode = http.StatusInternalServerError
+		ctx.SetError(errorsKeys.ServerError, "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	verify := s.cfg.EndpointURL(s.cfg.DeviceVerifyPath)
+	complete := url.Values{params.userCode: {formatUserCode(userCode)}}
+	ctx.SetData(params.deviceCode, d.DeviceCode)
+	ctx.SetData(params.userCode, formatUserCode(userCode))
+	ctx.SetData("verification_uri", verify)
+	ctx.SetData("verification_uri_complete", verify+"?"+complete.Encode())
+	ctx.SetData(params.expiresIn, d.ExpiresIn)
+	ctx.SetData("interval", d.Interval)
+	_ = ctx.CommitJSON()
+}
+
+// deviceAccess responds to client polling the token endpoint with the device code.
+// The access token is issued once the user has approved the device.
+func (s *Server) deviceAccess(client *Client, code string, ctx *context) {
+	d, err := s.q.DeviceByCode(code)
+	if err != nil || d.ClientID != client.ID {
+		ctx.SetError(errorsKeys.InvalidGrant, "")
+		ctx.InternalError = err
+		return
+	}
+
+	var errID string
+	switch {
+	case d.IsExpired():
+		errID = errorsKeys.ExpiredToken
+	case d.Denied:
+		errID = errorsKeys.AccessDenied
+	}
+	if errID != "" || d.Approved {
+
+		// the request has concluded, it is claimed before anything is issued so
+		// the device code can not be used again, even by concurrent polls.
+		if err = s.q.ClaimDevice(d.ID); err != nil {
+			ctx.StatusCode = http.StatusBadRequest
+			ctx.SetError(errorsKeys.InvalidGrant, "")
+			ctx.InternalError = err
+			return
+		}
+		if errID != "" {
+			ctx.StatusCode = http.StatusBadRequest
+			ctx.SetError(errID, "")
+			return
+		}
+		grant := &Grant{
+			Scope:    d.Scope,
+			ClientID: d.ClientID,
+			UserID:   d.UserID,
+			AuthTime: d.UpdatedAt.Unix(),
+		}
+		if _, err = s.finalizeAccess(grant, ctx); err != nil {
+			ctx.SetError(errorsKeys.ServerError, "")
+			ctx.InternalError = err
+		}
+		return
+	}
+
+	// devices polling faster than they were told to wait 5 more seconds from now on.
+	now := time.Now().Unix()
+	errID = errorsKeys.AuthorizationPending
+	if d.LastPoll != 0 && now-d.LastPoll < d.Interval {
+		d.Interval += 5
+		errID = errorsKeys.SlowDown
+	}
+	d.LastPoll = now
+	if err = s.q.PollDevice(d); err != nil {
+		ctx.InternalError = err
+	}
+	ctx.StatusCode = http.StatusBadRequest
+	ctx.SetError(errID, "")
+}
+
+// DeviceVerify is the page where logged in users enter the user code shown on their
+// device, and approve or deny the device access to their account.
+func (s *Server) DeviceVerify(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	data := make(map[string]interface{})
+	data["Config"] = s.cfg
+	data["Title"] = "device"
+	data["Action"] = s.cfg.DeviceVerifyPath
+
+	usr, ok := s.isSession(r)
+	if !ok && r.Method == "POST" {
+		usr = s.validUser(r, r.Form.Get(loginParams.username), r.Form.Get(loginParams.password))
+		if usr != nil {
+			if serr := s.SaveToSession(w, r, "UserID", usr.ID); serr != nil {
+				s.log.Println(serr)
+			}
+			ok = true
+		}
+	}
+	if !ok {
+		data["Title"] = "login"
+		data["Action"] = r.URL.String()
+		if err := s.view.Render(w, s.cfg.LoginTemplate, data); err != nil {
+			s.log.Println(err)
+		}
+		return
+	}
+
+	csrf, err := s.csrfToken(w, r)
+	if err != nil {
+		s.log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	data["User"] = usr
+	data["CSRF"] = csrf
+
+	if code := normalizeUserCode(r.Form.Get(params.userCode)); code != "" {
+		data[contextParams.Message] = s.verifyDevice(r, usr, code, data)
+	}
+	if err = s.view.Render(w, s.cfg.DeviceTemplate, data); err != nil {
+		s.log.Println(err)
+	}
+}
+
+// verifyDevice records the decision of usr about the device whose user code is code,
+// it returns the message shown to the user. When the user is yet to decide data
+// gets the client and scopes to show.
+//
+// Users and addresses entering Config.DeviceAttempts invalid codes are refused for
+// Config.DeviceExpire seconds so user codes can not be guessed, as required by RFC
+// 8628 section 5.1.
+func (s *Server) verifyDevice(r *http.Request, usr *User, code string, data map[string]interface{}) string {
+	keys := []string{fmt.Sprintf("user:%d", usr.ID), "addr:" + remoteHost(r)}
+	window := time.Duration(s.cfg.DeviceExpire) * time.Second
+	for _, k := range keys {
+		if !s.deviceAttempts.allowed(k, s.cfg.DeviceAttempts, window) {
+			return "Too many invalid codes, please try again later."
+		}
+	}
+	d, err := s.q.DeviceByUserCode(code)
+	if err != nil || d.IsExpired() || d.Approved || d.Denied {
+		for _, k := range keys {
+			s.deviceAttempts.fail(k, window)
+		}
+		return "The code is invalid or has expired."
+	}
+	client, err := s.q.ClientByID(d.ClientID)
+	if err != nil {
+		s.log.Println(err)
+		return "The code is invalid or has expired."
+	}
+
+	var decision string
+	if r.Method == "POST" && s.validCSRF(r) {
+		decision = r.PostForm.Get(consentParams.decision)
+	}
+	switch decision {
+	case consentParams.allow, consentParams.deny:
+		d.UserID = usr.ID
+		d.Approved = decision == consentParams.allow
+		d.Denied = !d.Approved
+		if err = s.q.DecideDevice(d); err != nil {
+			if err == ErrNotFound {
+
+				// it was decided from another page meanwhile.
+				return "The code is invalid or has expired."
+			}
+			s.log.Println(err)
+			return "Something went wrong, please try again."
+		}
+		if d.Denied {
+			return "The device was denied access to your account."
+		}
+		if err = s.saveConsent(usr, client, d.Scope); err != nil {
+			s.log.Println(err)
+		}
+		return "The device is now connected to your account, you can return to it."
+	}
+	data["UserCode"] = formatUserCode(d.UserCode)
+	data["Client"] = client
+	data["Scopes"] = s.describeScopes(d.Scope)
+	return ""
+}
+
+// remoteHost returns the address of the host r came from.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// attemptLimiter counts failed attempts by key, the count of a key is reset once
+// the window it started expires.
+//
+// It is safe for concurrent use.
+type attemptLimiter struct {
+	mu   sync.Mutex
+	seen map[string]*attempts
+}
+
+type attempts struct {
+	count int64
+	since time.Time
+}
+
+func newAttemptLimiter() *attemptLimiter {
+	return &attemptLimiter{seen: make(map[string]*attempts)}
+}
+
+// allowed returns true if key failed less than max times within window, there is no
+// limit when max is zero.
+func (l *attemptLimiter) allowed(key string, max int64, window time.Duration) bool {
+	if max <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.seen[key]
+	return !ok || time.Since(a.since) > window || a.count < max
+}
+
+// fail records a failed attempt by key, expired counts are dropped along the way.
+func (l *attemptLimiter) fail(key string, window time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, a := range l.seen {
+		if time.Since(a.since) > window {
+			delete(l.seen, k)
+		}
+	}
+	a, ok := l.seen[key]
+	if !ok {
+		a = &attempts{since: time.Now()}
+		l.seen[key] = a
+	}
+	a.count++
+}
@@ -0,0 +1,28 @@
+package hero
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUserCode(t *testing.T) {
+	code, err := newUserCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != userCodeLength {
+		t.Errorf("expected %d characters got %s", userCodeLength, code)
+	}
+	for _, c := range code {
+		if !strings.ContainsRune(userCodeChars, c) {
+			t.Errorf("unexpected character %c in %s", c, code)
+		}
+	}
+	shown := formatUserCode("WDJBMJHT")
+	if shown != "WDJB-MJHT" {
+		t.Errorf("expected WDJB-MJHT got %s", shown)
+	}
+	if n := normalizeUserCode("wdjb - mjht"); n != "WDJBMJHT" {
+		t.Errorf("expected WDJBMJHT got %s", n)
+	}
+}
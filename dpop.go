@@ -0,0 +1,186 @@
+package hero
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// dpopHeader is the header carrying the DPoP proof, and the authorization scheme
+// of DPoP bound access tokens.
+const dpopHeader = "DPoP"
+
+var errInvalidDPoPProof = errors.New("hero: invalid DPoP proof")
+
+// dpopProof verifies the DPoP proof sent with r as described in RFC 9449 section
+// 4.3 and returns the JWK thumbprint of the key that signed it. accessToken is the
+// token the proof is presented with, it is empty at the token endpoint.
+func (s *Server) dpopProof(r *http.Request, accessToken string) (string, error) {
+	proofs := r.Header[http.CanonicalHeaderKey(dpopHeader)]
+	if len(proofs) != 1 {
+		return "", errInvalidDPoPProof
+	}
+	var key *jwk
+	token, err := jwt.Parse(proofs[0], func(t *jwt.Token) (interface{}, error) {
+		if typ, _ := t.Header["typ"].(string); typ != "dpop+jwt" {
+			return nil, errInvalidDPoPProof
+		}
+		header, ok := t.Header["jwk"].(map[string]interface{})
+		if !ok {
+			return nil, errInvalidDPoPProof
+		}
+
+		// the proof must carry the public key only.
+		if _, ok = header["d"]; ok {
+			return nil, errInvalidDPoPProof
+		}
+		data, err := json.Marshal(header)
+		if err != nil {
+			return nil, err
+		}
+		key = &jwk{}
+		if err = json.Unmarshal(data, key); err != nil {
+			return nil, err
+		}
+		if !key.Allows(t.Method.Alg()) {
+			return nil, errUnsupportedSignAlg
+		}
+		return key.PublicKey()
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims := token.Claims
+	if htm, _ := claims["htm"].(string); htm != r.Method {
+		return "", errInvalidDPoPProof
+	}
+	if htu, _ := claims["htu"].(string); !s.matchHTU(htu, r) {
+		return "", errInvalidDPoPProof
+	}
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return "", errInvalidDPoPProof
+	}
+	lifetime := s.cfg.DPoPProofLifetime
+	if age := time.Now().Unix() - int64(iat); age > lifetime || age < -lifetime {
+		return "", errInvalidDPoPProof
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if ath, _ := claims["ath"].(string); ath != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return "", errInvalidDPoPProof
+		}
+	}
+	jkt, err := key.Thumbprint()
+	if err != nil {
+		return "", err
+	}
+
+	// proofs are unique per key, they are remembered until they are too old to
+	// be accepted anyway.
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return "", errInvalidDPoPProof
+	}
+	if err = s.q.UseJTI(0, jkt+":"+jti, int64(iat)+lifetime); err != nil {
+		return "", err
+	}
+	return jkt, nil
+}
+
+// matchHTU returns true if htu, the htu claim of a DPoP proof, is the url r was
+// sent to. The query and fragment are ignored.
+func (s *Server) matchHTU(htu string, r *http.Request) bool {
+	u, err := url.Parse(htu)
+	if err != nil || htu == "" {
+		return false
+	}
+	u.RawQuery, u.Fragment = "", ""
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	switch u.String() {
+	case s.cfg.EndpointURL(r.URL.Path), scheme + "://" + r.Host + r.URL.Path:
+		return true
+	}
+	return false
+}
+
+// tokenType returns the token_type of the access token of g.
+func (s *Server) tokenType(g *Grant) string {
+	if g.DPoPThumbprint != "" {
+		return dpopHeader
+	}
+	return s.cfg.TokenType
+}
+
+// tokenBinding returns the error to respond with when the access token of g, sent
+// with r, is bound to a certificate or a DPoP key that r does not prove
+// possession of. An empty string is returned when the token may be used.
+func (s *Server) tokenBinding(g *Grant, bearer *bearerAuth, r *http.Request) string {
+	if g.DPoPThumbprint == "" {
+		if bearer.DPoP {
+			return errorsKeys.InvalidToken
+		}
+		return possession(g, r, "")
+	}
+	if !bearer.DPoP {
+		return errorsKeys.InvalidToken
+	}
+	jkt, err := s.dpopProof(r, bearer.Code)
+	if err != nil {
+		return errorsKeys.InvalidDPoPProof
+	}
+	return possession(g, r, jkt)
+}
+
+// possession returns the error to respond with when r does not prove possession of
+// the certificate or the DPoP key the access token of g is bound to, jkt is the
+// thumbprint of the key that signed the verified DPoP proof of r.
+func possession(g *Grant, r *http.Request, jkt string) string {
+	if !certBound(g, r) {
+		return errorsKeys.InvalidToken
+	}
+	if g.DPoPThumbprint != "" && g.DPoPThumbprint != jkt {
+		return errorsKeys.InvalidDPoPProof
+	}
+	return ""
+}
+
+// Protect returns a handler that serves h only to requests with a valid access
+// token, resource servers sharing hero's database use it to guard their
+// endpoints. Tokens bound to a certificate or a DPoP key must be presented over
+// the same certificate or with a DPoP proof signed by the same key.
+func (s *Server) Protect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errID := errorsKeys.InvalidToken
+		bearer := checkBearerAuth(r)
+		if bearer != nil && bearer.Code != "" {
+			grant, err := s.q.GrantByBearer(bearer.Code)
+			if err == nil && !grant.IsExpired() {
+				errID = s.tokenBinding(grant, bearer, r)
+			}
+		}
+		if errID == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx := newContext(w)
+		scheme := "Bearer"
+		if bearer != nil && bearer.DPoP {
+			scheme = dpopHeader
+		}
+		ctx.Headers.Set("WWW-Authenticate", scheme+` error="`+errID+`"`)
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errID, "")
+		_ = ctx.CommitJSON()
+	})
+}
@@ -16,6 +16,21 @@ var errorsKeys = struct {
 	UnsupportedGrantType    string
 	InvalidGrant            string
 	InvalidClient           string
+	UnsupportedTokenType    string
+	InsufficientScope       string
+	AuthorizationPending    string
+	SlowDown                string
+	ExpiredToken            string
+	InvalidToken            string
+	InvalidDPoPProof        string
+	InvalidRedirectURI      string
+	InvalidClientMetadata   string
+	InvalidRequestURI       string
+	InvalidRequestObject    string
+	InvalidTarget           string
+	InvalidAuthDetails      string
+	UnknownUserID           string
+	InvalidBindingMessage   string
 }{
 	"invalid_request",
 	"unauthorized_client",
@@ -27,6 +42,21 @@ var errorsKeys = struct {
 	"unsupported_grant_type",
 	"invalid_grant",
 	"invalid_client",
+	"unsupported_token_type",
+	"insufficient_scope",
+	"authorization_pending",
+	"slow_down",
+	"expired_token",
+	"invalid_token",
+	"invalid_dpop_proof",
+	"invalid_redirect_uri",
+	"invalid_client_metadata",
+	"invalid_request_uri",
+	"invalid_request_object",
+	"invalid_target",
+	"invalid_authorization_details",
+	"unknown_user_id",
+	"invalid_binding_message",
 }
 
 //oauthErrors map of oauth2 error codes and descriptions
@@ -45,6 +75,14 @@ func (o oauthErrors) Get(key string) string {
 // http://tools.ietf.org/html/rfc6749#section-4.2.2.1
 // http://tools.ietf.org/html/rfc6749#section-5.2
 // http://tools.ietf.org/html/rfc6749#section-7.2
+// http://tools.ietf.org/html/rfc7009#section-2.2.1
+// http://tools.ietf.org/html/rfc6750#section-3.1
+// http://tools.ietf.org/html/rfc8628#section-3.5
+// http://tools.ietf.org/html/rfc9449#section-5
+// http://tools.ietf.org/html/rfc7591#section-3.2.2
+// http://tools.ietf.org/html/rfc8707#section-2
+// http://tools.ietf.org/html/rfc9396#section-5
+// https://openid.net/specs/openid-client-initiated-backchannel-authentication-core-1_0.html#auth_error_response
 var baseOauthErrs = oauthErrors{
 	errorsKeys.InvalidRequest:          "The request is missing a required parameter, includes an invalid parameter value, includes a parameter more than once, or is otherwise malformed.",
 	errorsKeys.UnauthorizedClient:      "The client is not authorized to request a token using this method.",
@@ -56,4 +94,17 @@ var baseOauthErrs = oauthErrors{
 	errorsKeys.UnsupportedGrantType:    "The authorization grant type is not supported by the authorization server.",
 	errorsKeys.InvalidGrant:            "The provided authorization grant (e.g., authorization code, resource owner credentials) or refresh token is invalid, expired, revoked, does not match the redirection URI used in the authorization request, or was issued to another client.",
 	errorsKeys.InvalidClient:           "Client authentication failed (e.g., unknown client, no client authentication included, or unsupported authentication method).",
+	errorsKeys.UnsupportedTokenType:    "The authorization server does not support the revocation of the presented token type.",
+	errorsKeys.InsufficientScope:       "The request requires higher privileges than provided by the access token.",
+	errorsKeys.AuthorizationPending:    "The authorization request is still pending as the end user hasn't yet completed the user-interaction steps.",
+	errorsKeys.SlowDown:                "The authorization request is still pending and polling should continue, but the interval MUST be increased by 5 seconds for this and all subsequent requests.",
+	errorsKeys.ExpiredToken:            "The device_code has expired, and the device authorization session has concluded.",
+	errorsKeys.InvalidToken:            "The access token provided is expired, revoked, malformed, or invalid for other reasons.",
+	errorsKeys.InvalidDPoPProof:        "The DPoP proof is missing, malformed, or does not match the request or the access token.",
+	errorsKeys.InvalidRedirectURI:      "The value of one or more redirection URIs is invalid.",
+	errorsKeys.InvalidClientMetadata:   "The value of one of the client metadata fields is invalid and the server has rejected this request.",
+	errorsKeys.InvalidTarget:           "The requested resource is invalid, missing, unknown, or malformed.",
+	errorsKeys.InvalidAuthDetails:      "The authorization details are invalid, use unknown types, or exceed what was authorized.",
+	errorsKeys.UnknownUserID:           "The OpenID Provider is not able to identify which end-user the Client wishes to be authenticated by means of the hint provided in the request.",
+	errorsKeys.InvalidBindingMessage:   "The binding message is invalid or unacceptable for use in the context of the given request.",
 }
@@ -0,0 +1,194 @@
+package hero
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// tokenTypeID contains the token type identifiers of RFC 8693 section 3.
+var tokenTypeID = struct {
+	AccessToken, RefreshToken, IDToken, JWT string
+}{
+	"urn:ietf:params:oauth:token-type:access_token",
+	"urn:ietf:params:oauth:token-type:refresh_token",
+	"urn:ietf:params:oauth:token-type:id_token",
+	"urn:ietf:params:oauth:token-type:jwt",
+}
+
+var (
+	errUnsupportedTokenType = errors.New("hero: unsupported token type")
+	errExpiredToken         = errors.New("hero: the token is expired")
+	errUnboundToken         = errors.New("hero: the token is bound to another certificate or key")
+)
+
+// tokenExchange issues client an access token in exchange for the subject token
+// in form, as described in RFC 8693 section 2. The new token is for the same user
+// and at most the scope of the subject token. It can be aimed at other audiences
+// and, when an actor token is sent, records who acts on behalf of the subject in
+// the act claim.
+//
+// Tokens bound to a certificate or a DPoP key are only exchanged by requests proving
+// possession of it. The issued token has no refresh token unless
+// Config.ExchangeRefresh is set.
+func (s *Server) tokenExchange(client *Client, r *http.Request, ctx *context) {
+	form := r.Form
+	if client.Public {
+		ctx.SetError(errorsKeys.UnauthorizedClient, "")
+		return
+	}
+	if typ := form.Get(params.requestedTokenType); typ != "" && typ != tokenTypeID.AccessToken {
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		ctx.InternalError = errUnsupportedTokenType
+		return
+	}
+	subject, err := s.exchangedGrant(r, ctx, form.Get(params.subjectToken), form.Get(params.subjectTokenType))
+	if err != nil {
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		ctx.InternalError = err
+		return
+	}
+
+	// the delegation chain of the subject token is carried on, the actor becomes
+	// the current one.
+	act := subject.Act
+	if token := form.Get(params.actorToken); token != "" {
+		actor, err := s.exchangedGrant(r, ctx, token, form.Get(params.actorTokenType))
+		if err != nil {
+			ctx.SetError(errorsKeys.InvalidRequest, "")
+			ctx.InternalError = err
+			return
+		}
+		if act, err = s.actClaim(actor, subject.Act); err != nil {
+			ctx.SetError(errorsKeys.ServerError, "")
+			ctx.InternalError = err
+			return
+		}
+	} else if form.Get(params.actorTokenType) != "" {
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		return
+	}
+
+	// the exchanged token can only be narrowed.
+	scope := subject.Scope
+	if v := form.Get(params.scope); v != "" {
+		if !coversScope(subject.Scope, v) {
+			ctx.SetError(errorsKeys.InvalidScope, "")
+			return
+		}
+		scope = strings.Join(parseScope(v), " ")
+	}
+
+	audience, err := s.targetAudience(form, scope)
+	if err != nil {
+		ctx.SetError(targetError(err), "")
+		ctx.InternalError = err
+		return
+	}
+	details, err := s.narrowDetails(subject.AuthorizationDetails, form.Get(params.authDetails))
+	if err != nil {
+		ctx.SetError(detailsError(err), "")
+		ctx.InternalError = err
+		return
+	}
+
+	grant := &Grant{
+		Type:     grantType.TokenExchange,
+		Scope:    scope,
+		ClientID: client.ID,
+		UserID:   subject.UserID,
+		AuthTime: subject.AuthTime,
+		Audience: audience,
+		Act:      act,
+
+		AuthorizationDetails: details,
+	}
+	if _, err = s.finalizeAccess(grant, ctx); err != nil {
+		ctx.SetError(errorsKeys.ServerError, "")
+		ctx.InternalError = err
+		return
+	}
+	ctx.SetData(params.issuedTokenType, tokenTypeID.AccessToken)
+}
+
+// exchangedGrant returns the grant of token, a subject or actor token of the type
+// typ sent with r. Only access tokens issued by hero that have not expired are
+// accepted, and bound tokens only when r proves possession of their key.
+func (s *Server) exchangedGrant(r *http.Request, ctx *context, token, typ string) (*Grant, error) {
+	if typ != tokenTypeID.AccessToken {
+		return nil, errUnsupportedTokenType
+	}
+	if _, err := s.q.TokenByCode(token); err != nil {
+		return nil, err
+	}
+	g, err := s.q.GrantByBearer(token)
+	if err != nil {
+		return nil, err
+	}
+	if g.IsExpired() {
+		return nil, errExpiredToken
+	}
+	if possession(g, r, ctx.DPoPThumbprint) != "" {
+		return nil, errUnboundToken
+	}
+	return g, nil
+}
+
+// actClaim returns the act claim naming the subject of the actor grant as the
+// current actor, prior is the act claim of the subject token which is nested in
+// it as described in RFC 8693 section 4.1.
+func (s *Server) actClaim(actor *Grant, prior string) (string, error) {
+	client, err := s.q.ClientByID(actor.ClientID)
+	if err != nil {
+		return "", err
+	}
+	act := map[string]interface{}{
+		"sub":           client.UUID,
+		params.clientID: client.UUID,
+	}
+	if actor.UserID != 0 {
+		act["sub"] = strconv.FormatInt(actor.UserID, 10)
+	}
+	if prior != "" {
+		act["act"] = json.RawMessage(prior)
+	}
+	b, err := json.Marshal(act)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// targetAudience returns the space delimited audience of the token requested with
+// form, it is made of the audience and resource parameters. Audiences name
+// registered resources or clients, resources must be registered and accept scope.
+func (s *Server) targetAudience(form url.Values, scope string) (string, error) {
+	var audience []string
+	for _, v := range form[params.audience] {
+		if v == "" || strings.ContainsAny(v, " ") || !s.knownAudience(v) {
+			return "", errInvalidTarget
+		}
+		audience = append(audience, v)
+	}
+	resources, err := s.resourceAudience(form, scope)
+	if err != nil {
+		return "", err
+	}
+	if resources != "" {
+		audience = append(audience, resources)
+	}
+	return strings.Join(audience, " "), nil
+}
+
+// knownAudience returns true if audience is the identifier of a registered resource
+// or the client_id of a client.
+func (s *Server) knownAudience(audience string) bool {
+	if _, err := s.q.ResourceByIdentifier(audience); err == nil {
+		return true
+	}
+	_, err := s.q.ClientByCode(audience)
+	return err == nil
+}
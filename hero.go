@@ -2,14 +2,18 @@
 package hero
 
 import (
+	"crypto/x509"
 	"errors"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	// load mysql driver.
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
 
 	// loag postgres driver
 	_ "github.com/lib/pq"
@@ -27,33 +31,85 @@ var (
 	grantType = struct {
 		AuthorizationCode, RefreshToken string
 		Password, ClientCredentials     string
-		Assertion, Implicit             string
+		JWTBearer, Implicit             string
+		DeviceCode, TokenExchange       string
+		CIBA                            string
 	}{
 		"authorization_code", "refresh_token",
 		"password", "client_credentials",
-		"assertion", "__implicit",
+		"urn:ietf:params:oauth:grant-type:jwt-bearer", "__implicit",
+		"urn:ietf:params:oauth:grant-type:device_code",
+		"urn:ietf:params:oauth:grant-type:token-exchange",
+		"urn:openid:params:grant-type:ciba",
+	}
+
+	// tokenTypeHint contains the token types a client can hint at when revoking or
+	// introspecting tokens.
+	tokenTypeHint = struct {
+		AccessToken, RefreshToken string
+	}{"access_token", "refresh_token"}
+
+	// authMethod contains the ways clients authenticate at the token endpoint.
+	authMethod = struct {
+		SecretBasic, SecretPost                string
+		SecretJWT, PrivateKeyJWT               string
+		TLSClientAuth, SelfSignedTLSClientAuth string
+		None                                   string
+	}{
+		"client_secret_basic", "client_secret_post",
+		"client_secret_jwt", "private_key_jwt",
+		"tls_client_auth", "self_signed_tls_client_auth",
+		"none",
 	}
 
 	// params contains varions keys used by hero
 	params = struct {
-		error         string
-		errDesc       string
-		errURI        string
-		state         string
-		grantType     string
-		location      string
-		clientID      string
-		clientSecret  string
-		accessToken   string
-		tokenType     string
-		expiresIn     string
-		refreshToken  string
-		scope         string
-		redirectURL   string
-		code          string
-		assertion     string
-		assertionType string
-		responseType  string
+		error        string
+		errDesc      string
+		errURI       string
+		state        string
+		grantType    string
+		location     string
+		clientID     string
+		clientSecret string
+		accessToken  string
+		tokenType    string
+		expiresIn    string
+		refreshToken string
+		scope        string
+		redirectURL  string
+		code         string
+		assertion    string
+		responseType string
+
+		codeChallenge       string
+		codeChallengeMethod string
+		codeVerifier        string
+		token               string
+		tokenTypeHint       string
+		nonce               string
+		idToken             string
+		prompt              string
+		csrfToken           string
+		deviceCode          string
+		userCode            string
+		requestURI          string
+		request             string
+		responseMode        string
+		subjectToken        string
+		subjectTokenType    string
+		actorToken          string
+		actorTokenType      string
+		requestedTokenType  string
+		issuedTokenType     string
+		audience            string
+		resource            string
+		authDetails         string
+		loginHint           string
+		bindingMessage      string
+		authReqID           string
+		notifyToken         string
+		requestedExpiry     string
 	}{
 		"error",
 		"error_description",
@@ -71,8 +127,35 @@ var (
 		"redirect_url",
 		"code",
 		"assertion",
-		"assertion_type",
 		"response_type",
+		"code_challenge",
+		"code_challenge_method",
+		"code_verifier",
+		"token",
+		"token_type_hint",
+		"nonce",
+		"id_token",
+		"prompt",
+		"csrf_token",
+		"device_code",
+		"user_code",
+		"request_uri",
+		"request",
+		"response_mode",
+		"subject_token",
+		"subject_token_type",
+		"actor_token",
+		"actor_token_type",
+		"requested_token_type",
+		"issued_token_type",
+		"audience",
+		"resource",
+		"authorization_details",
+		"login_hint",
+		"binding_message",
+		"auth_req_id",
+		"client_notification_token",
+		"requested_expiry",
 	}
 
 	// registerParams contains registration parameters
@@ -129,12 +212,25 @@ const (
 	//ClientsPath is the route for user clients
 	ClientsPath = "/clients"
 
+	// ClientsAPIPath is the route for the JSON API of user clients.
+	ClientsAPIPath = ClientsPath + "/api"
+
 	//HomePath is the home page route
 	HomePath = "/"
 
 	//StaticPath is the path for static assets.
 	StaticPath = "/static/"
 
+	// OpenIDConfigPath is the route for the OpenID Connect discovery document.
+	OpenIDConfigPath = "/.well-known/openid-configuration"
+
+	// AuthServerMetadataPath is the route for the OAuth 2.0 authorization server
+	// metadata.
+	AuthServerMetadataPath = "/.well-known/oauth-authorization-server"
+
+	// JWKSPath is the route for the JSON Web Key Set of the token signing keys.
+	JWKSPath = "/.well-known/jwks.json"
+
 	// FlashKey is the key used to store flash messages in seesion
 	FlashKey = "_flash"
 
@@ -148,13 +244,24 @@ const (
 //
 // This provide both resource owner, resource server and authorization server.
 type Server struct {
-	q     *query
+	q     Storage
 	cfg   *Config
 	gen   TokenGenerator
 	view  View
 	log   Logger
 	store *Store
 	mux   *mux.Router
+	keys  *KeySet
+
+	// notify reaches users to approve backchannel authentication requests.
+	notify Notifier
+
+	// clientCAs verifies the certificates of clients using tls_client_auth, the
+	// system roots are used when it is nil.
+	clientCAs *x509.CertPool
+
+	// deviceAttempts counts the invalid user codes entered by users and addresses.
+	deviceAttempts *attemptLimiter
 }
 
 //NewServer creates a new *Server.
@@ -162,6 +269,10 @@ type Server struct {
 //It panics if database connection cannot be established.If view is nil the default
 // view is used instead, it panics when the defalut view can not be created.
 //
+// When gen is *JWTTokenGen its key set is also used to sign OpenID Connect id
+// tokens, otherwise a key is generated using Config.SigningAlg. Use
+// *Server.SetKeySet to provide other keys.
+//
 //*Server.Init is called, meaning the returned *Server has all the http endpoints registered,
 // the returned instance is ready to be hooked on *http.ListenAndServe.
 func NewServer(cfg *Config, gen TokenGenerator, view View) *Server {
@@ -169,22 +280,39 @@ func NewServer(cfg *Config, gen TokenGenerator, view View) *Server {
 	if err != nil {
 		panic(err)
 	}
-	q := &query{}
-	q.DB = db
+	return NewServerWithStore(cfg, NewGormStore(db), gen, view)
+}
+
+// NewServerWithStore is like NewServer but keeps the server state in store instead
+// of the database in cfg.
+func NewServerWithStore(cfg *Config, store Storage, gen TokenGenerator, view View) *Server {
 	if view == nil {
-		view, err = NewDefaultView(cfg.TemplatesDir, false)
+		v, err := NewDefaultView(cfg.TemplatesDir, false)
 		if err != nil {
 			panic(err)
 		}
+		view = v
 	}
 	s := &Server{
-		q:     q,
+		q:     store,
 		cfg:   cfg,
 		gen:   gen,
 		view:  view,
 		log:   NewLogger(),
 		mux:   mux.NewRouter(),
-		store: DefaultStore(q.DB),
+		store: DefaultStore(store),
+
+		deviceAttempts: newAttemptLimiter(),
+	}
+	if jwtGen, ok := gen.(*JWTTokenGen); ok {
+		jwtGen.expire = time.Duration(cfg.AccessExpire) * time.Second
+		s.keys = jwtGen.Keys()
+	} else {
+		key, err := GenerateSigningKey(cfg.SigningAlg)
+		if err != nil {
+			panic(err)
+		}
+		s.keys = NewKeySet(key)
 	}
 	return s.Init()
 }
@@ -199,12 +327,41 @@ func (s *Server) Init() *Server {
 	s.mux.HandleFunc(LogoutPath, s.Logout)
 	s.mux.HandleFunc(ProfilePath, s.Profile)
 	s.mux.HandleFunc(ProfileUpdatePath, s.ProfileUpdate).Methods("GET", "POST")
+	s.mux.HandleFunc(ClientsAPIPath, s.ClientAPI)
+	s.mux.HandleFunc(ClientsAPIPath+"/{client_id}", s.ClientAPI)
+	s.mux.HandleFunc(ClientsAPIPath+"/{client_id}/{action:secret}", s.ClientAPI)
 	s.mux.HandleFunc(ClientsPath, s.Client)
+	s.mux.HandleFunc(ClientsPath+"/{client_id}", s.Client)
+	s.mux.HandleFunc(ClientsPath+"/{client_id}/{action:secret|delete}", s.Client)
 
 	// oauth stuffs
 	s.mux.HandleFunc(s.cfg.AuthEndpoint, s.Authorize)
 	s.mux.HandleFunc(s.cfg.TokenEndpoint, s.Access)
 	s.mux.HandleFunc(s.cfg.InfoEndpoint, s.Info)
+	s.mux.HandleFunc(OpenIDConfigPath, s.OpenIDConfiguration)
+	s.mux.HandleFunc(AuthServerMetadataPath, s.AuthorizationServerMetadata)
+	s.mux.HandleFunc(JWKSPath, s.JWKS)
+	if s.cfg.RevokeEndpoint != "" {
+		s.mux.HandleFunc(s.cfg.RevokeEndpoint, s.Revoke)
+	}
+	if s.cfg.IntrospectEndpoint != "" {
+		s.mux.HandleFunc(s.cfg.IntrospectEndpoint, s.Introspect)
+	}
+	if s.cfg.DeviceEndpoint != "" {
+		s.mux.HandleFunc(s.cfg.DeviceEndpoint, s.DeviceAuthorization)
+		s.mux.HandleFunc(s.cfg.DeviceVerifyPath, s.DeviceVerify)
+	}
+	if s.cfg.RegisterEndpoint != "" {
+		s.mux.HandleFunc(s.cfg.RegisterEndpoint, s.RegisterClient)
+		s.mux.HandleFunc(s.cfg.RegisterEndpoint+"/{client_id}", s.ClientConfiguration)
+	}
+	if s.cfg.PAREndpoint != "" {
+		s.mux.HandleFunc(s.cfg.PAREndpoint, s.PushedAuthorization)
+	}
+	if s.cfg.CIBAEndpoint != "" {
+		s.mux.HandleFunc(s.cfg.CIBAEndpoint, s.BackchannelAuthentication)
+		s.mux.HandleFunc(s.cfg.CIBAVerifyPath, s.BackchannelVerify)
+	}
 
 	// static stuffs
 	s.mux.PathPrefix(StaticPath).
@@ -213,10 +370,46 @@ func (s *Server) Init() *Server {
 }
 
 // Authorize provide oauth2 authorization.
+//
+// Clients that pushed their request to the PAR endpoint send its request_uri and
+// client_id instead of the request parameters. The parameters can also be sent in a
+// request object signed by the client(RFC 9101), either by value in request or by
+// reference in request_uri, its claims take precedence over the query.
+//
+// The response is sent the way the client asked for with response_mode, which is
+// one of query, fragment, form_post or their JWT secured(JARM) counterparts. Codes
+// are sent in the query and tokens in the fragment by default.
 func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) {
 	_ = r.ParseForm()
 
 	ctx := newContext(w)
+
+	// a pushed request takes the place of the parameters sent inline.
+	var pushed *PushedRequest
+	if strings.HasPrefix(r.Form.Get(params.requestURI), requestURIPrefix) {
+		p, err := s.pushedRequest(r)
+		if err != nil {
+			ctx.SetErrorState(errorsKeys.InvalidRequestURI, "", "")
+			ctx.InternalError = err
+			_ = ctx.CommitJSON()
+			return
+		}
+		pushed = p
+	}
+
+	// so do the claims of a request object.
+	if r.Form.Get(params.request) != "" || (pushed == nil && r.Form.Get(params.requestURI) != "") {
+		if err := s.requestObject(r); err != nil {
+			if err == errInvalidRequestURI {
+				ctx.SetErrorState(errorsKeys.InvalidRequestURI, "", "")
+			} else {
+				ctx.SetErrorState(errorsKeys.InvalidRequestObject, "", "")
+			}
+			ctx.InternalError = err
+			_ = ctx.CommitJSON()
+			return
+		}
+	}
 	redirectURI, err := url.QueryUnescape(r.Form.Get(params.redirectURL))
 	if err != nil {
 		ctx.SetErrorState(errorsKeys.InvalidRequest, "", "")
@@ -228,10 +421,11 @@ func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) {
 	state := r.Form.Get(params.state)
 	scope := r.Form.Get(params.scope)
 	clientID := r.Form.Get(params.clientID)
+	nonce := r.Form.Get(params.nonce)
 
 	client, err := s.q.ClientByCode(clientID)
 	if err != nil {
-		if err.Error() == gorm.ErrRecordNotFound.Error() {
+		if err == ErrNotFound {
 			ctx.SetErrorState(errorsKeys.UnauthorizedClient, "", state)
 		} else {
 			ctx.SetErrorState(errorsKeys.ServerError, "", state)
@@ -247,6 +441,12 @@ func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if client.RequirePAR && pushed == nil {
+		ctx.SetErrorState(errorsKeys.InvalidRequest, "pushed authorization request required", state)
+		_ = ctx.CommitJSON()
+		return
+	}
+
 	if redirectURI == "" && firstURI(client.RedirectURL, s.cfg.RedirSeparator) == client.RedirectURL {
 		redirectURI = firstURI(client.RedirectURL, s.cfg.RedirSeparator)
 	}
@@ -258,9 +458,72 @@ func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	reqTyp := r.Form.Get(params.responseType)
+	mode, err := authResponseMode(r.Form.Get(params.responseMode), reqTyp)
 	ctx.SetRedirect(redirectURI)
 
-	reqTyp := r.Form.Get(params.responseType)
+	// from here on errors are sent to the client the way it asked for the response.
+	commit := func() {
+		if cerr := s.commitAuthorize(ctx, mode, client); cerr != nil {
+			s.log.Println(cerr)
+		}
+	}
+	if err != nil {
+		ctx.SetErrorState(errorsKeys.InvalidRequest, "", state)
+		ctx.InternalError = err
+		commit()
+		return
+	}
+
+	if scope, err = s.validScope(client, scope); err != nil {
+		ctx.SetErrorState(scopeError(err), "", state)
+		ctx.InternalError = err
+		commit()
+		return
+	}
+
+	// the token can be restricted to resources(RFC 8707), the code carries them
+	// to the token endpoint.
+	audience, err := s.resourceAudience(r.Form, scope)
+	if err != nil {
+		ctx.SetErrorState(targetError(err), "", state)
+		ctx.InternalError = err
+		commit()
+		return
+	}
+
+	// authorization details(RFC 9396) describe what is authorized beyond scopes.
+	details, err := s.authorizationDetails(r.Form.Get(params.authDetails))
+	if err != nil {
+		ctx.SetErrorState(detailsError(err), "", state)
+		ctx.InternalError = err
+		commit()
+		return
+	}
+
+	if reqTyp != "" && !client.AllowsResponseType(reqTyp) {
+		ctx.SetErrorState(errorsKeys.UnauthorizedClient, "", state)
+		commit()
+		return
+	}
+
+	challenge := r.Form.Get(params.codeChallenge)
+	challengeMethod := r.Form.Get(params.codeChallengeMethod)
+	if challenge != "" {
+		challengeMethod, err = validCodeChallenge(challenge, challengeMethod)
+		if err != nil {
+			ctx.SetErrorState(errorsKeys.InvalidRequest, "", state)
+			ctx.InternalError = err
+			commit()
+			return
+		}
+	} else if client.Public && reqTyp == requestType.Code {
+		// public clients can not authenticate at the token endpoint, PKCE is the
+		// only thing that binds the code to them.
+		ctx.SetErrorState(errorsKeys.InvalidRequest, "code challenge required", state)
+		commit()
+		return
+	}
 
 	data := make(map[string]interface{})
 	data["Config"] = s.cfg
@@ -270,6 +533,17 @@ func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) {
 		password := r.Form.Get(loginParams.password)
 
 		usr = s.validUser(r, username, password)
+		if usr != nil {
+
+			// the user is remembered so the consent screen can be submitted
+			// without logging in again.
+			if serr := s.SaveToSession(w, r, "UserID", usr.ID); serr != nil {
+				s.log.Println(serr)
+			}
+		}
+	}
+	if usr == nil {
+		usr, _ = s.isSession(r)
 	}
 
 	// Case we can't find the user. The user-agent is served  with login template
@@ -278,6 +552,8 @@ func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) {
 	if usr == nil {
 		data["Action"] = r.URL.String()
 		data["Title"] = "login"
+		data["Client"] = client
+		data["Scopes"] = s.describeScopes(scope)
 
 		err = s.view.Render(w, s.cfg.LoginTemplate, data)
 		if err != nil {
@@ -286,6 +562,31 @@ func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Nothing is issued until the user has consented to the client getting the
+	// requested scopes, the consent screen is rendered when it is yet to be given.
+	consented, err := s.consent(w, r, usr, client, scope, details)
+	if err != nil {
+		if err == errConsentDenied {
+			ctx.SetErrorState(errorsKeys.AccessDenied, "", state)
+		} else {
+			ctx.SetErrorState(errorsKeys.ServerError, "", state)
+			ctx.InternalError = err
+		}
+		commit()
+		return
+	}
+	if !consented {
+		return
+	}
+
+	// the request_uri can only be used once, it is kept until now so the login and
+	// consent forms can be submitted with it.
+	if pushed != nil {
+		if err = s.q.DeletePushedRequest(pushed); err != nil {
+			s.log.Println(err)
+		}
+	}
+
 	switch reqTyp {
 	case requestType.Code:
 		grant := newGrant(s.gen.Generate())
@@ -294,17 +595,15 @@ func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) {
 		grant.Scope = scope
 		grant.State = state
 		grant.ClientID = client.ID
+		grant.CodeChallenge = challenge
+		grant.CodeChallengeMethod = challengeMethod
+		grant.Nonce = nonce
+		grant.AuthTime = time.Now().Unix()
+		grant.Audience = audience
+		grant.AuthorizationDetails = details
+		grant.UserID = usr.ID
 
-		usr.Grants = append(usr.Grants, grant)
-		err = s.q.SaveModel(usr)
-		if err != nil {
-			ctx.SetErrorState(errorsKeys.ServerError, "", state)
-			ctx.InternalError = err
-			break
-		}
-
-		client.Grants = append(client.Grants, grant)
-		err = s.q.SaveModel(client)
+		err = s.q.SaveGrant(&grant)
 		if err != nil {
 			ctx.SetErrorState(errorsKeys.ServerError, "", state)
 			ctx.InternalError = err
@@ -314,7 +613,6 @@ func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) {
 		ctx.SetData(params.state, state)
 
 	case requestType.Token:
-		ctx.SetRedirectFragment(true)
 		grant := newGrant(s.gen.Generate())
 		grant.Type = grantType.Implicit
 		grant.Scope = scope
@@ -322,6 +620,10 @@ func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) {
 		grant.RedirectURL = redirectURI
 		grant.ClientID = client.ID
 		grant.UserID = usr.ID
+		grant.Nonce = nonce
+		grant.AuthTime = time.Now().Unix()
+		grant.Audience = audience
+		grant.AuthorizationDetails = details
 
 		_, err = s.finalizeAccess(&grant, ctx)
 		if err != nil {
@@ -337,7 +639,7 @@ func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) {
 		ctx.SetErrorState(errorsKeys.UnsupportedResponseType, "", state)
 
 	}
-	_ = ctx.CommitJSON()
+	commit()
 }
 
 // Access provide oauth 2.0  access. This support all grant rypes specified by RFC 6976 namely
@@ -345,7 +647,10 @@ func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) {
 //	* Implicit
 //	* Resource owner password credentials
 //	* Client credentials
-func (s Server) Access(w http.ResponseWriter, r *http.Request) {
+//
+// Authorization codes issued with a PKCE(RFC 7636) code challenge are only exchanged
+// when the matching code_verifier is supplied.
+func (s *Server) Access(w http.ResponseWriter, r *http.Request) {
 	ctx := newContext(w)
 	if r.Method == "GET" {
 		if !s.cfg.AllowGetAccess {
@@ -368,7 +673,7 @@ func (s Server) Access(w http.ResponseWriter, r *http.Request) {
 	scope := r.Form.Get(params.scope)
 	code := r.Form.Get(params.code)
 
-	auth, err := getCLientAuth(r, true)
+	auth, err := requestClientAuth(r)
 	if err != nil {
 		ctx.SetError(errorsKeys.InvalidClient, "")
 		ctx.InternalError = err
@@ -376,6 +681,22 @@ func (s Server) Access(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// access tokens are bound to the certificate the client presented, and to
+	// the key of the DPoP proof.
+	if cert := peerCertificate(r); cert != nil {
+		ctx.CertThumbprint = certThumbprint(cert)
+	}
+	if r.Header.Get(dpopHeader) != "" {
+		ctx.DPoPThumbprint, err = s.dpopProof(r, "")
+		if err != nil {
+			ctx.StatusCode = http.StatusBadRequest
+			ctx.SetError(errorsKeys.InvalidDPoPProof, "")
+			ctx.InternalError = err
+			_ = ctx.CommitJSON()
+			return
+		}
+	}
+
 	if s.cfg.AccessAllowed(accessGrant) {
 		switch accessGrant {
 		case grantType.AuthorizationCode:
@@ -386,10 +707,16 @@ func (s Server) Access(w http.ResponseWriter, r *http.Request) {
 
 			client := s.getClient(auth)
 			if client == nil {
+				ctx.StatusCode = http.StatusUnauthorized
+				ctx.SetError(errorsKeys.InvalidClient, "")
+				break
+			}
+			if !client.AllowsGrant(accessGrant) {
+				ctx.SetError(errorsKeys.UnauthorizedClient, "")
 				break
 			}
 
-			grant, err := s.q.GrantByCLient(client, code)
+			grant, err := s.q.GrantByClient(client, code)
 			if err != nil {
 				ctx.SetError(errorsKeys.UnauthorizedClient, "")
 				ctx.InternalError = err
@@ -401,6 +728,17 @@ func (s Server) Access(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 
+			if client.Public && grant.CodeChallenge == "" {
+				ctx.SetError(errorsKeys.InvalidGrant, "")
+				break
+			}
+
+			if err = verifyCodeChallenge(grant, r.Form.Get(params.codeVerifier)); err != nil {
+				ctx.SetError(errorsKeys.InvalidGrant, "")
+				ctx.InternalError = err
+				break
+			}
+
 			if redirectURI == "" {
 				redirectURI = firstURI(client.RedirectURL, s.cfg.RedirSeparator)
 			}
@@ -411,6 +749,19 @@ func (s Server) Access(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 
+			// the token can be restricted to some of the resources the user
+			// authorized.
+			if grant.Audience, err = s.narrowAudience(grant.Audience, r.Form, grant.Scope); err != nil {
+				ctx.SetError(targetError(err), "")
+				ctx.InternalError = err
+				break
+			}
+			if grant.AuthorizationDetails, err = s.narrowDetails(grant.AuthorizationDetails, r.Form.Get(params.authDetails)); err != nil {
+				ctx.SetError(detailsError(err), "")
+				ctx.InternalError = err
+				break
+			}
+
 			_, err = s.finalizeAccess(grant, ctx)
 			if err != nil {
 				ctx.SetError(errorsKeys.ServerError, "")
@@ -426,33 +777,78 @@ func (s Server) Access(w http.ResponseWriter, r *http.Request) {
 
 			client := s.getClient(auth)
 			if client == nil {
+				ctx.StatusCode = http.StatusUnauthorized
+				ctx.SetError(errorsKeys.InvalidClient, "")
+				break
+			}
+			if !client.AllowsGrant(accessGrant) {
+				ctx.SetError(errorsKeys.UnauthorizedClient, "")
 				break
 			}
 
-			grant, err := s.q.GrantByRefreshToken(refreshToken)
+			tok, err := s.q.TokenByCode(refreshToken)
 			if err != nil {
 				ctx.SetError(errorsKeys.InvalidGrant, "")
 				ctx.InternalError = err
 				break
 			}
 
-			if grant.ClientID != client.ID {
+			if tok.ClientID != client.ID {
 				ctx.SetError(errorsKeys.UnauthorizedClient, "")
+				break
+			}
+
+			// A refresh token is exchanged only once. Seeing it again means it
+			// leaked, and there is no telling whether the client or an attacker
+			// holds the latest one so the whole family is revoked.
+			if tok.Used {
+				s.refreshReused(tok, client, ctx)
+				break
+			}
+
+			grant, err := s.q.GrantByRefreshToken(refreshToken)
+			if err != nil {
+				ctx.SetError(errorsKeys.InvalidGrant, "")
 				ctx.InternalError = err
 				break
 			}
 
-			authGrant := &Grant{
-				Scope:       scope,
-				RedirectURL: grant.RedirectURL,
+			// tokens bound to a DPoP key are refreshed only with a proof signed
+			// by the same key.
+			if grant.DPoPThumbprint != "" && grant.DPoPThumbprint != ctx.DPoPThumbprint {
+				ctx.SetError(errorsKeys.InvalidGrant, "")
+				break
 			}
 
-			if authGrant.Scope == "" {
-				authGrant.Scope = grant.Scope
+			// the refreshed grant may be narrowed to some of the scopes that
+			// were granted, but never widened.
+			if scope != "" {
+				if !coversScope(grant.Scope, scope) {
+					ctx.SetError(errorsKeys.InvalidScope, "")
+					break
+				}
+				grant.Scope = strings.Join(parseScope(scope), " ")
+			}
+			if grant.Audience, err = s.narrowAudience(grant.Audience, r.Form, grant.Scope); err != nil {
+				ctx.SetError(targetError(err), "")
+				ctx.InternalError = err
+				break
+			}
+			if grant.AuthorizationDetails, err = s.narrowDetails(grant.AuthorizationDetails, r.Form.Get(params.authDetails)); err != nil {
+				ctx.SetError(detailsError(err), "")
+				ctx.InternalError = err
+				break
 			}
 
-			if extraScopes(grant.Scope, authGrant.Scope) {
-				ctx.SetError(errorsKeys.AccessDenied, "")
+			// the token is claimed before issuing, of concurrent refreshes only
+			// one gets past this.
+			if err = s.q.UseToken(tok.ID); err != nil {
+				if err == ErrTokenUsed {
+					s.refreshReused(tok, client, ctx)
+					break
+				}
+				ctx.SetError(errorsKeys.ServerError, "")
+				ctx.InternalError = err
 				break
 			}
 			_, err = s.finalizeAccess(grant, ctx)
@@ -480,14 +876,41 @@ func (s Server) Access(w http.ResponseWriter, r *http.Request) {
 
 			client := s.getClient(auth)
 			if client == nil {
+				ctx.StatusCode = http.StatusUnauthorized
+				ctx.SetError(errorsKeys.InvalidClient, "")
+				break
+			}
+			if !client.AllowsGrant(accessGrant) {
+				ctx.SetError(errorsKeys.UnauthorizedClient, "")
+				break
+			}
+			if scope, err = s.validScope(client, scope); err != nil {
+				ctx.SetError(scopeError(err), "")
+				ctx.InternalError = err
+				break
+			}
+
+			audience, err := s.resourceAudience(r.Form, scope)
+			if err != nil {
+				ctx.SetError(targetError(err), "")
+				ctx.InternalError = err
+				break
+			}
+			details, err := s.authorizationDetails(r.Form.Get(params.authDetails))
+			if err != nil {
+				ctx.SetError(detailsError(err), "")
+				ctx.InternalError = err
 				break
 			}
 
 			grant := &Grant{
 				Scope:    scope,
+				Audience: audience,
 				UserID:   usr.ID,
 				ClientID: client.ID,
+				AuthTime: time.Now().Unix(),
 			}
+			grant.AuthorizationDetails = details
 			_, err = s.finalizeAccess(grant, ctx)
 			if err != nil {
 				ctx.SetError(errorsKeys.ServerError, "")
@@ -499,13 +922,44 @@ func (s Server) Access(w http.ResponseWriter, r *http.Request) {
 			// handle
 			client := s.getClient(auth)
 			if client == nil {
+				ctx.StatusCode = http.StatusUnauthorized
+				ctx.SetError(errorsKeys.InvalidClient, "")
+				break
+			}
+			if !client.AllowsGrant(accessGrant) {
+				ctx.SetError(errorsKeys.UnauthorizedClient, "")
+				break
+			}
+			if client.Public {
+				ctx.SetError(errorsKeys.UnauthorizedClient, "")
+				break
+			}
+			if scope, err = s.validScope(client, scope); err != nil {
+				ctx.SetError(scopeError(err), "")
+				ctx.InternalError = err
+				break
+			}
+
+			audience, err := s.resourceAudience(r.Form, scope)
+			if err != nil {
+				ctx.SetError(targetError(err), "")
+				ctx.InternalError = err
+				break
+			}
+			details, err := s.authorizationDetails(r.Form.Get(params.authDetails))
+			if err != nil {
+				ctx.SetError(detailsError(err), "")
+				ctx.InternalError = err
 				break
 			}
 
 			grant := &Grant{
+				Type:     grantType.ClientCredentials,
 				Scope:    scope,
+				Audience: audience,
 				ClientID: client.ID, UserID: client.UserID,
 			}
+			grant.AuthorizationDetails = details
 			_, err = s.finalizeAccess(grant, ctx)
 			if err != nil {
 				ctx.SetError(errorsKeys.ServerError, "")
@@ -513,30 +967,105 @@ func (s Server) Access(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 
-		case grantType.Assertion:
-			assertionTyp := r.Form.Get(params.assertionType)
+		case grantType.JWTBearer:
 			assertion := r.Form.Get(params.assertion)
-
-			if assertionTyp == "" || assertion == "" {
-				ctx.SetError(errorsKeys.InvalidGrant, "")
+			if assertion == "" {
+				ctx.SetError(errorsKeys.InvalidRequest, "")
 				break
 			}
 			client := s.getClient(auth)
 			if client == nil {
+				ctx.StatusCode = http.StatusUnauthorized
+				ctx.SetError(errorsKeys.InvalidClient, "")
 				break
 			}
-			redirectURI = firstURI(client.RedirectURL, s.cfg.RedirSeparator)
-			grant := &Grant{
-				Scope:       scope,
-				RedirectURL: redirectURI,
+			if !client.AllowsGrant(accessGrant) {
+				ctx.SetError(errorsKeys.UnauthorizedClient, "")
+				break
+			}
+			usr, err := s.assertionUser(client, assertion)
+			if err != nil {
+				ctx.SetError(errorsKeys.InvalidGrant, "")
+				ctx.InternalError = err
+				break
+			}
+			if scope, err = s.validScope(client, scope); err != nil {
+				ctx.SetError(scopeError(err), "")
+				ctx.InternalError = err
+				break
+			}
+			if err = s.assertionConsent(usr, client, scope); err != nil {
+				ctx.SetError(errorsKeys.InvalidGrant, "")
+				ctx.InternalError = err
+				break
+			}
+
+			audience, err := s.resourceAudience(r.Form, scope)
+			if err != nil {
+				ctx.SetError(targetError(err), "")
+				ctx.InternalError = err
+				break
+			}
+			details, err := s.authorizationDetails(r.Form.Get(params.authDetails))
+			if err != nil {
+				ctx.SetError(detailsError(err), "")
+				ctx.InternalError = err
+				break
 			}
 
+			// the user did not authenticate, there is no AuthTime.
+			grant := &Grant{
+				Scope:    scope,
+				Audience: audience,
+				ClientID: client.ID,
+				UserID:   usr.ID,
+			}
+			grant.AuthorizationDetails = details
 			_, err = s.finalizeAccess(grant, ctx)
 			if err != nil {
 				ctx.SetError(errorsKeys.ServerError, "")
 				ctx.InternalError = err
 				break
 			}
+
+		case grantType.DeviceCode:
+			client := s.getClient(auth)
+			if client == nil {
+				ctx.StatusCode = http.StatusUnauthorized
+				ctx.SetError(errorsKeys.InvalidClient, "")
+				break
+			}
+			if !client.AllowsGrant(accessGrant) {
+				ctx.SetError(errorsKeys.UnauthorizedClient, "")
+				break
+			}
+			s.deviceAccess(client, r.Form.Get(params.deviceCode), ctx)
+
+		case grantType.TokenExchange:
+			client := s.getClient(auth)
+			if client == nil {
+				ctx.StatusCode = http.StatusUnauthorized
+				ctx.SetError(errorsKeys.InvalidClient, "")
+				break
+			}
+			if !client.AllowsGrant(accessGrant) {
+				ctx.SetError(errorsKeys.UnauthorizedClient, "")
+				break
+			}
+			s.tokenExchange(client, r, ctx)
+
+		case grantType.CIBA:
+			client := s.getClient(auth)
+			if client == nil {
+				ctx.StatusCode = http.StatusUnauthorized
+				ctx.SetError(errorsKeys.InvalidClient, "")
+				break
+			}
+			if !client.AllowsGrant(accessGrant) {
+				ctx.SetError(errorsKeys.UnauthorizedClient, "")
+				break
+			}
+			s.backchannelAccess(client, r.Form.Get(params.authReqID), ctx)
 		}
 
 	} else {
@@ -558,6 +1087,37 @@ func (s *Server) getClient(auth interface{}) *Client {
 		if err != nil {
 			return nil
 		}
+		method := authMethod.SecretBasic
+		if cAuth.Post {
+			method = authMethod.SecretPost
+		}
+		if !client.AllowsAuthMethod(method) {
+			return nil
+		}
+		return client
+	case *publicAuth:
+		pAuth := auth.(*publicAuth)
+		client, err := s.q.ClientByCode(pAuth.ClientID)
+		if err != nil {
+			return nil
+		}
+		if !client.Public || !client.AllowsAuthMethod(authMethod.None) {
+			return nil
+		}
+		return client
+	case *assertionAuth:
+		client, err := s.assertionClient(auth.(*assertionAuth))
+		if err != nil {
+			s.log.Println(err)
+			return nil
+		}
+		return client
+	case *certAuth:
+		client, err := s.certClient(auth.(*certAuth))
+		if err != nil {
+			s.log.Println(err)
+			return nil
+		}
 		return client
 	case *bearerAuth:
 		// handle bearer auth
@@ -568,10 +1128,9 @@ func (s *Server) getClient(auth interface{}) *Client {
 			s.log.Println(err)
 			return nil
 		}
-		client := &Client{}
-		dd := s.q.Where(&Client{ID: access.ClientID}).First(client)
-		if dd.Error != nil {
-			s.log.Println(dd.Error)
+		client, err := s.q.ClientByID(access.ClientID)
+		if err != nil {
+			s.log.Println(err)
 			return nil
 		}
 		return client
@@ -579,46 +1138,93 @@ func (s *Server) getClient(auth interface{}) *Client {
 	return nil
 }
 
+// refreshReused handles the reuse of the refresh token tok by client, the whole
+// token family is revoked.
+func (s *Server) refreshReused(tok *Token, client *Client, ctx *context) {
+	s.log.Printf("security: reuse of refresh token %d of client %s, revoking token family %s\n",
+		tok.ID, client.UUID, tok.Family)
+	if err := s.q.RevokeFamily(tok.Family); err != nil {
+		ctx.InternalError = err
+	}
+	ctx.SetError(errorsKeys.InvalidGrant, "")
+}
+
 // finalizeAccess finalizess access request by generating access token and refresh token for the access grant.
 // When the access grant is saved to the database, the authorize grant is deleted.
 func (s *Server) finalizeAccess(authGrant *Grant, ctx *context) (accessGrant *Grant, err error) {
 	accessGrant = &Grant{}
+	accessGrant.Type = authGrant.Type
 	accessGrant.ClientID = authGrant.ClientID
 	accessGrant.UserID = authGrant.UserID
 	accessGrant.RedirectURL = authGrant.RedirectURL
 	accessGrant.Scope = authGrant.Scope
 	accessGrant.State = authGrant.State
+	accessGrant.Nonce = authGrant.Nonce
+	accessGrant.AuthTime = authGrant.AuthTime
 	accessGrant.ExpiresIn = s.cfg.AccessExpire
+	accessGrant.CertThumbprint = ctx.CertThumbprint
+	accessGrant.DPoPThumbprint = ctx.DPoPThumbprint
+	accessGrant.Audience = authGrant.Audience
+	accessGrant.Act = authGrant.Act
+	accessGrant.AuthorizationDetails = authGrant.AuthorizationDetails
+
+	// refreshed grants stay in the family of the grant they were refreshed from.
+	accessGrant.Family = authGrant.Family
+	if accessGrant.Family == "" {
+		accessGrant.Family = uuid.NewRandom().String()
+	}
 
-	genAccessToken := Token{
-		Code:     s.gen.Generate(),
-		ClientID: authGrant.ClientID,
-		UserID:   authGrant.UserID,
+	// set here rather than by gorm so the expiry embedded in self contained access
+	// tokens matches the grant.
+	accessGrant.CreatedAt = time.Now()
+
+	// The id token is issued along with the access token when the openid scope
+	// was granted to a user who authenticated, grants made for the client alone
+	// like client credentials have no AuthTime.
+	var idToken string
+	if accessGrant.UserID != 0 && accessGrant.AuthTime != 0 && hasScope(accessGrant.Scope, oidcScope.OpenID) {
+		if idToken, err = s.idToken(accessGrant); err != nil {
+			return nil, err
+		}
 	}
 
-	if err = s.q.SaveModel(&genAccessToken); err != nil {
+	accessCode, err := s.accessToken(accessGrant)
+	if err != nil {
 		return nil, err
 	}
-
-	genRefreshToken := Token{
-		Code:     s.gen.Generate(),
+	genAccessToken := Token{
+		Code:     accessCode,
 		ClientID: authGrant.ClientID,
 		UserID:   authGrant.UserID,
 	}
 
-	if err = s.q.SaveModel(&genRefreshToken); err != nil {
+	if err = s.q.SaveToken(&genAccessToken); err != nil {
 		return nil, err
 	}
-
 	accessGrant.AccessToken = genAccessToken
-	accessGrant.RefreshToken = genRefreshToken
 
-	if err = s.q.SaveModel(accessGrant); err != nil {
+	// exchanged tokens are short lived, they do not turn into refresh tokens
+	// unless configured.
+	if accessGrant.Type != grantType.TokenExchange || s.cfg.ExchangeRefresh {
+		genRefreshToken := Token{
+			Code:     s.gen.Generate(),
+			ClientID: authGrant.ClientID,
+			UserID:   authGrant.UserID,
+			Family:   accessGrant.Family,
+		}
+
+		if err = s.q.SaveToken(&genRefreshToken); err != nil {
+			return nil, err
+		}
+		accessGrant.RefreshToken = genRefreshToken
+	}
+
+	if err = s.q.SaveGrant(accessGrant); err != nil {
 		return nil, err
 	}
 
 	ctx.SetData(params.accessToken, accessGrant.AccessToken.Code)
-	ctx.SetData(params.tokenType, s.cfg.TokenType)
+	ctx.SetData(params.tokenType, s.tokenType(accessGrant))
 	ctx.SetData(params.expiresIn, accessGrant.ExpiresIn)
 
 	if accessGrant.RefreshTokenID != 0 {
@@ -627,10 +1233,16 @@ func (s *Server) finalizeAccess(authGrant *Grant, ctx *context) (accessGrant *Gr
 	if accessGrant.Scope != "" {
 		ctx.SetData(params.scope, accessGrant.Scope)
 	}
+	if idToken != "" {
+		ctx.SetData(params.idToken, idToken)
+	}
+	if accessGrant.AuthorizationDetails != "" {
+		ctx.SetData(params.authDetails, detailsJSON(accessGrant.AuthorizationDetails))
+	}
 
 	if authGrant.ID != 0 {
 		// delete authorization
-		if aerr := s.q.DeleteModel(authGrant); aerr != nil {
+		if aerr := s.q.DeleteGrant(authGrant); aerr != nil {
 			//TODO ??
 		}
 
@@ -646,8 +1258,12 @@ func (s *Server) finalizeAccess(authGrant *Grant, ctx *context) (accessGrant *Gr
 	return
 }
 
-// Info provide user information using Bearer token. The information served is user email, name and
-// avatar_url(this is the link to the user's profile picture a.k.a avatar.
+// Info provide user information using Bearer token, it is the OpenID Connect
+// UserInfo endpoint. The claims served depend on the granted scopes, openid gives
+// the subject, profile adds the name and avatar and email adds the email address.
+//
+// Grants for the legacy user scope are served the email, name and avatar_url(this is
+// the link to the user's profile picture a.k.a avatar.
 func (s *Server) Info(w http.ResponseWriter, r *http.Request) {
 	ctx := newContext(w)
 
@@ -691,20 +1307,42 @@ func (s *Server) Info(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if errID := s.tokenBinding(grant, bearer, r); errID != "" {
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errID, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	// tokens restricted to other resources are not accepted here.
+	if !s.infoAudience(grant.Audience) {
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errorsKeys.InvalidToken, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+
 	user, err := s.q.UserByID(grant.UserID)
 	if err != nil {
 		ctx.SetError(errorsKeys.InvalidGrant, "")
 		_ = ctx.CommitJSON()
 		return
 	}
+	if user.ProfileID != 0 {
+		if profile, perr := s.q.ProfileByID(user.ProfileID); perr == nil {
+			user.Profile = *profile
+		}
+	}
 
-	switch grant.Scope {
-	case "user":
-		ctx.SetData("email", user.Email)
-		ctx.SetData("avatar_url", "avatar")
-		ctx.SetData("name", user.UserName)
-	default:
-		ctx.SetError(errorsKeys.InvalidGrant, "")
+	claims := userClaims(user, grant.Scope)
+	if claims == nil {
+		ctx.StatusCode = http.StatusForbidden
+		ctx.SetError(errorsKeys.InsufficientScope, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+	for k, v := range claims {
+		ctx.SetData(k, v)
 	}
 	_ = ctx.CommitJSON()
 }
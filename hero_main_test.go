@@ -30,6 +30,10 @@ func TestMain(m *testing.M) {
 			dbConn.db = db
 			config := DefaultConfig()
 
+			// tests register clients for every flow.
+			config.OpenRegistration = true
+			config.RegistrationGrants = append([]string{grantTypeImplicit}, config.AllowedAccessType...)
+
 			testServer = NewServer(config, &SimpleTokenGen{}, nil)
 			testServer.Migrate()
 		}
@@ -1,10 +1,11 @@
 package hero
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"time"
 )
 
 // Register registers a new user.
@@ -145,104 +146,6 @@ func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, HomePath, http.StatusFound)
 }
 
-// Client is handler for user clients. To avoid creating spaghetti code, this method
-// utilizes query parameters to pack various functionality.
-//
-// The following are the query parameter names and their details
-//
-// 	uid  => Is the user ID it is an int64 value.
-//	uact => string describing user action. Options are create,delete,refresh,update
-//	clID => client ID it is int64 value.
-func (s *Server) Client(w http.ResponseWriter, r *http.Request) {
-
-	q := r.URL.Query()
-	u := q.Get("uid")
-	uAction := q.Get("uact")
-
-	_ = r.ParseForm()
-	data := make(map[string]interface{})
-	data[contextParams.Config] = s.cfg
-
-	userID, err := strconv.Atoi(u)
-	if err != nil {
-		data[contextParams.Message] = err.Error()
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = s.view.Render(w, s.cfg.ErrorTemplate, data)
-		return
-	}
-
-	usr, ok := s.isSession(r)
-	if !ok || usr.ID != int64(userID) {
-		http.Redirect(w, r, LoginPath, http.StatusFound)
-		return
-	}
-
-	if r.Method == "POST" {
-		clientName := r.Form.Get("client_name")
-		clientSecret := r.Form.Get("client_secret")
-		switch uAction {
-		case "create":
-			c := &Client{
-				Name: clientName,
-				UUID: s.gen.Generate(),
-			}
-			secret, err := hashString(clientSecret)
-			if err != nil {
-				data[contextParams.Message] = err.Error()
-				w.WriteHeader(http.StatusInternalServerError)
-				_ = s.view.Render(w, s.cfg.ErrorTemplate, data)
-				return
-			}
-			c.Secret = secret
-			usr.Clients = append(usr.Clients, *c)
-			if err = s.q.SaveModel(usr); err != nil {
-				data[contextParams.Message] = err.Error()
-				w.WriteHeader(http.StatusInternalServerError)
-				_ = s.view.Render(w, s.cfg.ErrorTemplate, data)
-				return
-			}
-			http.Redirect(w, r, ClientsPath, http.StatusFound)
-			return
-		}
-	}
-
-	switch uAction {
-	case "delete":
-
-		// Deelete the client whose id is specified in the url query paramater clID
-		// TODO(gernest): choose a decent name for the query parameter instead of
-		// clID
-		cID := q.Get("clID")
-		clientID, err := strconv.Atoi(cID)
-		if err != nil {
-			data[contextParams.Message] = err.Error()
-			w.WriteHeader(http.StatusInternalServerError)
-			_ = s.view.Render(w, s.cfg.ErrorTemplate, data)
-			return
-		}
-
-		client := &Client{}
-		d := s.q.Where(&Client{ID: int64(clientID)}).First(client)
-		if d.Error != nil {
-			data[contextParams.Message] = d.Error.Error()
-			w.WriteHeader(http.StatusInternalServerError)
-			_ = s.view.Render(w, s.cfg.ErrorTemplate, data)
-			return
-		}
-		if err = s.q.DeleteModel(client); err != nil {
-			data[contextParams.Message] = err.Error()
-			w.WriteHeader(http.StatusInternalServerError)
-			_ = s.view.Render(w, s.cfg.ErrorTemplate, data)
-			return
-		}
-	}
-	err = s.view.Render(w, s.cfg.CLientTemplate, data)
-	if err != nil {
-		s.log.Println(err)
-	}
-
-}
-
 // Home renders hero homepage
 func (s *Server) Home(w http.ResponseWriter, r *http.Request) {
 	data := make(map[string]interface{})
@@ -303,15 +206,16 @@ func (s *Server) DeleteSession(w http.ResponseWriter, r *http.Request, namse str
 // Migrate performs database migrations.
 func (s *Server) Migrate() {
 	fmt.Print("running migrations...")
-	s.q.AutoMigrate(&Token{}, &User{}, &Profile{}, &Session{}, &Client{}, &Grant{})
+	if err := s.q.Migrate(); err != nil {
+		s.log.Println(err)
+	}
 	fmt.Printf("done \n")
 }
 
 // DropAllTables drops all database tables used by hero.
 func (s *Server) DropAllTables() {
-	models := []interface{}{&User{}, &Profile{}, &Token{}, Grant{}, &Client{}, &Session{}}
-	for _, table := range models {
-		s.q.DropTableIfExists(table)
+	if err := s.q.DropAll(); err != nil {
+		s.log.Println(err)
 	}
 }
 
@@ -322,19 +226,33 @@ func (s *Server) Run() {
 	if s.cfg.Port != 0 {
 		port = s.cfg.Port
 	}
+	if s.cfg.KeyRotation > 0 && s.keys != nil {
+		go s.RotateKeysEvery(time.Duration(s.cfg.KeyRotation)*time.Second, nil)
+	}
 	s.log.Printf("starting hero service at  %s:%d \n", host, port)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), s))
 }
 
 // RunTLS runs hero webserver with https.
+//
+// Clients are asked for a certificate, which is optional and only verified when a
+// client authenticates with it.
 func (s *Server) RunTLS(cert, key string) {
 	host := "https://localhost"
 	port := 443
 	if s.cfg.Port != 0 {
 		port = s.cfg.Port
 	}
+	if s.cfg.KeyRotation > 0 && s.keys != nil {
+		go s.RotateKeysEvery(time.Duration(s.cfg.KeyRotation)*time.Second, nil)
+	}
 	s.log.Printf("starting hero service at  %s:%d \n", host, port)
-	log.Fatal(http.ListenAndServeTLS(fmt.Sprintf(":%d", port), cert, key, s))
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   s,
+		TLSConfig: &tls.Config{ClientAuth: tls.RequestClientCert},
+	}
+	log.Fatal(srv.ListenAndServeTLS(cert, key))
 }
 
 // TestClient creates a user usr and a new client c for usr, this is a helper for testing purpose.
@@ -351,12 +269,12 @@ func (s *Server) TestClient(usr *User, c *Client) (*User, *Client) {
 	usr.Password = hpas
 	c.Secret = cSec
 
-	err = s.q.SaveModel(usr)
+	err = s.q.SaveUser(usr)
 	if err != nil {
 		panic(err)
 	}
 	c.UserID = usr.ID
-	err = s.q.SaveModel(c)
+	err = s.q.SaveClient(c)
 	if err != nil {
 		panic(err)
 	}
@@ -1,13 +1,25 @@
 package hero
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/antonholmquist/jason"
+	"github.com/dgrijalva/jwt-go"
 )
 
 const formURLEncoded = "application/x-www-form-urlencoded"
@@ -149,7 +161,7 @@ func TestServer_Authorize(t *testing.T) {
 		Secret: secureSecret,
 	}
 	user.Clients = append(user.Clients, client)
-	err = testServer.q.SaveModel(user)
+	err = testServer.q.SaveUser(user)
 	if err != nil {
 		t.Error(err)
 	}
@@ -238,7 +250,7 @@ func TestServer_Authorize(t *testing.T) {
 	//
 	c, _ := testServer.q.ClientByCode(client.UUID)
 	c.RedirectURL = "http://example.com"
-	err = testServer.q.SaveModel(c)
+	err = testServer.q.SaveClient(c)
 	if err != nil {
 		t.Error(err)
 	}
@@ -280,6 +292,26 @@ func TestServer_Authorize(t *testing.T) {
 	req.Header.Set("Content-Type", formURLEncoded)
 	w = httptest.NewRecorder()
 	testServer.ServeHTTP(w, req)
+
+	// the user is asked to consent before the code is issued
+	if !strings.Contains(w.Body.String(), "consent") {
+		t.Error("should render the consent view")
+	}
+	cookies := readSetCookies(w.HeaderMap)
+	authParams.Del(loginParams.username)
+	authParams.Del(loginParams.password)
+	authParams.Set(params.csrfToken, csrfFromBody(w.Body.String()))
+	authParams.Set(consentParams.decision, consentParams.allow)
+	req, err = http.NewRequest("POST", authPath, strings.NewReader(authParams.Encode()))
+	if err != nil {
+		t.Error(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	for _, v := range cookies {
+		req.AddCookie(v)
+	}
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
 	if w.Code != http.StatusFound {
 		t.Errorf("expected %d got %d", http.StatusFound, w.Code)
 	}
@@ -314,6 +346,109 @@ func TestServer_Authorize(t *testing.T) {
 	}
 }
 
+func TestServer_Consent(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	authPath := testServer.cfg.AuthEndpoint
+	authParams := url.Values{
+		params.clientID:      {genericClient.UUID},
+		params.responseType:  {requestType.Code},
+		params.state:         {"xyz"},
+		loginParams.username: {genericUser.UserName},
+		loginParams.password: {genericUser.Password},
+	}
+
+	//
+	// case prior consent covers the request
+	//
+	req, err := http.NewRequest("POST", authPath, strings.NewReader(authParams.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	w := httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Errorf("expected %d got %d", http.StatusFound, w.Code)
+	}
+
+	//
+	// case prompt=consent asks again
+	//
+	authParams.Set(params.prompt, "consent")
+	req, err = http.NewRequest("POST", authPath, strings.NewReader(authParams.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d got %d", http.StatusOK, w.Code)
+	}
+	cookies := readSetCookies(w.HeaderMap)
+	csrf := csrfFromBody(w.Body.String())
+
+	//
+	// case a bad csrf token is ignored
+	//
+	authParams.Del(loginParams.username)
+	authParams.Del(loginParams.password)
+	authParams.Set(consentParams.decision, consentParams.deny)
+	authParams.Set(params.csrfToken, "bad csrf")
+	req, err = http.NewRequest("POST", authPath, strings.NewReader(authParams.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	for _, v := range cookies {
+		req.AddCookie(v)
+	}
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d got %d", http.StatusOK, w.Code)
+	}
+
+	//
+	// case the user declines
+	//
+	authParams.Set(params.csrfToken, csrf)
+	req, err = http.NewRequest("POST", authPath, strings.NewReader(authParams.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	for _, v := range cookies {
+		req.AddCookie(v)
+	}
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Errorf("expected %d got %d", http.StatusFound, w.Code)
+	}
+	q, err := url.ParseRequestURI(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := q.Query().Get("error"); e != errorsKeys.AccessDenied {
+		t.Errorf("expected %s got %s", errorsKeys.AccessDenied, e)
+	}
+	if st := q.Query().Get("state"); st != "xyz" {
+		t.Errorf("expected xyz got %s", st)
+	}
+}
+
+// csrfFromBody returns the csrf token of the form in the rendered html body.
+func csrfFromBody(body string) string {
+	m := regexp.MustCompile(`name="csrf_token" value="([^"]*)"`).FindStringSubmatch(body)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
 func TestServer_Access(t *testing.T) {
 	if !dbConn.isOpne {
 		t.Skip()
@@ -434,4 +569,2672 @@ func TestServer_Access(t *testing.T) {
 	req.Header.Set("Content-Type", formURLEncoded)
 	w = httptest.NewRecorder()
 	testServer.ServeHTTP(w, req)
+
+	//
+	// client credentials never get an id token, no user authenticated
+	//
+	ccParams := url.Values{
+		params.clientID:     {genericClient.UUID},
+		params.clientSecret: {genericClient.Secret},
+		params.grantType:    {grantType.ClientCredentials},
+		params.scope:        {"openid"},
+	}
+	req, err = http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(ccParams.Encode()))
+	if err != nil {
+		t.Error(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	jObj, err = jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = jObj.GetString("id_token"); err == nil {
+		t.Error("expected no id_token for client credentials")
+	}
+}
+
+func TestServer_RefreshRotation(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	access := func(v url.Values) *jason.Object {
+		req, err := http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jObj
+	}
+
+	accessParams := url.Values{
+		params.clientID:     {genericClient.UUID},
+		params.clientSecret: {genericClient.Secret},
+		params.grantType:    {grantType.ClientCredentials},
+	}
+	first, err := access(accessParams).GetString("refresh_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//
+	// case refreshing issues a new refresh token
+	//
+	accessParams.Set(params.grantType, grantType.RefreshToken)
+	accessParams.Set(params.refreshToken, first)
+	jObj := access(accessParams)
+	second, err := jObj.GetString("refresh_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Error("expected a new refresh token")
+	}
+	accessTok, err := jObj.GetString("access_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//
+	// case reusing the first refresh token revokes the whole family
+	//
+	resErr, err := access(accessParams).GetString("error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resErr != errorsKeys.InvalidGrant {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidGrant, resErr)
+	}
+	if _, err = testServer.q.GrantByBearer(accessTok); err == nil {
+		t.Error("expected the refreshed grant to be revoked")
+	}
+	accessParams.Set(params.refreshToken, second)
+	if _, err = access(accessParams).GetString("refresh_token"); err == nil {
+		t.Error("expected the latest refresh token to be revoked")
+	}
+
+	//
+	// case of concurrent refreshes only one claims the token
+	//
+	accessParams.Set(params.grantType, grantType.ClientCredentials)
+	third, err := access(accessParams).GetString("refresh_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := testServer.q.TokenByCode(third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testServer.q.UseToken(tok.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = testServer.q.UseToken(tok.ID); err != ErrTokenUsed {
+		t.Errorf("expected %v got %v", ErrTokenUsed, err)
+	}
+}
+
+func TestServer_Revoke(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+
+	// get a fresh access token using client credentials
+	accessParams := url.Values{
+		params.clientID:     {genericClient.UUID},
+		params.clientSecret: {genericClient.Secret},
+		params.grantType:    {grantType.ClientCredentials},
+	}
+	req, err := http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(accessParams.Encode()))
+	if err != nil {
+		t.Error(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	w := httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	jObj, err := jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessTok, err := jObj.GetString("access_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//
+	// case bad client credentials
+	//
+	revokeParams := url.Values{
+		params.clientID:     {genericClient.UUID},
+		params.clientSecret: {"bad secret"},
+		params.token:        {accessTok},
+	}
+	req, err = http.NewRequest("POST", testServer.cfg.RevokeEndpoint, strings.NewReader(revokeParams.Encode()))
+	if err != nil {
+		t.Error(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	//
+	// case revoking the access token
+	//
+	revokeParams.Set(params.clientSecret, genericClient.Secret)
+	revokeParams.Set(params.tokenTypeHint, tokenTypeHint.AccessToken)
+	req, err = http.NewRequest("POST", testServer.cfg.RevokeEndpoint, strings.NewReader(revokeParams.Encode()))
+	if err != nil {
+		t.Error(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d got %d", http.StatusOK, w.Code)
+	}
+	if _, err = testServer.q.GrantByBearer(accessTok); err == nil {
+		t.Error("expected the grant to be revoked")
+	}
+
+	//
+	// case unknown tokens are ignored
+	//
+	req, err = http.NewRequest("POST", testServer.cfg.RevokeEndpoint, strings.NewReader(revokeParams.Encode()))
+	if err != nil {
+		t.Error(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d got %d", http.StatusOK, w.Code)
+	}
+
+	//
+	// case unknown hints are ignored
+	//
+	req, err = http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(accessParams.Encode()))
+	if err != nil {
+		t.Error(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	jObj, err = jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessTok, err = jObj.GetString("access_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokeParams.Set(params.token, accessTok)
+	revokeParams.Set(params.tokenTypeHint, "id_token")
+	req, err = http.NewRequest("POST", testServer.cfg.RevokeEndpoint, strings.NewReader(revokeParams.Encode()))
+	if err != nil {
+		t.Error(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d got %d", http.StatusOK, w.Code)
+	}
+	if _, err = testServer.q.GrantByBearer(accessTok); err == nil {
+		t.Error("expected the grant to be revoked")
+	}
+}
+
+func TestServer_Introspect(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+
+	accessParams := url.Values{
+		params.clientID:     {genericClient.UUID},
+		params.clientSecret: {genericClient.Secret},
+		params.grantType:    {grantType.ClientCredentials},
+	}
+	req, err := http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(accessParams.Encode()))
+	if err != nil {
+		t.Error(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	w := httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	jObj, err := jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessTok, err := jObj.GetString("access_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sample := []struct {
+		token  string
+		active bool
+	}{
+		{accessTok, true},
+		{"bad token", false},
+	}
+	for _, v := range sample {
+		introParams := url.Values{
+			params.clientID:     {genericClient.UUID},
+			params.clientSecret: {genericClient.Secret},
+			params.token:        {v.token},
+		}
+		req, err = http.NewRequest("POST", testServer.cfg.IntrospectEndpoint, strings.NewReader(introParams.Encode()))
+		if err != nil {
+			t.Error(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		w = httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err = jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		active, err := jObj.GetBoolean("active")
+		if err != nil {
+			t.Error(err)
+		}
+		if active != v.active {
+			t.Errorf("expected %v got %v", v.active, active)
+		}
+		if !active {
+			continue
+		}
+		clientID, err := jObj.GetString("client_id")
+		if err != nil {
+			t.Error(err)
+		}
+		if clientID != genericClient.UUID {
+			t.Errorf("expected %s got %s", genericClient.UUID, clientID)
+		}
+		if sub, _ := jObj.GetString("sub"); sub != genericClient.UUID {
+			t.Errorf("expected %s got %s", genericClient.UUID, sub)
+		}
+	}
+}
+
+func TestServer_DeviceAuthorization(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	post := func(path string, v url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", path, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		return w
+	}
+	clientParams := url.Values{
+		params.clientID:     {genericClient.UUID},
+		params.clientSecret: {genericClient.Secret},
+	}
+	w := post(testServer.cfg.DeviceEndpoint, clientParams, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, w.Code)
+	}
+	jObj, err := jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceCode, err := jObj.GetString(params.deviceCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userCode, err := jObj.GetString(params.userCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poll := func() string {
+		v := url.Values{
+			params.clientID:     {genericClient.UUID},
+			params.clientSecret: {genericClient.Secret},
+			params.grantType:    {grantType.DeviceCode},
+			params.deviceCode:   {deviceCode},
+		}
+		jObj, err := jason.NewObjectFromReader(post(testServer.cfg.TokenEndpoint, v, nil).Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, err := jObj.GetString("error"); err == nil {
+			return e
+		}
+		if _, err := jObj.GetString("access_token"); err != nil {
+			t.Error(err)
+		}
+		return ""
+	}
+
+	//
+	// case the user is yet to approve
+	//
+	if e := poll(); e != errorsKeys.AuthorizationPending {
+		t.Errorf("expected %s got %s", errorsKeys.AuthorizationPending, e)
+	}
+	if e := poll(); e != errorsKeys.SlowDown {
+		t.Errorf("expected %s got %s", errorsKeys.SlowDown, e)
+	}
+
+	// a poll reads the request before the user approves and writes after.
+	stale, err := testServer.q.DeviceByCode(deviceCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//
+	// case the user logs in and approves
+	//
+	w = post(testServer.cfg.DeviceVerifyPath, url.Values{
+		loginParams.username: {genericUser.UserName},
+		loginParams.password: {genericUser.Password},
+		params.userCode:      {strings.ToLower(userCode)},
+	}, nil)
+	if !strings.Contains(w.Body.String(), userCode) {
+		t.Fatal("expected the user code to be shown")
+	}
+	w = post(testServer.cfg.DeviceVerifyPath, url.Values{
+		params.userCode:        {userCode},
+		params.csrfToken:       {csrfFromBody(w.Body.String())},
+		consentParams.decision: {consentParams.allow},
+	}, readSetCookies(w.HeaderMap))
+	if !strings.Contains(w.Body.String(), "connected") {
+		t.Error("expected the device to be connected")
+	}
+
+	//
+	// case a poll during the approval does not undo it
+	//
+	stale.LastPoll = time.Now().Unix()
+	if err = testServer.q.PollDevice(stale); err != nil {
+		t.Fatal(err)
+	}
+	d, err := testServer.q.DeviceByCode(deviceCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Approved || d.UserID == 0 {
+		t.Error("expected the device to stay approved")
+	}
+	if e := poll(); e != "" {
+		t.Errorf("expected an access token got %s", e)
+	}
+
+	//
+	// case the device code was used
+	//
+	if e := poll(); e != errorsKeys.InvalidGrant {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidGrant, e)
+	}
+	if err = testServer.q.PollDevice(stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = testServer.q.DeviceByCode(deviceCode); err == nil {
+		t.Error("expected a late poll not to bring the device code back")
+	}
+	if err = testServer.q.ClaimDevice(stale.ID); err != ErrRequestClaimed {
+		t.Errorf("expected %v got %v", ErrRequestClaimed, err)
+	}
+
+	//
+	// case guessing user codes is refused after too many invalid ones
+	//
+	defer func() { testServer.deviceAttempts = newAttemptLimiter() }()
+	w = post(testServer.cfg.DeviceEndpoint, clientParams, nil)
+	jObj, err = jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userCode, err = jObj.GetString(params.userCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := url.Values{
+		loginParams.username: {genericUser.UserName},
+		loginParams.password: {genericUser.Password},
+	}
+	for i := int64(0); i < testServer.cfg.DeviceAttempts; i++ {
+		login.Set(params.userCode, "BBBB-BBBB")
+		w = post(testServer.cfg.DeviceVerifyPath, login, nil)
+		if !strings.Contains(w.Body.String(), "invalid") {
+			t.Fatal("expected the code to be invalid")
+		}
+	}
+	login.Set(params.userCode, userCode)
+	w = post(testServer.cfg.DeviceVerifyPath, login, nil)
+	if !strings.Contains(w.Body.String(), "Too many") {
+		t.Error("expected the user to be refused")
+	}
+}
+
+func TestGormStore_NotFound(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	q := NewGormStore(dbConn.db)
+	if _, err := q.ClientByCode("missing"); err != ErrNotFound {
+		t.Errorf("expected %v got %v", ErrNotFound, err)
+	}
+	if _, err := q.GrantByBearer("missing"); err != ErrNotFound {
+		t.Errorf("expected %v got %v", ErrNotFound, err)
+	}
+	if _, err := q.ScopeByName(""); err != ErrNotFound {
+		t.Errorf("expected %v got %v", ErrNotFound, err)
+	}
+}
+
+func TestGormStore_UseJTI(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	q := NewGormStore(dbConn.db)
+	exp := time.Now().Add(time.Minute).Unix()
+	if err := q.UseJTI(genericClient.ID, "jti-once", exp); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.UseJTI(genericClient.ID, "jti-once", exp); err != ErrReplayedJWT {
+		t.Errorf("expected %v got %v", ErrReplayedJWT, err)
+	}
+
+	// the database refuses a second record, concurrent requests can not both pass.
+	if err := q.Create(&Assertion{ClientID: genericClient.ID, JTI: "jti-once", ExpiresAt: exp}).Error; err == nil {
+		t.Error("expected the assertion to be unique")
+	}
+}
+
+func TestServer_JWTBearer(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+
+	// register the public key of the client
+	key, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := NewKeySet(key)
+	jwks, err := json.Marshal(keys.JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := testServer.q.ClientByCode(genericClient.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.JWKS = string(jwks)
+	if err = testServer.q.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client acts only for users who consented to it.
+	user, err := testServer.q.UserByEmail(genericUser.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope, err := testServer.validScope(client, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testServer.q.SaveConsent(&Consent{UserID: user.ID, ClientID: client.ID, Scope: scope}); err != nil {
+		t.Fatal(err)
+	}
+
+	access := func(claims map[string]interface{}) string {
+		assertion, err := keys.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := url.Values{
+			params.clientID:     {genericClient.UUID},
+			params.clientSecret: {genericClient.Secret},
+			params.grantType:    {grantType.JWTBearer},
+			params.assertion:    {assertion},
+		}
+		req, err := http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, err := jObj.GetString("error"); err == nil {
+			return e
+		}
+		tok, err := jObj.GetString("access_token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		grant, err := testServer.q.GrantByBearer(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if grant.ClientID != client.ID || grant.UserID == 0 {
+			t.Errorf("expected the grant to be bound to the client and user got %d %d", grant.ClientID, grant.UserID)
+		}
+		return ""
+	}
+	claims := map[string]interface{}{
+		"iss": genericClient.UUID,
+		"sub": genericUser.UserName,
+		"aud": testServer.cfg.EndpointURL(testServer.cfg.TokenEndpoint),
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"jti": "jti-1",
+	}
+	if e := access(claims); e != "" {
+		t.Errorf("expected an access token got %s", e)
+	}
+
+	//
+	// case the assertion is replayed
+	//
+	if e := access(claims); e != errorsKeys.InvalidGrant {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidGrant, e)
+	}
+
+	//
+	// case the assertion is for another audience
+	//
+	claims["jti"] = "jti-2"
+	claims["aud"] = "https://example.com"
+	if e := access(claims); e != errorsKeys.InvalidGrant {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidGrant, e)
+	}
+
+	//
+	// case the assertion is not signed by the client
+	//
+	other, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = NewKeySet(other)
+	claims["jti"] = "jti-3"
+	claims["aud"] = testServer.cfg.Issuer
+	if e := access(claims); e != errorsKeys.InvalidGrant {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidGrant, e)
+	}
+
+	//
+	// case the user never consented to the client
+	//
+	stranger := &User{UserName: "stranger", Email: "stranger@example.com"}
+	if err = testServer.q.CreateUser(stranger); err != nil {
+		t.Fatal(err)
+	}
+	keys = NewKeySet(key)
+	claims["jti"] = "jti-4"
+	claims["sub"] = stranger.UserName
+	if e := access(claims); e != errorsKeys.InvalidGrant {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidGrant, e)
+	}
+}
+
+func TestServer_ClientAssertion(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	key, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := NewKeySet(key)
+	jwks, err := json.Marshal(keys.JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := testServer.q.ClientByCode(genericClient.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.JWKS = string(jwks)
+	client.JWTSecret = "a shared secret that is long enough"
+	if err = testServer.q.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		client.TokenEndpointAuthMethod = ""
+		_ = testServer.q.SaveClient(client)
+	}()
+
+	access := func(v url.Values, basic bool) string {
+		v.Set(params.grantType, grantType.ClientCredentials)
+		req, err := http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		if basic {
+			req.SetBasicAuth(genericClient.UUID, genericClient.Secret)
+		}
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, err := jObj.GetString("error"); err == nil {
+			return e
+		}
+		if _, err = jObj.GetString("access_token"); err != nil {
+			t.Fatal(err)
+		}
+		return ""
+	}
+	assertion := func(method jwt.SigningMethod, key interface{}, jti string) url.Values {
+		token := jwt.New(method)
+		token.Claims["iss"] = genericClient.UUID
+		token.Claims["sub"] = genericClient.UUID
+		token.Claims["aud"] = testServer.cfg.EndpointURL(testServer.cfg.TokenEndpoint)
+		token.Claims["exp"] = time.Now().Add(time.Minute).Unix()
+		token.Claims["jti"] = jti
+		token.Header["kid"] = keys.Current().ID
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return url.Values{
+			"client_assertion_type": {clientAssertionType},
+			"client_assertion":      {signed},
+		}
+	}
+	secret := []byte(client.JWTSecret)
+
+	//
+	// case client_secret_jwt
+	//
+	if e := access(assertion(jwt.SigningMethodHS256, secret, "client-jti-1"), false); e != "" {
+		t.Errorf("expected an access token got %s", e)
+	}
+
+	//
+	// case private_key_jwt
+	//
+	if e := access(assertion(jwt.SigningMethodES256, key.Private, "client-jti-2"), false); e != "" {
+		t.Errorf("expected an access token got %s", e)
+	}
+
+	//
+	// case the assertion is replayed
+	//
+	if e := access(assertion(jwt.SigningMethodES256, key.Private, "client-jti-2"), false); e != errorsKeys.InvalidClient {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidClient, e)
+	}
+
+	//
+	// case the client is restricted to private_key_jwt
+	//
+	client.TokenEndpointAuthMethod = authMethod.PrivateKeyJWT
+	if err = testServer.q.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	if e := access(url.Values{}, true); e != errorsKeys.InvalidClient {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidClient, e)
+	}
+	if e := access(assertion(jwt.SigningMethodHS256, secret, "client-jti-3"), false); e != errorsKeys.InvalidClient {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidClient, e)
+	}
+	if e := access(assertion(jwt.SigningMethodES256, key.Private, "client-jti-4"), false); e != "" {
+		t.Errorf("expected an access token got %s", e)
+	}
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	ca, caKey := newTestCert(t, "ca", nil, nil)
+	signed, _ := newTestCert(t, "client", ca, caKey)
+	selfSigned, _ := newTestCert(t, "self", nil, nil)
+	other, _ := newTestCert(t, "other", nil, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	testServer.SetClientCAs(pool)
+	defer testServer.SetClientCAs(nil)
+
+	client, err := testServer.q.ClientByCode(genericClient.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		client.TLSClientAuthSubjectDN = ""
+		client.TLSClientAuthThumbprint = ""
+		_ = testServer.q.SaveClient(client)
+	}()
+	save := func(dn, thumbprint string) {
+		client.TLSClientAuthSubjectDN = dn
+		client.TLSClientAuthThumbprint = thumbprint
+		if err := testServer.q.SaveClient(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	withCert := func(req *http.Request, cert *x509.Certificate) {
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}
+	}
+	access := func(cert *x509.Certificate) (string, string) {
+		v := url.Values{
+			params.clientID:  {genericClient.UUID},
+			params.grantType: {grantType.ClientCredentials},
+		}
+		req, err := http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		withCert(req, cert)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, err := jObj.GetString("error"); err == nil {
+			return "", e
+		}
+		tok, err := jObj.GetString("access_token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok, ""
+	}
+	info := func(tok string, cert *x509.Certificate) string {
+		req, err := http.NewRequest("GET", testServer.cfg.InfoEndpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+		withCert(req, cert)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, _ := jObj.GetString("error")
+		return e
+	}
+
+	//
+	// case tls_client_auth
+	//
+	save(signed.Subject.String(), "")
+	tok, e := access(signed)
+	if e != "" {
+		t.Fatalf("expected an access token got %s", e)
+	}
+	grant, err := testServer.q.GrantByBearer(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.CertThumbprint != certThumbprint(signed) {
+		t.Errorf("expected the token to be bound to %s got %s", certThumbprint(signed), grant.CertThumbprint)
+	}
+	if e = info(tok, signed); e == errorsKeys.InvalidToken {
+		t.Errorf("expected the token to be accepted with the bound certificate")
+	}
+	for _, cert := range []*x509.Certificate{other, nil} {
+		if e = info(tok, cert); e != errorsKeys.InvalidToken {
+			t.Errorf("expected %s got %s", errorsKeys.InvalidToken, e)
+		}
+	}
+	if _, e = access(selfSigned); e != errorsKeys.InvalidClient {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidClient, e)
+	}
+
+	//
+	// case self_signed_tls_client_auth
+	//
+	save("", certThumbprint(selfSigned))
+	if _, e = access(selfSigned); e != "" {
+		t.Errorf("expected an access token got %s", e)
+	}
+	if _, e = access(other); e != errorsKeys.InvalidClient {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidClient, e)
+	}
+
+	//
+	// case the token is introspected over another certificate
+	//
+	introspect := func(cert *x509.Certificate) bool {
+		v := url.Values{
+			params.clientID: {genericClient.UUID},
+			params.token:    {tok},
+		}
+		req, err := http.NewRequest("POST", testServer.cfg.IntrospectEndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		withCert(req, cert)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		active, _ := jObj.GetBoolean("active")
+		return active
+	}
+	if introspect(selfSigned) {
+		t.Error("expected the token to be inactive over another certificate")
+	}
+}
+
+func TestServer_DPoP(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	key, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := newJWK(key.Private.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jti := 0
+	proof := func(method, uri, accessToken string) string {
+		jti++
+		token := jwt.New(jwt.SigningMethodES256)
+		token.Header["typ"] = "dpop+jwt"
+		token.Header["jwk"] = pub
+		token.Claims["htm"] = method
+		token.Claims["htu"] = uri
+		token.Claims["iat"] = time.Now().Unix()
+		token.Claims["jti"] = fmt.Sprintf("dpop-%d", jti)
+		if accessToken != "" {
+			sum := sha256.Sum256([]byte(accessToken))
+			token.Claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+		}
+		signed, err := token.SignedString(key.Private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	tokenURL := testServer.cfg.EndpointURL(testServer.cfg.TokenEndpoint)
+	infoURL := testServer.cfg.EndpointURL(testServer.cfg.InfoEndpoint)
+
+	access := func(dpop string) (string, string) {
+		v := url.Values{
+			params.clientID:     {genericClient.UUID},
+			params.clientSecret: {genericClient.Secret},
+			params.grantType:    {grantType.ClientCredentials},
+		}
+		req, err := http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		req.Header.Set("DPoP", dpop)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, err := jObj.GetString("error"); err == nil {
+			return "", e
+		}
+		typ, _ := jObj.GetString("token_type")
+		if typ != "DPoP" {
+			t.Errorf("expected token type DPoP got %s", typ)
+		}
+		tok, err := jObj.GetString("access_token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok, ""
+	}
+
+	//
+	// case the proof is for another endpoint
+	//
+	if _, e := access(proof("POST", infoURL, "")); e != errorsKeys.InvalidDPoPProof {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidDPoPProof, e)
+	}
+	tok, e := access(proof("POST", tokenURL, ""))
+	if e != "" {
+		t.Fatalf("expected an access token got %s", e)
+	}
+	grant, err := testServer.q.GrantByBearer(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jkt, _ := pub.Thumbprint()
+	if grant.DPoPThumbprint != jkt {
+		t.Errorf("expected the token to be bound to %s got %s", jkt, grant.DPoPThumbprint)
+	}
+
+	info := func(scheme, dpop string) string {
+		req, err := http.NewRequest("GET", testServer.cfg.InfoEndpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = strings.TrimPrefix(testServer.cfg.Issuer, "http://")
+		req.Header.Set("Authorization", scheme+" "+tok)
+		if dpop != "" {
+			req.Header.Set("DPoP", dpop)
+		}
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, _ := jObj.GetString("error")
+		return e
+	}
+	valid := proof("GET", infoURL, tok)
+	sample := []struct {
+		scheme, dpop, err string
+	}{
+		{"DPoP", valid, ""},
+		{"DPoP", valid, errorsKeys.InvalidDPoPProof},
+		{"Bearer", "", errorsKeys.InvalidToken},
+		{"DPoP", "", errorsKeys.InvalidDPoPProof},
+		{"DPoP", proof("POST", infoURL, tok), errorsKeys.InvalidDPoPProof},
+		{"DPoP", proof("GET", infoURL, ""), errorsKeys.InvalidDPoPProof},
+	}
+	for _, v := range sample {
+		e = info(v.scheme, v.dpop)
+		if v.err == "" && (e == errorsKeys.InvalidToken || e == errorsKeys.InvalidDPoPProof) {
+			t.Errorf("expected the token to be accepted got %s", e)
+		}
+		if v.err != "" && e != v.err {
+			t.Errorf("expected %s got %s", v.err, e)
+		}
+	}
+
+	//
+	// case the resource is guarded by Protect
+	//
+	protected := testServer.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, dpop := range []string{proof("GET", "http://resource.example.com/data", tok), ""} {
+		req, err := http.NewRequest("GET", "http://resource.example.com/data", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "DPoP "+tok)
+		if dpop != "" {
+			req.Header.Set("DPoP", dpop)
+		}
+		w := httptest.NewRecorder()
+		protected.ServeHTTP(w, req)
+		expect := http.StatusNoContent
+		if dpop == "" {
+			expect = http.StatusUnauthorized
+		}
+		if w.Code != expect {
+			t.Errorf("expected %d got %d", expect, w.Code)
+		}
+	}
+}
+
+func TestServer_RegisterClient(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	register := func(md string) (int, *jason.Object) {
+		req, err := http.NewRequest("POST", testServer.cfg.RegisterEndpoint, strings.NewReader(md))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, jObj
+	}
+	sample := []struct {
+		md, err string
+	}{
+		{`{"client_name":"no redirect"}`, errorsKeys.InvalidRedirectURI},
+		{`{"redirect_uris":["/relative"]}`, errorsKeys.InvalidRedirectURI},
+		{`{"redirect_uris":["http://client.example.com/cb"]}`, errorsKeys.InvalidRedirectURI},
+		{`{"redirect_uris":["javascript:alert(1)"]}`, errorsKeys.InvalidRedirectURI},
+		{`{"redirect_uris":["data:text/html,hello"]}`, errorsKeys.InvalidRedirectURI},
+		{`{"redirect_uris":["myapp:/cb"]}`, errorsKeys.InvalidRedirectURI},
+		{`{"redirect_uris":["https://client.example.com/cb"],"scope":"unknown"}`, errorsKeys.InvalidClientMetadata},
+		{`{"redirect_uris":["https://client.example.com/cb"],"response_types":["token"]}`, errorsKeys.InvalidClientMetadata},
+		{`{"grant_types":["client_credentials"],"token_endpoint_auth_method":"private_key_jwt"}`, errorsKeys.InvalidClientMetadata},
+		{`{"redirect_uris":["https://client.example.com/cb"],"request_uris":["http://client.example.com/request"]}`, errorsKeys.InvalidClientMetadata},
+	}
+	for _, v := range sample {
+		code, jObj := register(v.md)
+		e, _ := jObj.GetString("error")
+		if code != http.StatusBadRequest || e != v.err {
+			t.Errorf("expected %s got %d %s for %s", v.err, code, e, v.md)
+		}
+	}
+
+	//
+	// case registered clients only get the configured grants
+	//
+	grants := testServer.cfg.RegistrationGrants
+	testServer.cfg.RegistrationGrants = DefaultConfig().RegistrationGrants
+	code, jObj := register(`{"grant_types":["client_credentials"]}`)
+	if e, _ := jObj.GetString("error"); code != http.StatusBadRequest || e != errorsKeys.InvalidClientMetadata {
+		t.Errorf("expected %s got %d %s", errorsKeys.InvalidClientMetadata, code, e)
+	}
+	testServer.cfg.RegistrationGrants = grants
+
+	//
+	// case registration is closed without the initial access token
+	//
+	testServer.cfg.OpenRegistration = false
+	testServer.cfg.RegistrationToken = "initial-access-token"
+	md := `{"redirect_uris":["https://client.example.com/cb"]}`
+	for _, token := range []string{"", "bad token", testServer.cfg.RegistrationToken} {
+		req, err := http.NewRequest("POST", testServer.cfg.RegisterEndpoint, strings.NewReader(md))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		expect := http.StatusUnauthorized
+		if token == testServer.cfg.RegistrationToken {
+			expect = http.StatusCreated
+		}
+		if w.Code != expect {
+			t.Errorf("expected %d got %d", expect, w.Code)
+		}
+	}
+	testServer.cfg.OpenRegistration = true
+	testServer.cfg.RegistrationToken = ""
+
+	code, jObj = register(`{
+		"redirect_uris": ["https://client.example.com/cb"],
+		"grant_types": ["authorization_code", "client_credentials"],
+		"client_name": "registered",
+		"scope": "openid"
+	}`)
+	if code != http.StatusCreated {
+		t.Fatalf("expected %d got %d", http.StatusCreated, code)
+	}
+	clientID, _ := jObj.GetString("client_id")
+	secret, _ := jObj.GetString("client_secret")
+	regToken, _ := jObj.GetString("registration_access_token")
+	regURI, _ := jObj.GetString("registration_client_uri")
+	if clientID == "" || secret == "" || regToken == "" {
+		t.Fatalf("expected credentials got %s", jObj)
+	}
+	if regURI != testServer.cfg.EndpointURL(testServer.cfg.RegisterEndpoint+"/"+clientID) {
+		t.Errorf("unexpected registration client uri %s", regURI)
+	}
+
+	//
+	// case the client uses its registered grant types
+	//
+	for _, gt := range []string{grantType.ClientCredentials, grantType.Password} {
+		v := url.Values{
+			params.grantType: {gt},
+			"username":       {genericUser.UserName},
+			"password":       {genericUser.Password},
+		}
+		req, err := http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		req.SetBasicAuth(clientID, secret)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err = jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, _ := jObj.GetString("error")
+		if gt == grantType.ClientCredentials && e != "" {
+			t.Errorf("expected an access token got %s", e)
+		}
+		if gt == grantType.Password && e != errorsKeys.UnauthorizedClient {
+			t.Errorf("expected %s got %s", errorsKeys.UnauthorizedClient, e)
+		}
+	}
+
+	manage := func(method, token, body string) (int, *jason.Object) {
+		req, err := http.NewRequest(method, testServer.cfg.RegisterEndpoint+"/"+clientID, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		if w.Code == http.StatusNoContent {
+			return w.Code, nil
+		}
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, jObj
+	}
+	if code, _ = manage("GET", "bad token", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected %d got %d", http.StatusUnauthorized, code)
+	}
+	code, jObj = manage("GET", regToken, "")
+	if name, _ := jObj.GetString("client_name"); code != http.StatusOK || name != "registered" {
+		t.Errorf("expected the registration got %d %s", code, jObj)
+	}
+	code, jObj = manage("PUT", regToken, `{
+		"client_id": "`+clientID+`",
+		"redirect_uris": ["https://client.example.com/callback"],
+		"client_name": "renamed"
+	}`)
+	if name, _ := jObj.GetString("client_name"); code != http.StatusOK || name != "renamed" {
+		t.Errorf("expected the updated registration got %d %s", code, jObj)
+	}
+	client, err := testServer.q.ClientByCode(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.RedirectURL != "https://client.example.com/callback" || client.GrantTypes != grantType.AuthorizationCode {
+		t.Errorf("expected the metadata to be replaced got %s %s", client.RedirectURL, client.GrantTypes)
+	}
+	if code, _ = manage("DELETE", regToken, ""); code != http.StatusNoContent {
+		t.Errorf("expected %d got %d", http.StatusNoContent, code)
+	}
+	if _, err = testServer.q.ClientByCode(clientID); err == nil {
+		t.Error("expected the client to be deleted")
+	}
+}
+
+func TestServer_Clients(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	user, err := testServer.q.UserByEmail(genericUser.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", ClientsPath, nil)
+	w := httptest.NewRecorder()
+	_ = testServer.SaveToSession(w, req, "UserID", user.ID)
+	cookies := readSetCookies(w.HeaderMap)
+
+	send := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		for _, v := range cookies {
+			req.AddCookie(v)
+		}
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		if c := readSetCookies(w.HeaderMap); len(c) > 0 {
+			cookies = c
+		}
+		return w
+	}
+	api := func(method, path, body string) (int, *jason.Object) {
+		w := send(method, ClientsAPIPath+path, "application/json", body)
+		if w.Code == http.StatusNoContent {
+			return w.Code, nil
+		}
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, jObj
+	}
+
+	if w = send("POST", ClientsAPIPath, formURLEncoded, "client_name=form"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected %d got %d", http.StatusUnsupportedMediaType, w.Code)
+	}
+	code, jObj := api("POST", "", `{"client_name":"api","grant_types":["authorization_code"]}`)
+	if e, _ := jObj.GetString("error"); code != http.StatusBadRequest || e != errorsKeys.InvalidRedirectURI {
+		t.Errorf("expected %s got %d %s", errorsKeys.InvalidRedirectURI, code, e)
+	}
+	code, jObj = api("POST", "", `{
+		"client_name": "api",
+		"redirect_uris": ["https://api.example.com/cb"],
+		"grant_types": ["authorization_code", "client_credentials"]
+	}`)
+	if code != http.StatusCreated {
+		t.Fatalf("expected %d got %d %s", http.StatusCreated, code, jObj)
+	}
+	clientID, _ := jObj.GetString("client_id")
+	secret, _ := jObj.GetString("client_secret")
+	if clientID == "" || secret == "" {
+		t.Fatalf("expected credentials got %s", jObj)
+	}
+	token := func(secret string) string {
+		v := url.Values{params.grantType: {grantType.ClientCredentials}}
+		req, err := http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		req.SetBasicAuth(clientID, secret)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, _ := jObj.GetString("error")
+		return e
+	}
+	if e := token(secret); e != "" {
+		t.Errorf("expected an access token got %s", e)
+	}
+
+	code, jObj = api("GET", "", "")
+	list, _ := jObj.GetObjectArray("clients")
+	found := false
+	for _, c := range list {
+		if id, _ := c.GetString("client_id"); id == clientID {
+			found = true
+		}
+		if _, err = c.GetString("client_secret"); err == nil {
+			t.Error("expected secrets not to be listed")
+		}
+	}
+	if code != http.StatusOK || !found {
+		t.Errorf("expected the client to be listed got %d %s", code, jObj)
+	}
+
+	code, jObj = api("PUT", "/"+clientID, `{
+		"client_name": "renamed",
+		"redirect_uris": ["https://api.example.com/callback"],
+		"grant_types": ["client_credentials"]
+	}`)
+	if name, _ := jObj.GetString("client_name"); code != http.StatusOK || name != "renamed" {
+		t.Errorf("expected the updated client got %d %s", code, jObj)
+	}
+	client, err := testServer.q.ClientByCode(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.RedirectURL != "https://api.example.com/callback" || client.GrantTypes != grantType.ClientCredentials {
+		t.Errorf("expected the client to be edited got %s %s", client.RedirectURL, client.GrantTypes)
+	}
+
+	code, jObj = api("POST", "/"+clientID+"/secret", "")
+	rotated, _ := jObj.GetString("client_secret")
+	if code != http.StatusOK || rotated == "" || rotated == secret {
+		t.Fatalf("expected a new secret got %d %s", code, jObj)
+	}
+	if e := token(secret); e != errorsKeys.InvalidClient {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidClient, e)
+	}
+	if e := token(rotated); e != "" {
+		t.Errorf("expected an access token got %s", e)
+	}
+
+	//
+	// case the client of another user
+	//
+	other := &Client{UUID: testServer.gen.Generate(), Name: "other", UserID: user.ID + 1000}
+	if err = testServer.q.SaveClient(other); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/" + other.UUID, "/unknown"} {
+		if code, _ = api("GET", path, ""); code != http.StatusNotFound {
+			t.Errorf("expected %d got %d for %s", http.StatusNotFound, code, path)
+		}
+		if code, _ = api("DELETE", path, ""); code != http.StatusNotFound {
+			t.Errorf("expected %d got %d for %s", http.StatusNotFound, code, path)
+		}
+	}
+	if w = send("GET", ClientsPath+"/"+other.UUID, "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d got %d", http.StatusNotFound, w.Code)
+	}
+
+	//
+	// case the html pages
+	//
+	w = send("GET", ClientsPath, "", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "renamed") {
+		t.Errorf("expected the client to be listed got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), other.UUID) {
+		t.Error("expected clients of other users to be hidden")
+	}
+	csrf := csrfFromBody(w.Body.String())
+	v := url.Values{"client_name": {"html"}}
+	if w = send("POST", ClientsPath+"/"+clientID, formURLEncoded, v.Encode()); w.Code != http.StatusForbidden {
+		t.Errorf("expected %d got %d", http.StatusForbidden, w.Code)
+	}
+	v = url.Values{
+		"client_name":    {"html"},
+		"redirect_uris":  {" https://html.example.com/cb\n"},
+		"grant_types":    {grantType.AuthorizationCode},
+		params.csrfToken: {csrf},
+	}
+	if w = send("POST", ClientsPath+"/"+clientID, formURLEncoded, v.Encode()); w.Code != http.StatusFound {
+		t.Errorf("expected %d got %d", http.StatusFound, w.Code)
+	}
+	if client, err = testServer.q.ClientByCode(clientID); err != nil {
+		t.Fatal(err)
+	}
+	if client.Name != "html" || client.RedirectURL != "https://html.example.com/cb" {
+		t.Errorf("expected the client to be edited got %s %s", client.Name, client.RedirectURL)
+	}
+	v = url.Values{params.csrfToken: {csrf}}
+	if w = send("POST", ClientsPath+"/"+clientID+"/delete", formURLEncoded, v.Encode()); w.Code != http.StatusFound {
+		t.Errorf("expected %d got %d", http.StatusFound, w.Code)
+	}
+	if _, err = testServer.q.ClientByCode(clientID); err == nil {
+		t.Error("expected the client to be deleted")
+	}
+	if _, err = testServer.q.ClientByCode(other.UUID); err != nil {
+		t.Error("expected the client of the other user to be kept")
+	}
+}
+
+func TestServer_PushedAuthorization(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	req, err := http.NewRequest("POST", testServer.cfg.RegisterEndpoint, strings.NewReader(`{
+		"redirect_uris": ["https://par.example.com/cb"],
+		"client_name": "pushed",
+		"require_pushed_authorization_requests": true
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	jObj, err := jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID, _ := jObj.GetString("client_id")
+	secret, _ := jObj.GetString("client_secret")
+	if required, _ := jObj.GetBoolean("require_pushed_authorization_requests"); !required {
+		t.Errorf("expected PAR to be required got %s", jObj)
+	}
+
+	push := func(v url.Values, secret string) (int, *jason.Object) {
+		req, err := http.NewRequest("POST", testServer.cfg.PAREndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		req.SetBasicAuth(clientID, secret)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, jObj
+	}
+	authorize := func(v url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", testServer.cfg.AuthEndpoint+"?"+v.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		return w
+	}
+	authError := func(w *httptest.ResponseRecorder) string {
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, _ := jObj.GetString("error")
+		return e
+	}
+
+	request := url.Values{
+		params.clientID:     {clientID},
+		params.responseType: {requestType.Code},
+		params.state:        {"pushed-state"},
+	}
+	if e := authError(authorize(request, nil)); e != errorsKeys.InvalidRequest {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidRequest, e)
+	}
+	if code, _ := push(request, "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("expected %d got %d", http.StatusUnauthorized, code)
+	}
+	sample := []struct {
+		key, value, err string
+	}{
+		{params.requestURI, requestURIPrefix + "x", errorsKeys.InvalidRequest},
+		{params.redirectURL, "https://evil.example.com/cb", errorsKeys.InvalidRequest},
+		{params.responseType, "unknown", errorsKeys.UnsupportedResponseType},
+	}
+	for _, v := range sample {
+		bad := url.Values{}
+		for k, vs := range request {
+			bad[k] = vs
+		}
+		bad.Set(v.key, v.value)
+		code, jObj := push(bad, secret)
+		if e, _ := jObj.GetString("error"); code != http.StatusBadRequest || e != v.err {
+			t.Errorf("expected %s got %d %s for %s", v.err, code, e, v.key)
+		}
+	}
+
+	code, jObj := push(request, secret)
+	if code != http.StatusCreated {
+		t.Fatalf("expected %d got %d %s", http.StatusCreated, code, jObj)
+	}
+	requestURI, _ := jObj.GetString(params.requestURI)
+	if expires, _ := jObj.GetInt64(params.expiresIn); !strings.HasPrefix(requestURI, requestURIPrefix) || expires != testServer.cfg.PARExpire {
+		t.Errorf("unexpected pushed request response %s", jObj)
+	}
+
+	// the request_uri only works for the client that pushed it.
+	ref := url.Values{params.clientID: {genericClient.UUID}, params.requestURI: {requestURI}}
+	if e := authError(authorize(ref, nil)); e != errorsKeys.InvalidRequestURI {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidRequestURI, e)
+	}
+
+	user, err := testServer.q.UserByEmail(genericUser.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("GET", testServer.cfg.AuthEndpoint, nil)
+	w = httptest.NewRecorder()
+	_ = testServer.SaveToSession(w, req, "UserID", user.ID)
+	cookies := readSetCookies(w.HeaderMap)
+
+	ref = url.Values{params.clientID: {clientID}, params.requestURI: {requestURI}}
+	w = authorize(ref, cookies)
+	if !strings.Contains(w.Body.String(), "pushed") {
+		t.Fatalf("expected the consent view got %d %s", w.Code, w.Body.String())
+	}
+	if c := readSetCookies(w.HeaderMap); len(c) > 0 {
+		cookies = c
+	}
+	form := url.Values{
+		params.csrfToken:       {csrfFromBody(w.Body.String())},
+		consentParams.decision: {consentParams.allow},
+	}
+	req, err = http.NewRequest("POST", testServer.cfg.AuthEndpoint+"?"+ref.Encode(), strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected %d got %d %s", http.StatusFound, w.Code, w.Body.String())
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Query().Get("code") == "" || loc.Query().Get("state") != "pushed-state" {
+		t.Errorf("expected a code for the pushed request got %s", loc)
+	}
+
+	// the request_uri is used up.
+	if e := authError(authorize(ref, cookies)); e != errorsKeys.InvalidRequestURI {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidRequestURI, e)
+	}
+
+	client, err := testServer.q.ClientByCode(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := &PushedRequest{RequestURI: requestURIPrefix + "expired", ClientID: client.ID, Params: request.Encode()}
+	if err = testServer.q.SavePushedRequest(expired); err != nil {
+		t.Fatal(err)
+	}
+	ref.Set(params.requestURI, expired.RequestURI)
+	if e := authError(authorize(ref, cookies)); e != errorsKeys.InvalidRequestURI {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidRequestURI, e)
+	}
+}
+
+func TestServer_RequestObject(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	key, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := NewKeySet(key)
+	jwks, err := json.Marshal(keys.JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var served string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", requestObjectType)
+		fmt.Fprint(w, served)
+	}))
+	defer ts.Close()
+	defaultClient := requestObjectClient
+	requestObjectClient = ts.Client()
+	defer func() { requestObjectClient = defaultClient }()
+
+	req, err := http.NewRequest("POST", testServer.cfg.RegisterEndpoint, strings.NewReader(`{
+		"redirect_uris": ["https://jar.example.com/cb"],
+		"client_name": "jar",
+		"request_uris": ["`+ts.URL+`/request"],
+		"jwks": `+string(jwks)+`
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	jObj, err := jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID, _ := jObj.GetString("client_id")
+	secret, _ := jObj.GetString("client_secret")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected %d got %d %s", http.StatusCreated, w.Code, jObj)
+	}
+	client, err := testServer.q.ClientByCode(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := testServer.q.UserByEmail(genericUser.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testServer.q.SaveConsent(&Consent{UserID: user.ID, ClientID: client.ID}); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("GET", testServer.cfg.AuthEndpoint, nil)
+	w = httptest.NewRecorder()
+	_ = testServer.SaveToSession(w, req, "UserID", user.ID)
+	cookies := readSetCookies(w.HeaderMap)
+
+	sign := func(k *SigningKey, claims map[string]interface{}) string {
+		token := jwt.New(k.Method)
+		token.Claims["iss"] = clientID
+		token.Claims["aud"] = testServer.cfg.Issuer
+		token.Claims["exp"] = time.Now().Add(time.Minute).Unix()
+		token.Claims[params.responseType] = requestType.Code
+		token.Claims[params.state] = "object-state"
+		for c, v := range claims {
+			token.Claims[c] = v
+		}
+		token.Header["kid"] = k.ID
+		signed, err := token.SignedString(k.Private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	// authorize returns the state the code was issued with or the error.
+	authorize := func(v url.Values) string {
+		v.Set(params.clientID, clientID)
+		v.Set(params.state, "query-state")
+		req, err := http.NewRequest("GET", testServer.cfg.AuthEndpoint+"?"+v.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		if w.Code == http.StatusFound {
+			loc, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loc.Query().Get("code") == "" {
+				t.Errorf("expected a code got %s", loc)
+			}
+			return loc.Query().Get("state")
+		}
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, _ := jObj.GetString("error")
+		return e
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"`+clientID+`","response_type":"code"}`)) + "."
+	sample := []struct {
+		request, expect string
+	}{
+		{sign(key, nil), "object-state"},
+		{sign(other, nil), errorsKeys.InvalidRequestObject},
+		{sign(key, map[string]interface{}{"iss": genericClient.UUID}), errorsKeys.InvalidRequestObject},
+		{sign(key, map[string]interface{}{"aud": "https://other.example.com"}), errorsKeys.InvalidRequestObject},
+		{sign(key, map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}), errorsKeys.InvalidRequestObject},
+		{unsigned, errorsKeys.InvalidRequestObject},
+	}
+	for i, v := range sample {
+		if got := authorize(url.Values{params.request: {v.request}}); got != v.expect {
+			t.Errorf("%d: expected %s got %s", i, v.expect, got)
+		}
+	}
+
+	//
+	// case request objects passed by reference
+	//
+	served = sign(key, nil)
+	if got := authorize(url.Values{params.requestURI: {ts.URL + "/request"}}); got != "object-state" {
+		t.Errorf("expected object-state got %s", got)
+	}
+	if got := authorize(url.Values{params.requestURI: {ts.URL + "/unregistered"}}); got != errorsKeys.InvalidRequestURI {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidRequestURI, got)
+	}
+
+	//
+	// case request objects pushed to the PAR endpoint
+	//
+	push := func(request string) (int, *jason.Object) {
+		v := url.Values{params.request: {request}}
+		req, err := http.NewRequest("POST", testServer.cfg.PAREndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		req.SetBasicAuth(clientID, secret)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, jObj
+	}
+	code, jObj := push(sign(other, nil))
+	if e, _ := jObj.GetString("error"); code != http.StatusBadRequest || e != errorsKeys.InvalidRequestObject {
+		t.Errorf("expected %s got %d %s", errorsKeys.InvalidRequestObject, code, e)
+	}
+	code, jObj = push(sign(key, nil))
+	if code != http.StatusCreated {
+		t.Fatalf("expected %d got %d %s", http.StatusCreated, code, jObj)
+	}
+	requestURI, _ := jObj.GetString(params.requestURI)
+	if got := authorize(url.Values{params.requestURI: {requestURI}}); got != "object-state" {
+		t.Errorf("expected object-state got %s", got)
+	}
+}
+
+func TestServer_ResponseMode(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	req, err := http.NewRequest("POST", testServer.cfg.RegisterEndpoint, strings.NewReader(`{
+		"redirect_uris": ["https://modes.example.com/cb"],
+		"client_name": "modes",
+		"grant_types": ["authorization_code", "implicit"],
+		"response_types": ["code", "token"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	jObj, err := jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID, _ := jObj.GetString("client_id")
+	client, err := testServer.q.ClientByCode(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := testServer.q.UserByEmail(genericUser.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testServer.q.SaveConsent(&Consent{UserID: user.ID, ClientID: client.ID}); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("GET", testServer.cfg.AuthEndpoint, nil)
+	w = httptest.NewRecorder()
+	_ = testServer.SaveToSession(w, req, "UserID", user.ID)
+	cookies := readSetCookies(w.HeaderMap)
+
+	// JWT secured responses are signed with the server keys.
+	key, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testServer.keys
+	testServer.SetKeySet(NewKeySet(key))
+	defer testServer.SetKeySet(keys)
+
+	authorize := func(typ, mode string) *httptest.ResponseRecorder {
+		v := url.Values{
+			params.clientID:     {clientID},
+			params.responseType: {typ},
+			params.responseMode: {mode},
+			params.state:        {"mode-state"},
+		}
+		req, err := http.NewRequest("GET", testServer.cfg.AuthEndpoint+"?"+v.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		return w
+	}
+	location := func(w *httptest.ResponseRecorder) (query, fragment url.Values) {
+		if w.Code != http.StatusFound {
+			t.Fatalf("expected %d got %d %s", http.StatusFound, w.Code, w.Body.String())
+		}
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fragment, err = url.ParseQuery(loc.Fragment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc.Query(), fragment
+	}
+
+	sample := []struct {
+		typ, mode, inQuery, inFragment string
+	}{
+		{requestType.Code, "", params.code, ""},
+		{requestType.Code, responseMode.Query, params.code, ""},
+		{requestType.Code, responseMode.Fragment, "", params.code},
+		{requestType.Token, "", "", params.accessToken},
+		{requestType.Token, responseMode.Fragment, "", params.accessToken},
+		{requestType.Token, responseMode.Query, "", params.error},
+		{requestType.Code, "unknown", params.error, ""},
+		{requestType.Code, responseMode.JWT, "response", ""},
+		{requestType.Token, responseMode.JWT, "", "response"},
+		{requestType.Code, responseMode.FragmentJWT, "", "response"},
+	}
+	for _, v := range sample {
+		query, fragment := location(authorize(v.typ, v.mode))
+		for _, key := range []string{params.code, params.accessToken, params.error, "response"} {
+			if (query.Get(key) != "") != (key == v.inQuery) {
+				t.Errorf("%s %s: unexpected %s in the query %s", v.typ, v.mode, key, query.Encode())
+			}
+			if (fragment.Get(key) != "") != (key == v.inFragment) {
+				t.Errorf("%s %s: unexpected %s in the fragment %s", v.typ, v.mode, key, fragment.Encode())
+			}
+		}
+	}
+
+	//
+	// case JWT secured responses
+	//
+	query, _ := location(authorize(requestType.Code, responseMode.QueryJWT))
+	token, err := testServer.keys.Parse(query.Get("response"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Claims["aud"] != clientID || token.Claims["iss"] != testServer.cfg.Issuer {
+		t.Errorf("unexpected audience or issuer %v", token.Claims)
+	}
+	if code, _ := token.Claims[params.code].(string); code == "" || token.Claims[params.state] != "mode-state" {
+		t.Errorf("expected the code and state got %v", token.Claims)
+	}
+
+	//
+	// case form_post
+	//
+	for _, mode := range []string{responseMode.FormPost, responseMode.FormPostJWT} {
+		w = authorize(requestType.Code, mode)
+		body := w.Body.String()
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			t.Fatalf("expected a html form got %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		if w.Header().Get("Location") != "" || !strings.Contains(body, `action="https://modes.example.com/cb"`) {
+			t.Errorf("expected the form to be posted to the redirect uri got %s", body)
+		}
+		name := `name="code"`
+		if mode == responseMode.FormPostJWT {
+			name = `name="response"`
+		}
+		if !strings.Contains(body, name) || !strings.Contains(body, "document.forms[0].submit()") {
+			t.Errorf("expected an auto submitted form with %s got %s", name, body)
+		}
+	}
+}
+
+func TestServer_TokenExchange(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	access := func(v url.Values) *jason.Object {
+		v.Set(params.clientID, genericClient.UUID)
+		v.Set(params.clientSecret, genericClient.Secret)
+		req, err := http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jObj
+	}
+	subjectTok, err := access(url.Values{
+		params.grantType: {grantType.Password},
+		"username":       {genericUser.UserName},
+		"password":       {genericUser.Password},
+		params.scope:     {"profile email"},
+	}).GetString("access_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actorTok, err := access(url.Values{
+		params.grantType: {grantType.ClientCredentials},
+	}).GetString("access_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testServer.q.SaveResource(&Resource{Identifier: "https://api.example.com/"}); err != nil {
+		t.Fatal(err)
+	}
+	exchange := func() url.Values {
+		return url.Values{
+			params.grantType:        {grantType.TokenExchange},
+			params.subjectToken:     {subjectTok},
+			params.subjectTokenType: {tokenTypeID.AccessToken},
+			params.actorToken:       {actorTok},
+			params.actorTokenType:   {tokenTypeID.AccessToken},
+		}
+	}
+
+	//
+	// case the token is narrowed and aimed at a resource on behalf of the user
+	//
+	v := exchange()
+	v.Set(params.scope, "email")
+	v.Set(params.audience, genericClient.UUID)
+	v.Set(params.resource, "https://api.example.com/")
+	jObj := access(v)
+	exchangedTok, err := jObj.GetString("access_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ, _ := jObj.GetString(params.issuedTokenType); typ != tokenTypeID.AccessToken {
+		t.Errorf("expected %s got %s", tokenTypeID.AccessToken, typ)
+	}
+	if _, err = jObj.GetString("refresh_token"); err == nil {
+		t.Error("expected no refresh token for exchanged tokens")
+	}
+	grant, err := testServer.q.GrantByBearer(exchangedTok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr, err := testServer.q.UserByEmail(genericUser.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.UserID != usr.ID {
+		t.Errorf("expected user %d got %d", usr.ID, grant.UserID)
+	}
+	if grant.Scope != "email" {
+		t.Errorf("expected email got %s", grant.Scope)
+	}
+	if grant.Audience != genericClient.UUID+" https://api.example.com/" {
+		t.Errorf("unexpected audience %s", grant.Audience)
+	}
+
+	//
+	// case exchanging the exchanged token nests the previous actor
+	//
+	v = exchange()
+	v.Set(params.subjectToken, exchangedTok)
+	jObj = access(v)
+	chainedTok, err := jObj.GetString("access_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	introParams := url.Values{
+		params.clientID:     {genericClient.UUID},
+		params.clientSecret: {genericClient.Secret},
+		params.token:        {chainedTok},
+	}
+	req, err := http.NewRequest("POST", testServer.cfg.IntrospectEndpoint, strings.NewReader(introParams.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	w := httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	jObj, err = jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := jObj.GetString("act", "client_id"); id != genericClient.UUID {
+		t.Errorf("expected actor %s got %s", genericClient.UUID, id)
+	}
+	if id, _ := jObj.GetString("act", "act", "client_id"); id != genericClient.UUID {
+		t.Errorf("expected prior actor %s got %s", genericClient.UUID, id)
+	}
+
+	//
+	// case bad exchange requests
+	//
+	sample := []struct {
+		key, value, err string
+	}{
+		{params.scope, "profile", errorsKeys.InvalidScope},
+		{params.resource, "/relative", errorsKeys.InvalidTarget},
+		{params.audience, "billing", errorsKeys.InvalidTarget},
+		{params.subjectTokenType, tokenTypeID.IDToken, errorsKeys.InvalidRequest},
+		{params.subjectToken, "bad token", errorsKeys.InvalidRequest},
+		{params.requestedTokenType, tokenTypeID.RefreshToken, errorsKeys.InvalidRequest},
+	}
+	for _, s := range sample {
+		v = exchange()
+		v.Set(params.subjectToken, exchangedTok)
+		v.Set(s.key, s.value)
+		if e, _ := access(v).GetString("error"); e != s.err {
+			t.Errorf("%s: expected %s got %s", s.key, s.err, e)
+		}
+	}
+
+	//
+	// case a certificate bound token is not exchanged without the certificate
+	//
+	grant, err = testServer.q.GrantByBearer(subjectTok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grant.CertThumbprint = "bound"
+	if err = testServer.q.SaveGrant(grant); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := access(exchange()).GetString("error"); e != errorsKeys.InvalidRequest {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidRequest, e)
+	}
+}
+
+func TestServer_Resource(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	register := func(body string) (*Client, string) {
+		req, err := http.NewRequest("POST", testServer.cfg.RegisterEndpoint, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientID, _ := jObj.GetString("client_id")
+		secret, _ := jObj.GetString("client_secret")
+		client, err := testServer.q.ClientByCode(clientID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, secret
+	}
+	client, secret := register(`{
+		"redirect_uris": ["https://resources.example.com/cb"],
+		"client_name": "resources"
+	}`)
+	api, apiSecret := register(`{
+		"redirect_uris": ["https://photos.example.com/cb"],
+		"client_name": "photos"
+	}`)
+	photos := &Resource{Identifier: "https://photos.example.com/", Scope: "profile", ClientID: api.ID}
+	docs := &Resource{Identifier: "https://docs.example.com/"}
+	for _, res := range []*Resource{photos, docs} {
+		if err := testServer.q.SaveResource(res); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	user, err := testServer.q.UserByEmail(genericUser.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testServer.q.SaveConsent(&Consent{UserID: user.ID, ClientID: client.ID, Scope: "profile"}); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", testServer.cfg.AuthEndpoint, nil)
+	w := httptest.NewRecorder()
+	_ = testServer.SaveToSession(w, req, "UserID", user.ID)
+	cookies := readSetCookies(w.HeaderMap)
+
+	authorize := func(scope string, resources ...string) url.Values {
+		v := url.Values{
+			params.clientID:     {client.UUID},
+			params.responseType: {requestType.Code},
+			params.scope:        {scope},
+			params.resource:     resources,
+		}
+		req, err := http.NewRequest("GET", testServer.cfg.AuthEndpoint+"?"+v.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc.Query()
+	}
+	access := func(v url.Values, id, secret string) *jason.Object {
+		req, err := http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		req.SetBasicAuth(id, secret)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jObj
+	}
+	introspect := func(token, id, secret string) *jason.Object {
+		v := url.Values{params.token: {token}}
+		req, err := http.NewRequest("POST", testServer.cfg.IntrospectEndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		req.SetBasicAuth(id, secret)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jObj
+	}
+
+	//
+	// case bad resource indicators at the authorization endpoint
+	//
+	sample := []struct {
+		scope     string
+		resources []string
+		err       string
+	}{
+		{"profile", []string{"https://unknown.example.com/"}, errorsKeys.InvalidTarget},
+		{"profile", []string{"/photos"}, errorsKeys.InvalidTarget},
+		{"email", []string{photos.Identifier}, errorsKeys.InvalidScope},
+	}
+	for _, v := range sample {
+		if e := authorize(v.scope, v.resources...).Get("error"); e != v.err {
+			t.Errorf("%v: expected %s got %s", v.resources, v.err, e)
+		}
+	}
+
+	//
+	// case the code is redeemed for one of the authorized resources
+	//
+	code := authorize("profile", photos.Identifier, docs.Identifier).Get(params.code)
+	if code == "" {
+		t.Fatal("expected a code")
+	}
+	grant, err := testServer.q.GrantByClient(client, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.Audience != photos.Identifier+" "+docs.Identifier {
+		t.Errorf("unexpected audience %s", grant.Audience)
+	}
+	jObj := access(url.Values{
+		params.grantType: {grantType.AuthorizationCode},
+		params.code:      {code},
+		params.resource:  {photos.Identifier},
+	}, client.UUID, secret)
+	accessTok, err := jObj.GetString("access_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshTok, err := jObj.GetString("refresh_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grant, err = testServer.q.GrantByBearer(accessTok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.Audience != photos.Identifier {
+		t.Errorf("expected %s got %s", photos.Identifier, grant.Audience)
+	}
+
+	//
+	// case refreshing can not widen the audience
+	//
+	e, _ := access(url.Values{
+		params.grantType:    {grantType.RefreshToken},
+		params.refreshToken: {refreshTok},
+		params.resource:     {docs.Identifier},
+	}, client.UUID, secret).GetString("error")
+	if e != errorsKeys.InvalidTarget {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidTarget, e)
+	}
+
+	//
+	// case only the resource server sees the token as active
+	//
+	if active, _ := introspect(accessTok, client.UUID, secret).GetBoolean("active"); active {
+		t.Error("expected the token to be inactive for the client")
+	}
+	jObj = introspect(accessTok, api.UUID, apiSecret)
+	if active, _ := jObj.GetBoolean("active"); !active {
+		t.Errorf("expected the token to be active for the resource server got %s", jObj)
+	}
+	if aud, _ := jObj.GetString("aud"); aud != photos.Identifier {
+		t.Errorf("expected %s got %s", photos.Identifier, aud)
+	}
+
+	//
+	// case the token is refused by the info endpoint
+	//
+	req, err = http.NewRequest("GET", testServer.cfg.InfoEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessTok)
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	//
+	// case the resource does not accept the requested scope
+	//
+	e, _ = access(url.Values{
+		params.grantType: {grantType.ClientCredentials},
+		params.scope:     {"email"},
+		params.resource:  {photos.Identifier},
+	}, genericClient.UUID, genericClient.Secret).GetString("error")
+	if e != errorsKeys.InvalidScope {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidScope, e)
+	}
+}
+
+func TestServer_AuthorizationDetails(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	payment := &AuthorizationDetailType{
+		Type:        "payment_initiation",
+		Description: "Make a payment",
+		Fields:      "instructedAmount creditorName",
+	}
+	if err := testServer.q.SaveAuthorizationDetailType(payment); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", testServer.cfg.RegisterEndpoint, strings.NewReader(`{
+		"redirect_uris": ["https://payments.example.com/cb"],
+		"client_name": "payments"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	jObj, err := jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID, _ := jObj.GetString("client_id")
+	secret, _ := jObj.GetString("client_secret")
+	client, err := testServer.q.ClientByCode(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := testServer.q.UserByEmail(genericUser.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testServer.q.SaveConsent(&Consent{UserID: user.ID, ClientID: client.ID, Scope: "profile"}); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("GET", testServer.cfg.AuthEndpoint, nil)
+	w = httptest.NewRecorder()
+	_ = testServer.SaveToSession(w, req, "UserID", user.ID)
+	cookies := readSetCookies(w.HeaderMap)
+
+	authorize := func(method string, v url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, testServer.cfg.AuthEndpoint, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		return w
+	}
+	location := func(w *httptest.ResponseRecorder) url.Values {
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc.Query()
+	}
+	detail := `{"type":"payment_initiation","actions":["initiate"],"creditorName":"Merchant A","instructedAmount":{"currency":"EUR","amount":"123.50"}}`
+	request := url.Values{
+		params.clientID:     {clientID},
+		params.responseType: {requestType.Code},
+		params.scope:        {"profile"},
+		params.authDetails:  {"[" + detail + "]"},
+	}
+
+	//
+	// case bad authorization details
+	//
+	sample := []string{
+		`{"type":"payment_initiation"}`,
+		`[{"type":"unknown"}]`,
+		`[{"type":"payment_initiation","debtorAccount":"x"}]`,
+		`[{"type":"payment_initiation","actions":"initiate"}]`,
+	}
+	for _, v := range sample {
+		bad := url.Values{}
+		for k, vs := range request {
+			bad[k] = vs
+		}
+		bad.Set(params.authDetails, v)
+		if e := location(authorize("POST", bad, cookies)).Get("error"); e != errorsKeys.InvalidAuthDetails {
+			t.Errorf("%s: expected %s got %s", v, errorsKeys.InvalidAuthDetails, e)
+		}
+	}
+
+	//
+	// case the details are shown on the consent screen even with prior consent
+	//
+	w = authorize("POST", request, cookies)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, w.Code)
+	}
+	body := w.Body.String()
+	for _, v := range []string{payment.Description, "Merchant A", "initiate"} {
+		if !strings.Contains(body, v) {
+			t.Errorf("expected %s on the consent screen", v)
+		}
+	}
+	request.Set(params.csrfToken, csrfFromBody(body))
+	request.Set(consentParams.decision, consentParams.allow)
+	code := location(authorize("POST", request, append(cookies, readSetCookies(w.HeaderMap)...))).Get(params.code)
+	if code == "" {
+		t.Fatal("expected a code")
+	}
+
+	//
+	// case the details are returned with the token and by introspection
+	//
+	v := url.Values{
+		params.grantType: {grantType.AuthorizationCode},
+		params.code:      {code},
+	}
+	req, err = http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	req.SetBasicAuth(clientID, secret)
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	jObj, err = jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	details, err := jObj.GetObjectArray(params.authDetails)
+	if err != nil {
+		t.Fatalf("expected authorization details got %s", jObj)
+	}
+	if name, _ := details[0].GetString("creditorName"); name != "Merchant A" {
+		t.Errorf("expected Merchant A got %s", name)
+	}
+	accessTok, _ := jObj.GetString("access_token")
+	refreshTok, _ := jObj.GetString("refresh_token")
+
+	v = url.Values{params.token: {accessTok}}
+	req, err = http.NewRequest("POST", testServer.cfg.IntrospectEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	req.SetBasicAuth(clientID, secret)
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	jObj, err = jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details, err = jObj.GetObjectArray(params.authDetails); err != nil || len(details) != 1 {
+		t.Errorf("expected authorization details got %s", jObj)
+	}
+
+	//
+	// case refreshing can not ask for details that were not granted
+	//
+	v = url.Values{
+		params.grantType:    {grantType.RefreshToken},
+		params.refreshToken: {refreshTok},
+		params.authDetails:  {`[{"type":"payment_initiation","creditorName":"Merchant B"}]`},
+	}
+	req, err = http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	req.SetBasicAuth(clientID, secret)
+	w = httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	jObj, err = jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := jObj.GetString("error"); e != errorsKeys.InvalidAuthDetails {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidAuthDetails, e)
+	}
+}
+
+func TestServer_Backchannel(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+
+	notified := &bytes.Buffer{}
+	testServer.SetNotifier(&LogNotifier{Log: log.New(notified, "", 0)})
+	defer testServer.SetNotifier(nil)
+
+	type ping struct {
+		auth, body string
+	}
+	pings := make(chan ping, 1)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		pings <- ping{r.Header.Get("Authorization"), string(b)}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	defaultClient := notificationClient
+	notificationClient = ts.Client()
+	defer func() { notificationClient = defaultClient }()
+
+	register := func(body string) *jason.Object {
+		req, err := http.NewRequest("POST", testServer.cfg.RegisterEndpoint, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jObj
+	}
+	post := func(path string, v url.Values, id, secret string) *jason.Object {
+		req, err := http.NewRequest("POST", path, strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", formURLEncoded)
+		req.SetBasicAuth(id, secret)
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		jObj, err := jason.NewObjectFromReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jObj
+	}
+	poll := func(authReqID, id, secret string) string {
+		jObj := post(testServer.cfg.TokenEndpoint, url.Values{
+			params.grantType: {grantType.CIBA},
+			params.authReqID: {authReqID},
+		}, id, secret)
+		if e, err := jObj.GetString("error"); err == nil {
+			return e
+		}
+		if _, err := jObj.GetString(params.idToken); err != nil {
+			t.Errorf("expected an id token got %s", jObj)
+		}
+		return ""
+	}
+
+	user, err := testServer.q.UserByEmail(genericUser.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", testServer.cfg.CIBAVerifyPath, nil)
+	w := httptest.NewRecorder()
+	_ = testServer.SaveToSession(w, req, "UserID", user.ID)
+	cookies := readSetCookies(w.HeaderMap)
+	decide := func(authReqID, decision string) string {
+		b, err := testServer.q.BackchannelRequestByID(authReqID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", testServer.cfg.CIBAVerifyPath, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		if b.BindingMessage != "" && !strings.Contains(w.Body.String(), b.BindingMessage) {
+			t.Errorf("expected the binding message %s to be shown", b.BindingMessage)
+		}
+		v := url.Values{
+			"id":                   {fmt.Sprint(b.ID)},
+			params.csrfToken:       {csrfFromBody(w.Body.String())},
+			consentParams.decision: {decision},
+		}
+		req, _ = http.NewRequest("POST", testServer.cfg.CIBAVerifyPath, strings.NewReader(v.Encode()))
+		req.Header.Set("Content-Type", formURLEncoded)
+		for _, c := range append(cookies, readSetCookies(w.HeaderMap)...) {
+			req.AddCookie(c)
+		}
+		w = httptest.NewRecorder()
+		testServer.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	//
+	// case bad backchannel authentication requests
+	//
+	sample := []struct {
+		v   url.Values
+		err string
+	}{
+		{url.Values{params.scope: {"profile"}, params.loginHint: {genericUser.Email}}, errorsKeys.InvalidScope},
+		{url.Values{params.scope: {"openid"}, params.loginHint: {"nobody"}}, errorsKeys.UnknownUserID},
+		{url.Values{params.scope: {"openid"}}, errorsKeys.UnknownUserID},
+		{url.Values{
+			params.scope:          {"openid"},
+			params.loginHint:      {genericUser.Email},
+			params.bindingMessage: {strings.Repeat("x", maxBindingMessage+1)},
+		}, errorsKeys.InvalidBindingMessage},
+	}
+	for _, v := range sample {
+		if e, _ := post(testServer.cfg.CIBAEndpoint, v.v, genericClient.UUID, genericClient.Secret).GetString("error"); e != v.err {
+			t.Errorf("expected %s got %s", v.err, e)
+		}
+	}
+
+	//
+	// case a poll mode client waits for the user to approve
+	//
+	jObj := post(testServer.cfg.CIBAEndpoint, url.Values{
+		params.scope:          {"openid profile"},
+		params.loginHint:      {genericUser.Email},
+		params.bindingMessage: {"W4SCT"},
+	}, genericClient.UUID, genericClient.Secret)
+	authReqID, err := jObj.GetString(params.authReqID)
+	if err != nil {
+		t.Fatalf("expected auth_req_id got %s", jObj)
+	}
+	if !strings.Contains(notified.String(), "W4SCT") {
+		t.Errorf("expected the user to be notified got %q", notified.String())
+	}
+	if e := poll(authReqID, genericClient.UUID, genericClient.Secret); e != errorsKeys.AuthorizationPending {
+		t.Errorf("expected %s got %s", errorsKeys.AuthorizationPending, e)
+	}
+	if e := poll(authReqID, genericClient.UUID, genericClient.Secret); e != errorsKeys.SlowDown {
+		t.Errorf("expected %s got %s", errorsKeys.SlowDown, e)
+	}
+
+	// a poll reads the request before the user approves and writes after.
+	stale, err := testServer.q.BackchannelRequestByID(authReqID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decide(authReqID, consentParams.allow)
+
+	//
+	// case a poll during the approval does not undo it
+	//
+	stale.LastPoll = time.Now().Unix()
+	if err = testServer.q.PollBackchannelRequest(stale); err != nil {
+		t.Fatal(err)
+	}
+	if e := poll(authReqID, genericClient.UUID, genericClient.Secret); e != "" {
+		t.Errorf("expected a token got %s", e)
+	}
+	if e := poll(authReqID, genericClient.UUID, genericClient.Secret); e != errorsKeys.InvalidGrant {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidGrant, e)
+	}
+	if err = testServer.q.PollBackchannelRequest(stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = testServer.q.BackchannelRequestByID(authReqID); err == nil {
+		t.Error("expected a late poll not to bring the request back")
+	}
+
+	//
+	// case a concluded request is claimed only once
+	//
+	claimed := &BackchannelRequest{AuthReqID: "claim-me", ClientID: genericClient.ID, UserID: genericUser.ID}
+	if err = testServer.q.SaveBackchannelRequest(claimed); err != nil {
+		t.Fatal(err)
+	}
+	if err = testServer.q.ClaimBackchannelRequest(claimed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = testServer.q.ClaimBackchannelRequest(claimed.ID); err != ErrRequestClaimed {
+		t.Errorf("expected %v got %v", ErrRequestClaimed, err)
+	}
+
+	//
+	// case ping mode clients must be notified over https
+	//
+	if e, _ := register(`{
+		"redirect_uris": ["https://ping.example.com/cb"],
+		"grant_types": ["authorization_code", "urn:openid:params:grant-type:ciba"],
+		"backchannel_token_delivery_mode": "ping",
+		"backchannel_client_notification_endpoint": "http://ping.example.com/notify"
+	}`).GetString("error"); e != errorsKeys.InvalidClientMetadata {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidClientMetadata, e)
+	}
+	jObj = register(`{
+		"redirect_uris": ["https://ping.example.com/cb"],
+		"grant_types": ["authorization_code", "urn:openid:params:grant-type:ciba"],
+		"backchannel_token_delivery_mode": "ping",
+		"backchannel_client_notification_endpoint": "` + ts.URL + `/notify"
+	}`)
+	clientID, _ := jObj.GetString("client_id")
+	secret, _ := jObj.GetString("client_secret")
+
+	//
+	// case a ping mode client is told when the user has decided
+	//
+	request := url.Values{
+		params.scope:     {"openid"},
+		params.loginHint: {genericUser.UserName},
+	}
+	if e, _ := post(testServer.cfg.CIBAEndpoint, request, clientID, secret).GetString("error"); e != errorsKeys.InvalidRequest {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidRequest, e)
+	}
+	request.Set(params.notifyToken, "notify-me")
+	authReqID, err = post(testServer.cfg.CIBAEndpoint, request, clientID, secret).GetString(params.authReqID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decide(authReqID, consentParams.deny)
+	select {
+	case p := <-pings:
+		if p.auth != "Bearer notify-me" {
+			t.Errorf("expected Bearer notify-me got %s", p.auth)
+		}
+		if !strings.Contains(p.body, authReqID) {
+			t.Errorf("expected %s in %s", authReqID, p.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the client to be pinged")
+	}
+	if e := poll(authReqID, clientID, secret); e != errorsKeys.AccessDenied {
+		t.Errorf("expected %s got %s", errorsKeys.AccessDenied, e)
+	}
 }
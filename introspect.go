@@ -0,0 +1,123 @@
+package hero
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Introspect provide oauth 2.0 token introspection as described in RFC 7662.
+//
+// Resource servers authenticate as confidential clients and POST the token they were
+// presented with. The response tells whether the token is active and, when it is,
+// who it was issued to and what it grants access to.
+func (s *Server) Introspect(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(w)
+	if r.Method != "POST" {
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		ctx.InternalError = errors.New("request must be POST")
+		_ = ctx.CommitJSON()
+		return
+	}
+	_ = r.ParseForm()
+
+	auth, err := requestClientAuth(r)
+	if err != nil {
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errorsKeys.InvalidClient, "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+	client := s.getClient(auth)
+	if client == nil || client.Public {
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errorsKeys.InvalidClient, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	token := r.Form.Get(params.token)
+	if token == "" {
+		ctx.StatusCode = http.StatusBadRequest
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	ctx.SetData("active", false)
+	if _, err = s.q.TokenByCode(token); err != nil {
+		_ = ctx.CommitJSON()
+		return
+	}
+	grant, typ, err := s.q.GrantByToken(token, r.Form.Get(params.tokenTypeHint))
+	if err != nil {
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	// refresh tokens stay valid for as long as their grant exists.
+	if typ == tokenTypeHint.AccessToken && grant.IsExpired() {
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	owner, err := s.q.ClientByID(grant.ClientID)
+	if err != nil {
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	// a client introspecting its own certificate bound token must present it over
+	// the same certificate, other callers verify the cnf claim themselves.
+	if grant.ClientID == client.ID && typ == tokenTypeHint.AccessToken && !certBound(grant, r) {
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	// access tokens restricted to resources are only active for their servers.
+	if typ == tokenTypeHint.AccessToken && !s.audienceOf(grant.Audience, client) {
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	ctx.SetData("active", true)
+	ctx.SetData(params.clientID, owner.UUID)
+	ctx.SetData("iat", grant.CreatedAt.Unix())
+	if grant.Scope != "" {
+		ctx.SetData(params.scope, grant.Scope)
+	}
+	if typ == tokenTypeHint.AccessToken {
+		exp := grant.CreatedAt.Add(time.Duration(grant.ExpiresIn) * time.Second)
+		ctx.SetData("exp", exp.Unix())
+		ctx.SetData(params.tokenType, s.tokenType(grant))
+		if cnf := confirmation(grant); cnf != nil {
+			ctx.SetData("cnf", cnf)
+		}
+	}
+	if grant.Audience != "" {
+		ctx.SetData("aud", audienceClaim(grant.Audience))
+	}
+	if grant.Act != "" {
+		ctx.SetData("act", json.RawMessage(grant.Act))
+	}
+	if grant.AuthorizationDetails != "" {
+		ctx.SetData(params.authDetails, detailsJSON(grant.AuthorizationDetails))
+	}
+
+	// tokens issued through client credentials have the client as their subject,
+	// even when the grant carries the user owning the client.
+	if grant.UserID == 0 || grant.Type == grantType.ClientCredentials {
+		ctx.SetData("sub", owner.UUID)
+		_ = ctx.CommitJSON()
+		return
+	}
+	ctx.SetData("sub", strconv.FormatInt(grant.UserID, 10))
+	if usr, uerr := s.q.UserByID(grant.UserID); uerr == nil {
+		ctx.SetData("username", usr.UserName)
+	}
+	_ = ctx.CommitJSON()
+}
@@ -0,0 +1,210 @@
+package hero
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// requestObjectType is the media type of request objects served from a request_uri,
+// as registered by RFC 9101 section 10.2.
+const requestObjectType = "application/oauth-authz-req+jwt"
+
+// maxRequestObjectSize is the most bytes read when fetching a request object.
+const maxRequestObjectSize = 64 << 10
+
+var (
+	errInvalidRequestObject = errors.New("hero: invalid request object")
+	errNonPublicAddress     = errors.New("hero: the request_uri is not a public address")
+)
+
+// requestObjectClient fetches the request objects that clients pass by reference.
+var requestObjectClient = newPublicClient()
+
+// newPublicClient returns a client for the URLs given by clients. It only connects
+// to public addresses and does not follow redirects, so clients can not make hero
+// reach its own network.
+func newPublicClient() *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 10 * time.Second,
+				Control: publicAddressOnly,
+			}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// publicAddressOnly refuses connections to loopback, private, link local and other
+// addresses which are not public. It is called with the resolved address, so host
+// names resolving to such addresses are refused too.
+func publicAddressOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return errNonPublicAddress
+	}
+	return nil
+}
+
+// publicIP returns true if ip is a public unicast address.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast())
+}
+
+// requestObject replaces the authorization request parameters of r with the ones in
+// the request object sent with it, either by value in request or by reference in
+// request_uri, as described in RFC 9101 section 5. Parameters that are only in the
+// query are kept.
+//
+// errInvalidRequestURI is returned when the request object can not be fetched, any
+// other error means the request object is invalid.
+func (s *Server) requestObject(r *http.Request) error {
+	token := r.Form.Get(params.request)
+	uri := r.Form.Get(params.requestURI)
+	if token != "" && uri != "" {
+		return errInvalidRequestObject
+	}
+	client, err := s.q.ClientByCode(r.Form.Get(params.clientID))
+	if err != nil {
+		return err
+	}
+	if uri != "" {
+		if token, err = fetchRequestObject(client, uri); err != nil {
+			return errInvalidRequestURI
+		}
+	}
+	claims, err := s.verifyRequestObject(client, token)
+	if err != nil {
+		return err
+	}
+	for k, v := range claims {
+		r.Form[k] = v
+	}
+	return nil
+}
+
+// verifyRequestObject verifies the request object token signed by client and
+// returns the authorization request parameters it carries. Unsigned request
+// objects are refused.
+func (s *Server) verifyRequestObject(client *Client, token string) (url.Values, error) {
+	t, err := clientJWT(client, token)
+	if err != nil {
+		return nil, err
+	}
+	claims := t.Claims
+	if iss, ok := claims["iss"]; ok && iss != client.UUID {
+		return nil, errInvalidJWTClaim
+	}
+	if id, ok := claims[params.clientID]; ok && id != client.UUID {
+		return nil, errInvalidJWTClaim
+	}
+	if aud, ok := claims["aud"]; ok && !s.validAudience(aud) {
+		return nil, errInvalidJWTClaim
+	}
+
+	values := url.Values{}
+	for k, v := range claims {
+		switch k {
+		case "iss", "aud", "exp", "iat", "nbf", "jti":
+			continue
+		}
+		switch x := v.(type) {
+		case string:
+			values.Set(k, x)
+		case float64:
+			values.Set(k, strconv.FormatFloat(x, 'f', -1, 64))
+		case bool:
+			values.Set(k, strconv.FormatBool(x))
+		case []interface{}:
+			// parameters that can be repeated, like resource, are arrays.
+			if strs, ok := stringValues(x); ok {
+				values[k] = strs
+				continue
+			}
+			b, err := json.Marshal(x)
+			if err != nil {
+				return nil, err
+			}
+			values.Set(k, string(b))
+		default:
+			// structured parameters like claims are sent as JSON.
+			b, err := json.Marshal(x)
+			if err != nil {
+				return nil, err
+			}
+			values.Set(k, string(b))
+		}
+	}
+	return values, nil
+}
+
+// stringValues returns the values of v if they are all strings.
+func stringValues(v []interface{}) ([]string, bool) {
+	strs := make([]string, 0, len(v))
+	for _, e := range v {
+		str, ok := e.(string)
+		if !ok {
+			return nil, false
+		}
+		strs = append(strs, str)
+	}
+	return strs, len(strs) > 0
+}
+
+// fetchRequestObject returns the request object served at uri, which must be one
+// of the https request uris client registered.
+func fetchRequestObject(client *Client, uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" {
+		return "", errInvalidRequestURI
+	}
+	u.Fragment = ""
+	registered := false
+	for _, v := range strings.Fields(client.RequestURIs) {
+		if v == u.String() {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		return "", errInvalidRequestURI
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", requestObjectType)
+	res, err := requestObjectClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", errInvalidRequestURI
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, maxRequestObjectSize))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
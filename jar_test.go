@@ -0,0 +1,45 @@
+package hero
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPublicIP(t *testing.T) {
+	sample := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+	}
+	for _, v := range sample {
+		if public := publicIP(net.ParseIP(v.ip)); public != v.public {
+			t.Errorf("%s: expected %v got %v", v.ip, v.public, public)
+		}
+	}
+}
+
+func TestFetchRequestObject(t *testing.T) {
+	client := &Client{RequestURIs: "http://client.example.com/request https://127.0.0.1:1/request"}
+
+	// request objects are only fetched over https.
+	if _, err := fetchRequestObject(client, "http://client.example.com/request"); err != errInvalidRequestURI {
+		t.Errorf("expected %v got %v", errInvalidRequestURI, err)
+	}
+
+	// the server never connects to its own network.
+	_, err := fetchRequestObject(client, "https://127.0.0.1:1/request")
+	if err == nil || !strings.Contains(err.Error(), errNonPublicAddress.Error()) {
+		t.Errorf("expected %v got %v", errNonPublicAddress, err)
+	}
+}
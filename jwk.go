@@ -0,0 +1,196 @@
+package hero
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	errUnsupportedKey = errors.New("hero: unsupported key type")
+	errInvalidKey     = errors.New("hero: invalid key")
+)
+
+// jwk is a public JSON Web Key as described in RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// newJWK returns the JSON Web Key representation of the public key pub.
+func newJWK(pub crypto.PublicKey) (*jwk, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return &jwk{
+			Kty: "RSA",
+			N:   encodeBigInt(k.N, 0),
+			E:   encodeBigInt(big.NewInt(int64(k.E)), 0),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return &jwk{
+			Kty: "EC",
+			Crv: k.Curve.Params().Name,
+			X:   encodeBigInt(k.X, size),
+			Y:   encodeBigInt(k.Y, size),
+		}, nil
+	case ed25519.PublicKey:
+		return &jwk{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(k),
+		}, nil
+	}
+	return nil, errUnsupportedKey
+}
+
+// Thumbprint returns the base64url encoded SHA-256 JWK thumbprint of k as described
+// in RFC 7638.
+func (k *jwk) Thumbprint() (string, error) {
+	var members string
+
+	// only the required members, in lexicographic order, are hashed.
+	switch k.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, k.E, k.Kty, k.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, k.Crv, k.Kty, k.X, k.Y)
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, k.Crv, k.Kty, k.X)
+	default:
+		return "", errUnsupportedKey
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// encodeBigInt returns base64url encoding of the big endian bytes of n, left padded
+// with zeros to size bytes.
+func encodeBigInt(n *big.Int, size int) string {
+	b := n.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseJWKS parses a JSON Web Key Set.
+func parseJWKS(data string) ([]*jwk, error) {
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal([]byte(data), &set); err != nil {
+		return nil, err
+	}
+	return set.Keys, nil
+}
+
+// PublicKey returns the public key represented by k.
+func (k *jwk) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.Sign() <= 0 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errInvalidKey
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve := curveByName(k.Crv)
+		if curve == nil {
+			return nil, errUnsupportedKey
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errInvalidKey
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errUnsupportedKey
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errInvalidKey
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errUnsupportedKey
+}
+
+// Allows returns true if k can verify signatures made with the JWS algorithm alg.
+func (k *jwk) Allows(alg string) bool {
+	if k.Alg != "" && k.Alg != alg {
+		return false
+	}
+	if k.Use != "" && k.Use != "sig" {
+		return false
+	}
+	switch k.Kty {
+	case "RSA":
+		return alg == "RS256" || alg == "RS384" || alg == "RS512"
+	case "EC":
+		return (k.Crv == "P-256" && alg == "ES256") ||
+			(k.Crv == "P-384" && alg == "ES384") ||
+			(k.Crv == "P-521" && alg == "ES512")
+	case "OKP":
+		return alg == SigningMethodEdDSA.Alg()
+	}
+	return false
+}
+
+// curveByName returns the elliptic curve with the JWK curve name.
+func curveByName(name string) elliptic.Curve {
+	switch name {
+	case "P-256":
+		return elliptic.P256()
+	case "P-384":
+		return elliptic.P384()
+	case "P-521":
+		return elliptic.P521()
+	}
+	return nil
+}
+
+// decodeBigInt decodes the base64url encoded big endian integer s.
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errInvalidKey
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,363 @@
+package hero
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+var (
+	errInvalidPEM         = errors.New("hero: invalid PEM encoded key")
+	errUnknownKey         = errors.New("hero: unknown signing key")
+	errEdDSAVerification  = errors.New("hero: EdDSA verification failed")
+	errUnsupportedSignAlg = errors.New("hero: unsupported signing algorithm")
+)
+
+// SigningMethodEdDSA implements the EdDSA signing method, as described in RFC 8037,
+// using Ed25519 keys.
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKey
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return errEdDSAVerification
+	}
+	return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKey
+	}
+	return jwt.EncodeSegment(ed25519.Sign(priv, []byte(signingString))), nil
+}
+
+// SigningKey is a private key used to sign tokens.
+type SigningKey struct {
+	// ID is the key id(kid), it is the JWK thumbprint of the public key.
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+
+	// RetiredAt is set when the key is rotated out. Retired keys no longer sign
+	// tokens but are still published so the tokens they signed can be verified.
+	RetiredAt time.Time
+
+	// expires is the expiry of the longest lived token signed by the key.
+	expires time.Time
+}
+
+// NewSigningKey returns a *SigningKey for private which must be *rsa.PrivateKey,
+// *ecdsa.PrivateKey or ed25519.PrivateKey.
+func NewSigningKey(private crypto.Signer) (*SigningKey, error) {
+	var method jwt.SigningMethod
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			method = jwt.SigningMethodES256
+		case elliptic.P384():
+			method = jwt.SigningMethodES384
+		case elliptic.P521():
+			method = jwt.SigningMethodES512
+		default:
+			return nil, errUnsupportedKey
+		}
+	case ed25519.PrivateKey:
+		method = SigningMethodEdDSA
+	default:
+		return nil, errUnsupportedKey
+	}
+	key, err := newJWK(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	kid, err := key.Thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: kid, Method: method, Private: private}, nil
+}
+
+// GenerateSigningKey generates a new key for the signing algorithm alg. Supported
+// algorithms are RS256, ES256 and EdDSA.
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	var (
+		private crypto.Signer
+		err     error
+	)
+	switch alg {
+	case jwt.SigningMethodRS256.Alg():
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case SigningMethodEdDSA.Alg():
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, errUnsupportedSignAlg
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKey(private)
+}
+
+// ParseSigningKey parses a PEM encoded PKCS #1, SEC 1 or PKCS #8 private key.
+func ParseSigningKey(data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errInvalidPEM
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return NewSigningKey(k)
+	}
+	if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return NewSigningKey(k)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, errUnsupportedKey
+	}
+	return NewSigningKey(signer)
+}
+
+// KeySet is a set of signing keys identified by their key id. The most recently
+// added key signs new tokens, the rest only verify tokens they signed before they
+// were rotated out.
+//
+// It is safe for concurrent use.
+type KeySet struct {
+	mu   sync.RWMutex
+	keys []*SigningKey
+}
+
+// NewKeySet returns a *KeySet with keys, the last key is the current signing key.
+func NewKeySet(keys ...*SigningKey) *KeySet {
+	return &KeySet{keys: keys}
+}
+
+// Current returns the key used to sign new tokens.
+func (ks *KeySet) Current() *SigningKey {
+	if ks == nil {
+		return nil
+	}
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if len(ks.keys) == 0 {
+		return nil
+	}
+	return ks.keys[len(ks.keys)-1]
+}
+
+// Key returns the key whose id is kid.
+func (ks *KeySet) Key(kid string) *SigningKey {
+	if ks == nil {
+		return nil
+	}
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	for _, k := range ks.keys {
+		if k.ID == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+// Rotate retires the current key and makes key the current signing key.
+func (ks *KeySet) Rotate(key *SigningKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if n := len(ks.keys); n > 0 {
+		ks.keys[n-1].RetiredAt = time.Now()
+	}
+	ks.keys = append(ks.keys, key)
+}
+
+// Prune removes keys which were retired more than maxAge ago, keys are kept until
+// all the tokens they signed have expired regardless of maxAge.
+func (ks *KeySet) Prune(maxAge time.Duration) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	var keys []*SigningKey
+	now := time.Now()
+	for _, k := range ks.keys {
+		if !k.RetiredAt.IsZero() && now.Sub(k.RetiredAt) > maxAge && now.After(k.expires) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	ks.keys = keys
+}
+
+// Sign returns a JWT with claims signed by the current key.
+func (ks *KeySet) Sign(claims map[string]interface{}) (string, error) {
+	return ks.sign(nil, claims)
+}
+
+// sign returns a JWT with claims, the header is extended with the key id and
+// header.
+func (ks *KeySet) sign(header, claims map[string]interface{}) (string, error) {
+	key := ks.Current()
+	if key == nil {
+		return "", errNoSigningKey
+	}
+	token := jwt.New(key.Method)
+	for k, v := range header {
+		token.Header[k] = v
+	}
+	token.Header["kid"] = key.ID
+	for k, v := range claims {
+		token.Claims[k] = v
+	}
+	if exp, ok := claims["exp"].(int64); ok {
+		ks.mu.Lock()
+		if t := time.Unix(exp, 0); t.After(key.expires) {
+			key.expires = t
+		}
+		ks.mu.Unlock()
+	}
+	return token.SignedString(key.Private)
+}
+
+// Parse parses and verifies a JWT signed by one of the keys in the set.
+func (ks *KeySet) Parse(token string) (*jwt.Token, error) {
+	return jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key := ks.Key(kid)
+		if key == nil {
+			return nil, errUnknownKey
+		}
+		if t.Method.Alg() != key.Method.Alg() {
+			return nil, errUnsupportedSignAlg
+		}
+		return key.Private.Public(), nil
+	})
+}
+
+// JWKS returns the public keys in the set as a JSON Web Key Set.
+func (ks *KeySet) JWKS() map[string]interface{} {
+	keys := []*jwk{}
+	if ks != nil {
+		ks.mu.RLock()
+		for _, k := range ks.keys {
+			pub, err := newJWK(k.Private.Public())
+			if err != nil {
+				continue
+			}
+			pub.Kid = k.ID
+			pub.Use = "sig"
+			pub.Alg = k.Method.Alg()
+			keys = append(keys, pub)
+		}
+		ks.mu.RUnlock()
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+// Algs returns the signing algorithms of the keys in the set.
+func (ks *KeySet) Algs() []string {
+	algs := []string{}
+	if ks == nil {
+		return algs
+	}
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	seen := make(map[string]bool)
+	for _, k := range ks.keys {
+		if alg := k.Method.Alg(); !seen[alg] {
+			seen[alg] = true
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+// SetKeySet sets the keys used to sign OpenID Connect id tokens. When the token
+// generator is a *JWTTokenGen its access tokens are signed with keys too, so JWKS
+// keeps publishing the keys that verify the issued tokens.
+func (s *Server) SetKeySet(keys *KeySet) {
+	s.keys = keys
+	if jwtGen, ok := s.gen.(*JWTTokenGen); ok {
+		jwtGen.SetKeys(keys)
+	}
+}
+
+// RotateKeys makes a freshly generated key, using Config.SigningAlg, the current
+// signing key. Retired keys are published for at least Config.AccessExpire and
+// until all the tokens they signed have expired.
+func (s *Server) RotateKeys() error {
+	if s.keys == nil {
+		return errNoSigningKey
+	}
+	key, err := GenerateSigningKey(s.cfg.SigningAlg)
+	if err != nil {
+		return err
+	}
+	s.keys.Rotate(key)
+	s.keys.Prune(time.Duration(s.cfg.AccessExpire) * time.Second)
+	return nil
+}
+
+// RotateKeysEvery calls RotateKeys after every d until stop is closed. It blocks,
+// servers embedded in another http.Server run it in a goroutine, Run and RunTLS
+// do so with Config.KeyRotation.
+func (s *Server) RotateKeysEvery(d time.Duration, stop <-chan struct{}) {
+	tick := time.NewTicker(d)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if err := s.RotateKeys(); err != nil {
+				s.log.Println(err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// JWKS serves the public keys used to sign tokens as a JSON Web Key Set, resource
+// servers use it to verify tokens without calling back to hero.
+func (s *Server) JWKS(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(w)
+	ctx.Data = s.keys.JWKS()
+	_ = ctx.CommitJSON()
+}
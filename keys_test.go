@@ -0,0 +1,269 @@
+package hero
+
+import (
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/antonholmquist/jason"
+)
+
+func TestKeySet_Sign(t *testing.T) {
+	var empty *KeySet
+	if _, err := empty.Sign(nil); err != errNoSigningKey {
+		t.Errorf("expected %v got %v", errNoSigningKey, err)
+	}
+
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		key, err := GenerateSigningKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ks := NewKeySet(key)
+		tok, err := ks.Sign(map[string]interface{}{"sub": "7", "nonce": "n-0S6_WzA2Mj"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ks.Parse(tok)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if parsed.Header["kid"] != key.ID {
+			t.Errorf("expected %s got %v", key.ID, parsed.Header["kid"])
+		}
+		if parsed.Claims["nonce"] != "n-0S6_WzA2Mj" {
+			t.Errorf("expected n-0S6_WzA2Mj got %v", parsed.Claims["nonce"])
+		}
+	}
+
+	if _, err := GenerateSigningKey("HS256"); err != errUnsupportedSignAlg {
+		t.Errorf("expected %v got %v", errUnsupportedSignAlg, err)
+	}
+}
+
+func TestKeySet_Rotate(t *testing.T) {
+	old, err := GenerateSigningKey("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := NewKeySet(old)
+	tok, err := ks.Sign(map[string]interface{}{"sub": "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.Rotate(key)
+	if ks.Current() != key {
+		t.Error("expected the new key to be current")
+	}
+	if old.RetiredAt.IsZero() {
+		t.Error("expected the old key to be retired")
+	}
+	if _, err = ks.Parse(tok); err != nil {
+		t.Errorf("expected tokens signed by retired keys to verify got %v", err)
+	}
+	if algs := ks.Algs(); len(algs) != 2 {
+		t.Errorf("expected 2 algs got %v", algs)
+	}
+
+	ks.Prune(time.Hour)
+	if ks.Key(old.ID) == nil {
+		t.Error("expected the old key to be kept")
+	}
+	ks.Prune(0)
+	if ks.Key(old.ID) != nil {
+		t.Error("expected the old key to be pruned")
+	}
+	if _, err = ks.Parse(tok); err == nil {
+		t.Error("expected an error parsing a token signed by a pruned key")
+	}
+}
+
+func TestKeySet_PruneUnexpired(t *testing.T) {
+	old, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := NewKeySet(old)
+	tok, err := ks.Sign(map[string]interface{}{
+		"sub": "7",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.Rotate(key)
+
+	// the token signed by the old key is still valid for an hour.
+	ks.Prune(0)
+	if ks.Key(old.ID) == nil {
+		t.Error("expected the old key to be kept until its tokens expire")
+	}
+	if _, err = ks.Parse(tok); err != nil {
+		t.Errorf("expected the token to verify got %v", err)
+	}
+}
+
+func TestJWKThumbprint(t *testing.T) {
+
+	// https://tools.ietf.org/html/rfc7638#section-3.1
+	k := &jwk{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   encodeBigInt(big.NewInt(65537), 0),
+	}
+	if k.E != "AQAB" {
+		t.Errorf("expected AQAB got %s", k.E)
+	}
+	tp, err := k.Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"
+	if tp != expect {
+		t.Errorf("expected %s got %s", expect, tp)
+	}
+}
+
+func TestServer_JWKS(t *testing.T) {
+	key, err := GenerateSigningKey("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{cfg: DefaultConfig()}
+	s.SetKeySet(NewKeySet(key))
+
+	req, _ := http.NewRequest("GET", JWKSPath, nil)
+	w := httptest.NewRecorder()
+	s.JWKS(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d got %d", http.StatusOK, w.Code)
+	}
+	jObj, err := jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := jObj.GetObjectArray("keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key got %d", len(keys))
+	}
+	sample := []struct {
+		key, value string
+	}{
+		{"kty", "OKP"},
+		{"crv", "Ed25519"},
+		{"alg", "EdDSA"},
+		{"kid", key.ID},
+	}
+	for _, v := range sample {
+		value, err := keys[0].GetString(v.key)
+		if err != nil {
+			t.Error(err)
+		}
+		if value != v.value {
+			t.Errorf("expected %s got %s", v.value, value)
+		}
+	}
+
+	if err = s.RotateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if s.keys.Current() == key {
+		t.Error("expected a new signing key")
+	}
+}
+
+func TestServer_SetKeySet(t *testing.T) {
+	old, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := NewJWTGenWithKeys(NewKeySet(old))
+	s := &Server{cfg: DefaultConfig(), gen: gen, keys: gen.Keys()}
+
+	key, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetKeySet(NewKeySet(key))
+
+	// access tokens are signed with the keys published by JWKS.
+	if gen.Keys() != s.keys || gen.Keys().Current() != key {
+		t.Error("expected the token generator to use the new keys")
+	}
+}
+
+func TestServer_RotateKeysEvery(t *testing.T) {
+	key, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.SigningAlg = "ES256"
+	s := &Server{cfg: cfg}
+	s.SetKeySet(NewKeySet(key))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.RotateKeysEvery(10*time.Millisecond, stop)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.keys.Current() == key && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+	if s.keys.Current() == key {
+		t.Error("expected the keys to be rotated")
+	}
+}
+
+func TestJWKPublicKey(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		key, err := GenerateSigningKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, err := newJWK(key.Private.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !k.Allows(alg) {
+			t.Errorf("expected %s key to allow %s", k.Kty, alg)
+		}
+		if k.Allows("HS256") {
+			t.Errorf("expected %s key to not allow HS256", k.Kty)
+		}
+		pub, err := k.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := newJWK(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *again != *k {
+			t.Errorf("expected %v got %v", k, again)
+		}
+	}
+
+	bad := &jwk{Kty: "EC", Crv: "P-256", X: "AQAB", Y: "AQAB"}
+	if _, err := bad.PublicKey(); err != errInvalidKey {
+		t.Errorf("expected %v got %v", errInvalidKey, err)
+	}
+}
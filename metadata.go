@@ -0,0 +1,105 @@
+package hero
+
+import (
+	"net/http"
+	"sort"
+)
+
+// serverMetadata returns the metadata of this authorization server as described in
+// RFC 8414 section 2, the endpoints are absolute urls built from the Config. Only
+// the endpoints that are enabled are listed, and JWT secured responses only when
+// there are keys to sign them.
+func (s *Server) serverMetadata() map[string]interface{} {
+	authMethods := []string{
+		authMethod.SecretBasic, authMethod.SecretPost,
+		authMethod.SecretJWT, authMethod.PrivateKeyJWT,
+		authMethod.TLSClientAuth, authMethod.SelfSignedTLSClientAuth, authMethod.None,
+	}
+	clientAlgs := []string{
+		"HS256", "HS384", "HS512", "RS256", "RS384", "RS512",
+		"ES256", "ES384", "ES512", SigningMethodEdDSA.Alg(),
+	}
+	md := map[string]interface{}{
+		"issuer":                 s.cfg.Issuer,
+		"authorization_endpoint": s.cfg.EndpointURL(s.cfg.AuthEndpoint),
+		"token_endpoint":         s.cfg.EndpointURL(s.cfg.TokenEndpoint),
+		"userinfo_endpoint":      s.cfg.EndpointURL(s.cfg.InfoEndpoint),
+		"jwks_uri":               s.cfg.EndpointURL(JWKSPath),
+	}
+	if s.cfg.RevokeEndpoint != "" {
+		md["revocation_endpoint"] = s.cfg.EndpointURL(s.cfg.RevokeEndpoint)
+		md["revocation_endpoint_auth_methods_supported"] = authMethods
+	}
+	if s.cfg.IntrospectEndpoint != "" {
+		md["introspection_endpoint"] = s.cfg.EndpointURL(s.cfg.IntrospectEndpoint)
+		md["introspection_endpoint_auth_methods_supported"] = authMethods
+	}
+	if s.cfg.DeviceEndpoint != "" {
+		md["device_authorization_endpoint"] = s.cfg.EndpointURL(s.cfg.DeviceEndpoint)
+	}
+	if s.cfg.RegisterEndpoint != "" {
+		md["registration_endpoint"] = s.cfg.EndpointURL(s.cfg.RegisterEndpoint)
+	}
+	if s.cfg.PAREndpoint != "" {
+		md["pushed_authorization_request_endpoint"] = s.cfg.EndpointURL(s.cfg.PAREndpoint)
+		md["require_pushed_authorization_requests"] = false
+	}
+	if s.cfg.CIBAEndpoint != "" {
+		md["backchannel_authentication_endpoint"] = s.cfg.EndpointURL(s.cfg.CIBAEndpoint)
+		md["backchannel_token_delivery_modes_supported"] = []string{backchannelMode.Poll, backchannelMode.Ping}
+		md["backchannel_user_code_parameter_supported"] = false
+	}
+	md["response_types_supported"] = []string{requestType.Code, requestType.Token}
+	modes := []string{responseMode.Query, responseMode.Fragment, responseMode.FormPost}
+	if s.keys.Current() != nil {
+		modes = append(modes, responseMode.JWT, responseMode.QueryJWT, responseMode.FragmentJWT, responseMode.FormPostJWT)
+		md["authorization_signing_alg_values_supported"] = s.keys.Algs()
+	}
+	md["response_modes_supported"] = modes
+	if scopes, err := s.supportedScopes(); err == nil {
+		md["scopes_supported"] = scopes
+	} else {
+		s.log.Println(err)
+	}
+	md["grant_types_supported"] = s.grantTypeOptions()
+	md["token_endpoint_auth_methods_supported"] = authMethods
+	md["token_endpoint_auth_signing_alg_values_supported"] = clientAlgs
+	md["tls_client_certificate_bound_access_tokens"] = true
+	md["dpop_signing_alg_values_supported"] = []string{
+		"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", SigningMethodEdDSA.Alg(),
+	}
+	md["request_object_signing_alg_values_supported"] = clientAlgs
+	md["request_parameter_supported"] = true
+	md["request_uri_parameter_supported"] = true
+	md["require_request_uri_registration"] = true
+	md["code_challenge_methods_supported"] = []string{
+		codeChallengeMethod.Plain, codeChallengeMethod.S256,
+	}
+	return md
+}
+
+// supportedScopes returns the names of the scopes any client can request, the
+// restricted scopes are left out.
+func (s *Server) supportedScopes() ([]string, error) {
+	reg, err := s.scopeRegistry()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name, sc := range reg {
+		if !sc.Restricted {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// AuthorizationServerMetadata serves the OAuth 2.0 authorization server metadata
+// of RFC 8414, clients use it to find the endpoints and capabilities of this server
+// instead of configuring them by hand.
+func (s *Server) AuthorizationServerMetadata(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(w)
+	ctx.Data = s.serverMetadata()
+	_ = ctx.CommitJSON()
+}
@@ -0,0 +1,109 @@
+package hero
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/antonholmquist/jason"
+)
+
+func TestServer_AuthorizationServerMetadata(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RevokeEndpoint = ""
+	s := &Server{cfg: cfg, q: &memStore{scopes: []Scope{
+		{Name: "photos"},
+		{Name: "admin", Restricted: true},
+	}}}
+	req, _ := http.NewRequest("GET", AuthServerMetadataPath, nil)
+	w := httptest.NewRecorder()
+	s.AuthorizationServerMetadata(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d got %d", http.StatusOK, w.Code)
+	}
+	jObj, err := jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample := []struct {
+		key, value string
+	}{
+		{"issuer", cfg.Issuer},
+		{"authorization_endpoint", cfg.Issuer + cfg.AuthEndpoint},
+		{"token_endpoint", cfg.Issuer + cfg.TokenEndpoint},
+		{"introspection_endpoint", cfg.Issuer + cfg.IntrospectEndpoint},
+		{"device_authorization_endpoint", cfg.Issuer + cfg.DeviceEndpoint},
+		{"registration_endpoint", cfg.Issuer + cfg.RegisterEndpoint},
+		{"pushed_authorization_request_endpoint", cfg.Issuer + cfg.PAREndpoint},
+		{"jwks_uri", cfg.Issuer + JWKSPath},
+	}
+	for _, v := range sample {
+		value, err := jObj.GetString(v.key)
+		if err != nil {
+			t.Error(err)
+		}
+		if value != v.value {
+			t.Errorf("expected %s got %s", v.value, value)
+		}
+	}
+	if _, err = jObj.GetString("revocation_endpoint"); err == nil {
+		t.Error("expected disabled endpoints to be left out")
+	}
+
+	lists := []struct {
+		key    string
+		values []string
+	}{
+		{"grant_types_supported", append([]string{grantTypeImplicit}, cfg.AllowedAccessType...)},
+		{"response_types_supported", []string{requestType.Code, requestType.Token}},
+		{"scopes_supported", []string{oidcScope.OpenID, "photos"}},
+		{"token_endpoint_auth_methods_supported", []string{authMethod.SecretBasic, authMethod.PrivateKeyJWT}},
+		{"code_challenge_methods_supported", []string{codeChallengeMethod.S256}},
+	}
+	for _, v := range lists {
+		got, err := jObj.GetStringArray(v.key)
+		if err != nil {
+			t.Errorf("%s: %v", v.key, err)
+			continue
+		}
+		for _, want := range v.values {
+			found := false
+			for _, g := range got {
+				if g == want {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("expected %s in %s got %v", want, v.key, got)
+			}
+		}
+	}
+	scopes, _ := jObj.GetStringArray("scopes_supported")
+	for _, sc := range scopes {
+		if sc == "admin" {
+			t.Error("expected restricted scopes to be left out")
+		}
+	}
+
+	// JWT secured responses are not offered without signing keys.
+	modes, _ := jObj.GetStringArray("response_modes_supported")
+	for _, m := range modes {
+		if m == responseMode.JWT {
+			t.Error("expected no jwt response mode without keys")
+		}
+	}
+	key, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetKeySet(NewKeySet(key))
+	w = httptest.NewRecorder()
+	s.AuthorizationServerMetadata(w, req)
+	jObj, err = jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algs, _ := jObj.GetStringArray("authorization_signing_alg_values_supported"); len(algs) != 1 || algs[0] != "ES256" {
+		t.Errorf("expected ES256 got %v", algs)
+	}
+}
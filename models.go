@@ -37,6 +37,11 @@ type Token struct {
 	ClientID  int64
 	UserID    int64
 	ExpiresIn int64
+
+	// Family is shared by the refresh tokens issued by refreshing the same grant,
+	// Used is set once a refresh token has been exchanged for a new one.
+	Family    string
+	Used      bool
 	CreatedAT time.Time
 	UpdatedAt time.Time
 }
@@ -51,8 +56,82 @@ type Client struct {
 	Grants      []Grant
 	Tokens      []Token
 	RedirectURL string
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+
+	// Public is true for clients that can not keep their secret confidential
+	// e.g mobile and single page applications. Public clients must use PKCE.
+	Public bool
+
+	// Scope is the space delimited list of scopes the client may request, when it
+	// is empty the client may request any scope that is not restricted.
+	Scope string
+
+	// JWKS is the JSON Web Key Set with the public keys of the client, JWTs the
+	// client signs are verified with them.
+	JWKS string `sql:"type:text"`
+
+	// JWTSecret is the key of JWTs the client signs with HMAC. Unlike Secret it is
+	// stored as is since it is needed to verify the signatures.
+	JWTSecret string
+
+	// TLSClientAuthSubjectDN and TLSClientAuthSAN identify the certificate of a
+	// client using tls_client_auth, either the subject distinguished name or one
+	// of the subject alternative names must match.
+	TLSClientAuthSubjectDN string
+	TLSClientAuthSAN       string
+
+	// TLSClientAuthThumbprint is the base64url encoded SHA-256 thumbprint of the
+	// certificate of a client using self_signed_tls_client_auth.
+	TLSClientAuthThumbprint string
+
+	// TokenEndpointAuthMethod is the only way the client may authenticate, any is
+	// allowed when it is empty.
+	TokenEndpointAuthMethod string
+
+	// GrantTypes and ResponseTypes are the space delimited grant types and response
+	// types the client may use, any is allowed when they are empty.
+	GrantTypes    string
+	ResponseTypes string
+	LogoURI       string
+
+	// RequestURIs are the space delimited urls the client may pass as request_uri,
+	// its request objects are fetched from them.
+	RequestURIs string
+
+	// RequirePAR is true for clients that must push their authorization requests
+	// to the PAR endpoint, as described in RFC 9126 section 6.
+	RequirePAR bool
+
+	// BackchannelMode is how the client gets the result of its backchannel
+	// authentication requests(CIBA), poll when it is empty. Ping mode clients are
+	// notified at BackchannelNotifyURI.
+	BackchannelMode      string
+	BackchannelNotifyURI string
+
+	// RegistrationToken is the hashed registration access token the client manages
+	// its registration with, as described in RFC 7592.
+	RegistrationToken string
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
+
+// AllowsAuthMethod returns true if the client may authenticate using method.
+func (c *Client) AllowsAuthMethod(method string) bool {
+	return c.TokenEndpointAuthMethod == "" || c.TokenEndpointAuthMethod == method
+}
+
+// AllowsGrant returns true if the client may use the grant type. Refresh tokens
+// are issued with every grant, so they may be used by clients allowed any grant.
+func (c *Client) AllowsGrant(grant string) bool {
+	if c.GrantTypes == "" || grant == grantType.RefreshToken {
+		return true
+	}
+	return hasScope(c.GrantTypes, grant)
+}
+
+// AllowsResponseType returns true if the client may use the authorization response
+// type typ.
+func (c *Client) AllowsResponseType(typ string) bool {
+	return c.ResponseTypes == "" || hasScope(c.ResponseTypes, typ)
 }
 
 // Session stores session data from gorilla/sessions
@@ -65,6 +144,161 @@ type Session struct {
 	UpdatedAt time.Time
 }
 
+// Scope is a registered scope that clients can request.
+type Scope struct {
+	ID          int64
+	Name        string
+	Description string
+
+	// Default scopes are granted when the client does not request any scope.
+	Default bool
+
+	// Restricted scopes are only granted to clients which list them in their
+	// Scope.
+	Restricted bool
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// DeviceAuthorization is an authorization request made by a device that can not
+// use a browser, as described in RFC 8628. The user approves it by entering the
+// UserCode on another device.
+type DeviceAuthorization struct {
+	ID         int64
+	DeviceCode string
+	UserCode   string
+	ClientID   int64
+	Scope      string
+	ExpiresIn  int64
+
+	// Interval is the minimum number of seconds the device must wait between polls
+	// and LastPoll is the unix time of its last poll.
+	Interval int64
+	LastPoll int64
+
+	// UserID is the user who approved or denied the request.
+	UserID    int64
+	Approved  bool
+	Denied    bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// IsExpired returns true if the device authorization is expired.
+func (d *DeviceAuthorization) IsExpired() bool {
+	return d.CreatedAt.Add(time.Duration(d.ExpiresIn) * time.Second).Before(time.Now())
+}
+
+// BackchannelRequest is a backchannel authentication request(CIBA) a client made
+// for a user, who approves or denies it on their own device.
+type BackchannelRequest struct {
+	ID        int64
+	AuthReqID string
+	ClientID  int64
+	UserID    int64
+	Scope     string
+	ExpiresIn int64
+
+	// BindingMessage is shown to the user on both devices so they can tell the
+	// request is the one they are approving.
+	BindingMessage string
+
+	// NotifyToken is the bearer token ping mode clients are notified with.
+	NotifyToken string
+
+	// Interval is the minimum number of seconds the client must wait between polls
+	// and LastPoll is the unix time of its last poll.
+	Interval int64
+	LastPoll int64
+
+	Approved  bool
+	Denied    bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// IsExpired returns true if the backchannel authentication request is expired.
+func (b *BackchannelRequest) IsExpired() bool {
+	return b.CreatedAt.Add(time.Duration(b.ExpiresIn) * time.Second).Before(time.Now())
+}
+
+// PushedRequest is an authorization request that a client pushed to the PAR
+// endpoint, as described in RFC 9126. The client refers to it with RequestURI when
+// it sends the user to the authorization endpoint.
+type PushedRequest struct {
+	ID         int64
+	RequestURI string
+	ClientID   int64
+
+	// Params are the url encoded authorization request parameters.
+	Params    string `sql:"type:text"`
+	ExpiresIn int64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// IsExpired returns true if the request_uri of the pushed request can no longer be
+// used.
+func (p *PushedRequest) IsExpired() bool {
+	return p.CreatedAt.Add(time.Duration(p.ExpiresIn) * time.Second).Before(time.Now())
+}
+
+// Resource is an API that tokens can be restricted to with the resource parameter,
+// as described in RFC 8707.
+type Resource struct {
+	ID int64
+
+	// Identifier is the absolute uri clients refer to the resource with, it is
+	// the audience of the tokens issued for it.
+	Identifier string `sql:"unique"`
+	Name       string
+
+	// Scope is the space delimited list of the scopes tokens for the resource can
+	// carry, any scope is accepted when empty.
+	Scope string
+
+	// ClientID is the client the resource server authenticates as when it
+	// introspects the tokens it is presented with.
+	ClientID  int64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// AuthorizationDetailType is a type of the authorization details clients can request
+// with authorization_details, as described in RFC 9396.
+type AuthorizationDetailType struct {
+	ID          int64
+	Type        string `sql:"unique"`
+	Description string
+
+	// Fields is the space delimited list of the fields details of the type can
+	// have besides the common ones, any field is accepted when empty.
+	Fields    string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Assertion is a JWT that was presented by a client, it is remembered until it
+// expires so it can not be replayed. The id of the JWT is unique per client, so
+// concurrent requests presenting the same JWT can not both record it.
+type Assertion struct {
+	ID        int64
+	ClientID  int64  `sql:"unique_index:idx_assertion_client_jti"`
+	JTI       string `sql:"unique_index:idx_assertion_client_jti"`
+	ExpiresAt int64
+	CreatedAt time.Time
+}
+
+// Consent records the scopes a user has allowed a client to be granted.
+type Consent struct {
+	ID        int64
+	UserID    int64
+	ClientID  int64
+	Scope     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
 // Grant is a hero grant object.
 type Grant struct {
 	ID               int64
@@ -82,8 +316,44 @@ type Grant struct {
 	State            string
 	RedirectURL      string
 	ExpiresIn        int64
-	CreatedAt        time.Time
-	UpdatedAt        time.Time
+
+	// CodeChallenge and CodeChallengeMethod are the PKCE(RFC 7636) parameters sent
+	// with the authorization request.
+	CodeChallenge       string
+	CodeChallengeMethod string
+
+	// Nonce is the OpenID Connect nonce sent with the authorization request and
+	// AuthTime is the unix time when the user authenticated.
+	Nonce    string
+	AuthTime int64
+
+	// Family identifies the chain of grants made by refreshing the grant issued for
+	// an authorization, it is the same as the Family of their refresh tokens.
+	Family string
+
+	// CertThumbprint is the base64url encoded SHA-256 thumbprint of the TLS client
+	// certificate the access token is bound to, as described in RFC 8705.
+	CertThumbprint string
+
+	// DPoPThumbprint is the JWK thumbprint of the key the access token is bound to
+	// with DPoP, as described in RFC 9449.
+	DPoPThumbprint string
+
+	// AuthorizationDetails is the JSON encoded authorization_details granted, as
+	// described in RFC 9396.
+	AuthorizationDetails string `sql:"type:text"`
+
+	// Audience is the space delimited list of the audiences and resources the
+	// access token is meant for, it is any when empty. It is set on authorization
+	// codes too so the token can be restricted to the resources the user
+	// authorized.
+	Audience string
+
+	// Act is the JSON encoded act claim of tokens issued through token exchange,
+	// it names who acts on behalf of the user as described in RFC 8693.
+	Act       string `sql:"type:text"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
 // IsExpired returns true if the grant is expired.
@@ -96,6 +366,26 @@ type TokenGenerator interface {
 	Generate() string
 }
 
+// AccessTokenGenerator is implemented by token generators which embed the details
+// of the grant in the access tokens they generate. When the TokenGenerator used by
+// *Server implements it, GenerateAccess is used for access tokens instead of
+// Generate.
+type AccessTokenGenerator interface {
+	GenerateAccess(tc *TokenContext) (string, error)
+}
+
+// TokenContext is what an access token is issued for.
+type TokenContext struct {
+	Issuer string
+	Grant  *Grant
+	Client *Client
+
+	// User is the user of the grant, it is nil when there is none. Client
+	// credentials grants carry the user owning the client, who is not the subject
+	// of the token.
+	User *User
+}
+
 func newToken(code string) Token {
 	return Token{Code: code}
 }
@@ -0,0 +1,155 @@
+package hero
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	errNoTLSClientAuth = errors.New("hero: the client has no registered certificate")
+	errCertMismatch    = errors.New("hero: the certificate does not match the client")
+	errCertValidity    = errors.New("hero: the certificate is not valid at this time")
+)
+
+// SetClientCAs sets the certificate authorities trusted to issue the certificates
+// of clients using tls_client_auth.
+func (s *Server) SetClientCAs(pool *x509.CertPool) {
+	s.clientCAs = pool
+}
+
+// peerCertificate returns the TLS client certificate presented with r, nil is
+// returned when there is none.
+func peerCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// certThumbprint returns the base64url encoded SHA-256 hash of the DER encoding of
+// cert, it is the x5t#S256 confirmation method of RFC 8705.
+func certThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// certClient authenticates the client with the TLS client certificate it presented
+// as described in RFC 8705 section 2.
+//
+// Certificates of clients using tls_client_auth must chain to a trusted authority
+// and match the registered subject DN or SAN, self signed certificates must match
+// the registered thumbprint. Public clients without a registered certificate are
+// accepted, their certificate is only used to bind their tokens.
+func (s *Server) certClient(auth *certAuth) (*Client, error) {
+	client, err := s.q.ClientByCode(auth.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	cert := auth.Cert
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errCertValidity
+	}
+
+	var method string
+	switch {
+	case client.TLSClientAuthThumbprint != "":
+		method = authMethod.SelfSignedTLSClientAuth
+		if subtle.ConstantTimeCompare([]byte(certThumbprint(cert)), []byte(client.TLSClientAuthThumbprint)) != 1 {
+			return nil, errCertMismatch
+		}
+	case client.TLSClientAuthSubjectDN != "" || client.TLSClientAuthSAN != "":
+		method = authMethod.TLSClientAuth
+		intermediates := x509.NewCertPool()
+		for _, c := range auth.Chain {
+			intermediates.AddCert(c)
+		}
+		_, err = cert.Verify(x509.VerifyOptions{
+			Roots:         s.clientCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !matchCert(client, cert) {
+			return nil, errCertMismatch
+		}
+	case client.Public:
+		method = authMethod.None
+	default:
+		return nil, errNoTLSClientAuth
+	}
+	if !client.AllowsAuthMethod(method) {
+		return nil, errUnauthorizedAuthMethod
+	}
+	return client, nil
+}
+
+// matchCert returns true if the subject DN or one of the subject alternative names
+// of cert is the one registered by client.
+func matchCert(client *Client, cert *x509.Certificate) bool {
+	if dn := client.TLSClientAuthSubjectDN; dn != "" && cert.Subject.String() == dn {
+		return true
+	}
+	san := client.TLSClientAuthSAN
+	if san == "" {
+		return false
+	}
+	for _, name := range cert.DNSNames {
+		if name == san {
+			return true
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if email == san {
+			return true
+		}
+	}
+	for _, ip := range cert.IPAddresses {
+		if ip.String() == san {
+			return true
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == san {
+			return true
+		}
+	}
+	return false
+}
+
+// certBound returns true if the access token of g may be used with r. Tokens
+// bound to a certificate must be presented over a connection authenticated with
+// the same certificate.
+func certBound(g *Grant, r *http.Request) bool {
+	if g.CertThumbprint == "" {
+		return true
+	}
+	cert := peerCertificate(r)
+	if cert == nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(certThumbprint(cert)), []byte(g.CertThumbprint)) == 1
+}
+
+// confirmation returns the cnf claim of the access token of g, nil is returned
+// when the token is not bound to a certificate or a DPoP key.
+func confirmation(g *Grant) map[string]interface{} {
+	cnf := make(map[string]interface{})
+	if g.CertThumbprint != "" {
+		cnf["x5t#S256"] = g.CertThumbprint
+	}
+	if g.DPoPThumbprint != "" {
+		cnf["jkt"] = g.DPoPThumbprint
+	}
+	if len(cnf) == 0 {
+		return nil
+	}
+	return cnf
+}
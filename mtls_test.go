@@ -0,0 +1,66 @@
+package hero
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a client certificate for name signed by parent, the
+// certificate is self signed when parent is nil.
+func newTestCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"hero"}},
+		DNSNames:     []string{name + ".example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestMatchCert(t *testing.T) {
+	cert, _ := newTestCert(t, "client", nil, nil)
+	sample := []struct {
+		client Client
+		match  bool
+	}{
+		{Client{TLSClientAuthSubjectDN: "CN=client,O=hero"}, true},
+		{Client{TLSClientAuthSubjectDN: "CN=other,O=hero"}, false},
+		{Client{TLSClientAuthSAN: "client.example.com"}, true},
+		{Client{TLSClientAuthSAN: "127.0.0.1"}, true},
+		{Client{TLSClientAuthSAN: "other.example.com"}, false},
+		{Client{}, false},
+	}
+	for _, v := range sample {
+		if m := matchCert(&v.client, cert); m != v.match {
+			t.Errorf("expected %v got %v for %+v", v.match, m, v.client)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package hero
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// oidcScope contains the scopes defined by OpenID Connect.
+// http://openid.net/specs/openid-connect-core-1_0.html#ScopeClaims
+var oidcScope = struct {
+	OpenID, Profile, Email string
+}{
+	"openid", "profile", "email",
+}
+
+var errNoSigningKey = errors.New("hero: no key for signing tokens")
+
+// idToken returns a signed OpenID Connect id token for the user of the grant g.
+// http://openid.net/specs/openid-connect-core-1_0.html#IDToken
+func (s *Server) idToken(g *Grant) (string, error) {
+	client, err := s.q.ClientByID(g.ClientID)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": s.cfg.Issuer,
+		"sub": strconv.FormatInt(g.UserID, 10),
+		"aud": client.UUID,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Duration(s.cfg.AccessExpire) * time.Second).Unix(),
+	}
+	if g.AuthTime != 0 {
+		claims["auth_time"] = g.AuthTime
+	}
+	if g.Nonce != "" {
+		claims["nonce"] = g.Nonce
+	}
+	return s.keys.Sign(claims)
+}
+
+// userClaims returns the standard claims about usr that are released for scope.
+// The legacy user scope is still honored, nil is returned when scope does not
+// allow any claims.
+// http://openid.net/specs/openid-connect-core-1_0.html#StandardClaims
+func userClaims(usr *User, scope string) map[string]interface{} {
+	claims := make(map[string]interface{})
+	if hasScope(scope, "user") {
+		claims["email"] = usr.Email
+		claims["avatar_url"] = usr.Avatar
+		claims["name"] = usr.UserName
+	}
+	if !hasScope(scope, oidcScope.OpenID) {
+		if len(claims) == 0 {
+			return nil
+		}
+		return claims
+	}
+
+	claims["sub"] = strconv.FormatInt(usr.ID, 10)
+	if hasScope(scope, oidcScope.Profile) {
+		p := usr.Profile
+		name := strings.TrimSpace(p.FirstName + " " + p.LastName)
+		if name == "" {
+			name = usr.UserName
+		}
+		picture := p.AvatarURL
+		if picture == "" {
+			picture = usr.Avatar
+		}
+		claims["name"] = name
+		claims["preferred_username"] = usr.UserName
+		claims["updated_at"] = usr.UpdatedAt.Unix()
+		if p.FirstName != "" {
+			claims["given_name"] = p.FirstName
+		}
+		if p.LastName != "" {
+			claims["family_name"] = p.LastName
+		}
+		if picture != "" {
+			claims["picture"] = picture
+		}
+	}
+	if hasScope(scope, oidcScope.Email) {
+		claims["email"] = usr.Email
+		claims["email_verified"] = false
+	}
+	return claims
+}
+
+// OpenIDConfiguration serves the OpenID Connect discovery document, it describes
+// the endpoints and capabilities of this provider. It extends the authorization
+// server metadata with what is specific to OpenID Connect.
+// http://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+func (s *Server) OpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(w)
+	ctx.Data = s.serverMetadata()
+	ctx.SetData("subject_types_supported", []string{"public"})
+	ctx.SetData("id_token_signing_alg_values_supported", s.keys.Algs())
+	ctx.SetData("claims_supported", []string{
+		"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce",
+		"name", "given_name", "family_name", "preferred_username",
+		"picture", "updated_at", "email", "email_verified",
+	})
+	_ = ctx.CommitJSON()
+}
@@ -0,0 +1,80 @@
+package hero
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/antonholmquist/jason"
+)
+
+func TestUserClaims(t *testing.T) {
+	usr := &User{
+		ID:       7,
+		UserName: "gernest",
+		Email:    "hero@swordsplay.com",
+		Profile: Profile{
+			FirstName: "Geofrey",
+			LastName:  "Ernest",
+		},
+	}
+
+	if c := userClaims(usr, "profile"); c != nil {
+		t.Errorf("expected no claims without openid scope got %v", c)
+	}
+
+	c := userClaims(usr, "openid")
+	if c["sub"] != "7" {
+		t.Errorf("expected 7 got %v", c["sub"])
+	}
+	if _, ok := c["email"]; ok {
+		t.Error("expected email to require the email scope")
+	}
+
+	c = userClaims(usr, "openid profile email")
+	if c["name"] != "Geofrey Ernest" {
+		t.Errorf("expected Geofrey Ernest got %v", c["name"])
+	}
+	if c["preferred_username"] != usr.UserName {
+		t.Errorf("expected %s got %v", usr.UserName, c["preferred_username"])
+	}
+	if c["email"] != usr.Email {
+		t.Errorf("expected %s got %v", usr.Email, c["email"])
+	}
+
+	c = userClaims(usr, "user")
+	if c["name"] != usr.UserName {
+		t.Errorf("expected %s got %v", usr.UserName, c["name"])
+	}
+}
+
+func TestServer_OpenIDConfiguration(t *testing.T) {
+	s := &Server{cfg: DefaultConfig(), q: &memStore{}}
+	req, _ := http.NewRequest("GET", OpenIDConfigPath, nil)
+	w := httptest.NewRecorder()
+	s.OpenIDConfiguration(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d got %d", http.StatusOK, w.Code)
+	}
+	jObj, err := jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample := []struct {
+		key, value string
+	}{
+		{"issuer", s.cfg.Issuer},
+		{"authorization_endpoint", s.cfg.Issuer + s.cfg.AuthEndpoint},
+		{"token_endpoint", s.cfg.Issuer + s.cfg.TokenEndpoint},
+		{"userinfo_endpoint", s.cfg.Issuer + s.cfg.InfoEndpoint},
+	}
+	for _, v := range sample {
+		value, err := jObj.GetString(v.key)
+		if err != nil {
+			t.Error(err)
+		}
+		if value != v.value {
+			t.Errorf("expected %s got %s", v.value, value)
+		}
+	}
+}
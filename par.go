@@ -0,0 +1,184 @@
+package hero
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// requestURIPrefix is the prefix of the request_uri of pushed authorization
+// requests, as suggested by RFC 9126 section 2.2.
+const requestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+
+var errInvalidRequestURI = errors.New("hero: the request_uri is unknown or expired")
+
+// PushedAuthorization provide the pushed authorization request endpoint of RFC 9126.
+// Authenticated clients post the parameters of their authorization request, or a
+// request object carrying them, and get a request_uri which they send to the
+// authorization endpoint in their place so the parameters do not travel through
+// the user agent.
+func (s *Server) PushedAuthorization(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(w)
+	ctx.StatusCode = http.StatusBadRequest
+	if r.Method != "POST" {
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		ctx.InternalError = errors.New("request must be POST")
+		_ = ctx.CommitJSON()
+		return
+	}
+	_ = r.ParseForm()
+
+	auth, err := requestClientAuth(r)
+	if err != nil {
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errorsKeys.InvalidClient, "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+	client := s.getClient(auth)
+	if client == nil {
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errorsKeys.InvalidClient, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	form := r.PostForm
+	if form.Get(params.requestURI) != "" {
+		ctx.SetError(errorsKeys.InvalidRequest, "request_uri can not be pushed")
+		_ = ctx.CommitJSON()
+		return
+	}
+	if token := form.Get(params.request); token != "" {
+		claims, err := s.verifyRequestObject(client, token)
+		if err != nil {
+			ctx.SetError(errorsKeys.InvalidRequestObject, "")
+			ctx.InternalError = err
+			_ = ctx.CommitJSON()
+			return
+		}
+		form.Del(params.request)
+		for k, v := range claims {
+			form[k] = v
+		}
+	}
+	if id := form.Get(params.clientID); id != "" && id != client.UUID {
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+	if errID := s.checkPushedRequest(client, form); errID != "" {
+		ctx.SetError(errID, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	// client credentials are not part of the authorization request.
+	pushed := url.Values{}
+	for k, v := range form {
+		switch k {
+		case params.clientSecret, "client_assertion", "client_assertion_type":
+			continue
+		}
+		pushed[k] = v
+	}
+	pushed.Set(params.clientID, client.UUID)
+
+	b, err := generateRandomToken(32)
+	if err != nil {
+		ctx.StatusCode = http.StatusInternalServerError
+		ctx.SetError(errorsKeys.ServerError, "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+	p := &PushedRequest{
+		RequestURI: requestURIPrefix + base64.RawURLEncoding.EncodeToString(b),
+		ClientID:   client.ID,
+		Params:     pushed.Encode(),
+		ExpiresIn:  s.cfg.PARExpire,
+	}
+	if err = s.q.SavePushedRequest(p); err != nil {
+		ctx.StatusCode = http.StatusInternalServerError
+		ctx.SetError(errorsKeys.ServerError, "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+	ctx.StatusCode = http.StatusCreated
+	ctx.SetData(params.requestURI, p.RequestURI)
+	ctx.SetData(params.expiresIn, p.ExpiresIn)
+	_ = ctx.CommitJSON()
+}
+
+// checkPushedRequest validates the pushed authorization request form of client the
+// way the authorization endpoint would, so mistakes are reported to the client
+// instead of the user. The error code is returned, it is empty when form is valid.
+func (s *Server) checkPushedRequest(client *Client, form url.Values) string {
+	redirectURI := form.Get(params.redirectURL)
+	if redirectURI == "" && firstURI(client.RedirectURL, s.cfg.RedirSeparator) == client.RedirectURL {
+		redirectURI = client.RedirectURL
+	}
+	if client.RedirectURL == "" || validateURIList(client.RedirectURL, redirectURI, s.cfg.RedirSeparator) != nil {
+		return errorsKeys.InvalidRequest
+	}
+	scope, err := s.validScope(client, form.Get(params.scope))
+	if err != nil {
+		return scopeError(err)
+	}
+	if _, err = s.resourceAudience(form, scope); err != nil {
+		return targetError(err)
+	}
+	if _, err = s.authorizationDetails(form.Get(params.authDetails)); err != nil {
+		return detailsError(err)
+	}
+	typ := form.Get(params.responseType)
+	switch typ {
+	case requestType.Code, requestType.Token:
+		if !client.AllowsResponseType(typ) {
+			return errorsKeys.UnauthorizedClient
+		}
+	default:
+		return errorsKeys.UnsupportedResponseType
+	}
+	if challenge := form.Get(params.codeChallenge); challenge != "" {
+		if _, err := validCodeChallenge(challenge, form.Get(params.codeChallengeMethod)); err != nil {
+			return errorsKeys.InvalidRequest
+		}
+	} else if client.Public && typ == requestType.Code {
+		return errorsKeys.InvalidRequest
+	}
+	return ""
+}
+
+// pushedRequest replaces the authorization request parameters of r with the ones
+// of the pushed request its request_uri refers to. Only the parameters of the login
+// and consent forms are kept from r.
+func (s *Server) pushedRequest(r *http.Request) (*PushedRequest, error) {
+	p, err := s.q.PushedRequestByURI(r.Form.Get(params.requestURI))
+	if err != nil {
+		return nil, err
+	}
+	if p.IsExpired() {
+		return nil, errInvalidRequestURI
+	}
+	form, err := url.ParseQuery(p.Params)
+	if err != nil {
+		return nil, err
+	}
+	if form.Get(params.clientID) != r.Form.Get(params.clientID) {
+		return nil, errInvalidRequestURI
+	}
+	for _, k := range []string{
+		params.requestURI, params.csrfToken, consentParams.decision,
+		loginParams.username, loginParams.password,
+	} {
+		if v, ok := r.Form[k]; ok {
+			form[k] = v
+		}
+	}
+	r.Form = form
+	return p, nil
+}
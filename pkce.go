@@ -0,0 +1,80 @@
+package hero
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+)
+
+// codeChallengeMethod contains the PKCE code challenge methods supported by hero.
+// https://tools.ietf.org/html/rfc7636#section-4.2
+var codeChallengeMethod = struct {
+	Plain, S256 string
+}{
+	"plain", "S256",
+}
+
+var (
+	errInvalidChallengeMethod = errors.New("unsupported code challenge method")
+	errInvalidCodeVerifier    = errors.New("invalid code verifier")
+	errCodeVerifierMismatch   = errors.New("code verifier does not match code challenge")
+)
+
+// validCodeChallenge returns the method to be used with challenge. When method is
+// empty plain is assumed as required by the spec.
+func validCodeChallenge(challenge, method string) (string, error) {
+	if method == "" {
+		method = codeChallengeMethod.Plain
+	}
+	if method != codeChallengeMethod.Plain && method != codeChallengeMethod.S256 {
+		return "", errInvalidChallengeMethod
+	}
+	if !isCodeVerifier(challenge) {
+		return "", errInvalidCodeVerifier
+	}
+	return method, nil
+}
+
+// verifyCodeChallenge checks verifier against the code challenge stored in the
+// authorization grant. Grants without a code challenge are not checked.
+func verifyCodeChallenge(g *Grant, verifier string) error {
+	if g.CodeChallenge == "" {
+		return nil
+	}
+	if !isCodeVerifier(verifier) {
+		return errInvalidCodeVerifier
+	}
+	var computed string
+	switch g.CodeChallengeMethod {
+	case codeChallengeMethod.S256:
+		h := sha256.Sum256([]byte(verifier))
+		computed = base64.RawURLEncoding.EncodeToString(h[:])
+	case codeChallengeMethod.Plain, "":
+		computed = verifier
+	default:
+		return errInvalidChallengeMethod
+	}
+	if subtle.ConstantTimeCompare([]byte(computed), []byte(g.CodeChallenge)) != 1 {
+		return errCodeVerifierMismatch
+	}
+	return nil
+}
+
+// isCodeVerifier returns true if v is 43 to 128 characters long and only made of
+// unreserved characters [A-Z] / [a-z] / [0-9] / "-" / "." / "_" / "~".
+func isCodeVerifier(v string) bool {
+	if len(v) < 43 || len(v) > 128 {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
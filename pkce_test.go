@@ -0,0 +1,65 @@
+package hero
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// https://tools.ietf.org/html/rfc7636#appendix-B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	sample := []struct {
+		grant    *Grant
+		verifier string
+		valid    bool
+	}{
+		{&Grant{}, "", true},
+		{&Grant{CodeChallenge: challenge, CodeChallengeMethod: codeChallengeMethod.S256}, verifier, true},
+		{&Grant{CodeChallenge: challenge, CodeChallengeMethod: codeChallengeMethod.S256}, challenge, false},
+		{&Grant{CodeChallenge: challenge, CodeChallengeMethod: codeChallengeMethod.S256}, "", false},
+		{&Grant{CodeChallenge: verifier, CodeChallengeMethod: codeChallengeMethod.Plain}, verifier, true},
+		{&Grant{CodeChallenge: verifier}, verifier, true},
+		{&Grant{CodeChallenge: verifier, CodeChallengeMethod: "S512"}, verifier, false},
+	}
+	for _, v := range sample {
+		err := verifyCodeChallenge(v.grant, v.verifier)
+		if v.valid && err != nil {
+			t.Errorf("expected %s to be valid got %v", v.verifier, err)
+		}
+		if !v.valid && err == nil {
+			t.Errorf("expected %s to be invalid", v.verifier)
+		}
+	}
+}
+
+func TestValidCodeChallenge(t *testing.T) {
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	sample := []struct {
+		challenge, method, result string
+		valid                     bool
+	}{
+		{challenge, "", codeChallengeMethod.Plain, true},
+		{challenge, codeChallengeMethod.S256, codeChallengeMethod.S256, true},
+		{challenge, "S512", "", false},
+		{"short", codeChallengeMethod.S256, "", false},
+		{strings.Repeat("a", 129), codeChallengeMethod.Plain, "", false},
+		{strings.Repeat("a", 42) + "+", codeChallengeMethod.Plain, "", false},
+	}
+	for _, v := range sample {
+		m, err := validCodeChallenge(v.challenge, v.method)
+		if v.valid {
+			if err != nil {
+				t.Error(err)
+			}
+			if m != v.result {
+				t.Errorf("expected %s got %s", v.result, m)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("expected %s %s to be invalid", v.challenge, v.method)
+		}
+	}
+}
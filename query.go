@@ -2,62 +2,113 @@ package hero
 
 import (
 	"errors"
+	"time"
 
 	"github.com/jinzhu/gorm"
 )
 
-type query struct {
+// GormStore is a Storage backed by a gorm database. It supports the dialects of
+// gorm, the database is the one in Config.DatabaseDialect when created by
+// NewServer.
+type GormStore struct {
 	*gorm.DB
 }
 
-func (q *query) ClientByCode(code string) (*Client, error) {
+var _ Storage = (*GormStore)(nil)
+
+// NewGormStore returns a *GormStore using db.
+func NewGormStore(db *gorm.DB) *GormStore {
+	return &GormStore{DB: db}
+}
+
+// storeError returns ErrNotFound for the not found errors of gorm, other errors
+// are returned as they are.
+func storeError(err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// models are all the models stored by hero.
+var models = []interface{}{
+	&Token{}, &User{}, &Profile{}, &Session{}, &Client{}, &Grant{}, &Consent{},
+	&Scope{}, &DeviceAuthorization{}, &Assertion{}, &PushedRequest{}, &Resource{},
+	&AuthorizationDetailType{}, &BackchannelRequest{},
+}
+
+// Migrate creates or updates the tables of all the models.
+func (q *GormStore) Migrate() error {
+	return q.AutoMigrate(models...).Error
+}
+
+// DropAll drops the tables of all the models.
+func (q *GormStore) DropAll() error {
+	for _, m := range models {
+		if err := q.DropTableIfExists(m).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *GormStore) ClientByCode(code string) (*Client, error) {
 	c := &Client{}
 	if code == "" {
 		return nil, errors.New("invalid code")
 	}
 	d := q.Where(&Client{UUID: code}).First(c)
 	if d.Error != nil {
-		return nil, d.Error
+		return nil, storeError(d.Error)
 	}
 	return c, nil
 
 }
 
-func (q *query) GrantByRefreshToken(code string) (*Grant, error) {
+func (q *GormStore) ClientByID(id int64) (*Client, error) {
+	c := &Client{}
+	d := q.Where(&Client{ID: id}).First(c)
+	if d.Error != nil {
+		return nil, storeError(d.Error)
+	}
+	return c, nil
+}
+
+func (q *GormStore) GrantByRefreshToken(code string) (*Grant, error) {
 	tok := &Token{}
 	d := q.Where(&Token{Code: code}).First(tok)
 	if d.Error != nil {
-		return nil, d.Error
+		return nil, storeError(d.Error)
 	}
 	g := &Grant{}
 	d = q.Where(&Grant{RefreshTokenID: tok.ID}).First(g)
 	if d.Error != nil {
-		return nil, d.Error
+		return nil, storeError(d.Error)
 	}
 	return g, nil
 }
 
-func (q *query) GrantByCode(code string) (*Grant, error) {
+func (q *GormStore) GrantByCode(code string) (*Grant, error) {
 	g := &Grant{}
 	d := q.Where(&Grant{Code: code}).Preload("AccessToken").Preload("AuthorizaToken").
 		Preload("RefreshToken").First(g)
 	if d.Error != nil {
-		return nil, d.Error
+		return nil, storeError(d.Error)
 	}
 	return g, nil
 }
 
-func (q *query) GrantByCLient(c *Client, code string) (*Grant, error) {
+func (q *GormStore) GrantByClient(c *Client, code string) (*Grant, error) {
 	g := &Grant{}
 	d := q.Where(&Grant{Code: code, ClientID: c.ID}).Preload("AccessToken").Preload("AuthorizeToken").
 		Preload("RefreshToken").First(g)
 	if d.Error != nil {
-		return nil, d.Error
+		return nil, storeError(d.Error)
 	}
 	return g, nil
 }
 
-func (q *query) GrantByBearer(bearerCode string) (*Grant, error) {
+func (q *GormStore) GrantByBearer(bearerCode string) (*Grant, error) {
 	tok, err := q.TokenByCode(bearerCode)
 	if err != nil {
 		return nil, err
@@ -66,33 +117,227 @@ func (q *query) GrantByBearer(bearerCode string) (*Grant, error) {
 	d := q.Where(&Grant{AccessTokenID: tok.ID}).
 		Preload("AccessToken").Preload("RefreshToken").First(g)
 	if d.Error != nil {
-		return nil, d.Error
+		return nil, storeError(d.Error)
 	}
 	return g, nil
 }
 
-func (q *query) SaveModel(model interface{}) error {
-	return q.Save(model).Error
+// GrantByToken returns the grant that owns the access or refresh token code. The
+// token type named by hint is looked up first, the type of the matching token is
+// returned along with the grant.
+func (q *GormStore) GrantByToken(code, hint string) (*Grant, string, error) {
+	lookup := []string{tokenTypeHint.AccessToken, tokenTypeHint.RefreshToken}
+	if hint == tokenTypeHint.RefreshToken {
+		lookup[0], lookup[1] = lookup[1], lookup[0]
+	}
+	var err error
+	for _, typ := range lookup {
+		var g *Grant
+		if typ == tokenTypeHint.RefreshToken {
+			g, err = q.GrantByRefreshToken(code)
+		} else {
+			g, err = q.GrantByBearer(code)
+		}
+		if err == nil {
+			return g, typ, nil
+		}
+	}
+	return nil, "", err
+}
+
+// RevokeGrant deletes the grant together with its access and refresh tokens.
+func (q *GormStore) RevokeGrant(g *Grant) error {
+	for _, id := range []int64{g.AccessTokenID, g.RefreshTokenID} {
+
+		// gorm deletes all records when the primary key is blank.
+		if id == 0 {
+			continue
+		}
+		if err := q.Delete(&Token{ID: id}).Error; err != nil {
+			return err
+		}
+	}
+	if g.ID == 0 {
+		return nil
+	}
+	return q.Delete(g).Error
+}
+
+// errBlankID is returned when deleting a model that was never saved, gorm deletes
+// all records when the primary key is blank.
+var errBlankID = errors.New("hero: can not delete a model without id")
+
+// SaveUser creates or updates usr.
+func (q *GormStore) SaveUser(usr *User) error {
+	return q.Save(usr).Error
+}
+
+// SaveConsent creates or updates the consent c.
+func (q *GormStore) SaveConsent(c *Consent) error {
+	return q.Save(c).Error
+}
+
+// SaveClient creates or updates client.
+func (q *GormStore) SaveClient(client *Client) error {
+	return q.Save(client).Error
+}
+
+// SaveGrant creates or updates the grant g.
+func (q *GormStore) SaveGrant(g *Grant) error {
+	return q.Save(g).Error
+}
+
+// DeleteGrant deletes the grant g, its tokens are left alone. Use RevokeGrant to
+// delete them too.
+func (q *GormStore) DeleteGrant(g *Grant) error {
+	if g.ID == 0 {
+		return errBlankID
+	}
+	return q.Delete(g).Error
+}
+
+// SaveToken creates or updates the token tok.
+func (q *GormStore) SaveToken(tok *Token) error {
+	return q.Save(tok).Error
+}
+
+// SaveDevice creates or updates the device authorization request d.
+func (q *GormStore) SaveDevice(d *DeviceAuthorization) error {
+	return q.Save(d).Error
+}
+
+// PollDevice records the last poll and the interval of the device authorization
+// request d, its other columns are left alone so a poll does not undo a decision
+// made meanwhile. The columns are updated without touching UpdatedAt, it is the
+// time the user decided.
+func (q *GormStore) PollDevice(d *DeviceAuthorization) error {
+	if d.ID == 0 {
+		return errBlankID
+	}
+	return q.Model(d).UpdateColumns(map[string]interface{}{
+		"last_poll": d.LastPoll,
+		"interval":  d.Interval,
+	}).Error
+}
+
+// DecideDevice records the decision of the user about the device authorization
+// request d. Only undecided requests are updated, ErrNotFound is returned when d
+// was decided or claimed meanwhile.
+func (q *GormStore) DecideDevice(d *DeviceAuthorization) error {
+	db := q.Model(&DeviceAuthorization{}).
+		Where("id = ? AND approved = ? AND denied = ?", d.ID, false, false).
+		Updates(map[string]interface{}{
+			"user_id":  d.UserID,
+			"approved": d.Approved,
+			"denied":   d.Denied,
+		})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ClaimDevice deletes the device authorization request whose id is id,
+// ErrRequestClaimed is returned when it is already gone. It is a single delete so
+// only one of concurrent polls with the same device code succeeds.
+func (q *GormStore) ClaimDevice(id int64) error {
+	d := q.Where("id = ?", id).Delete(&DeviceAuthorization{})
+	if d.Error != nil {
+		return d.Error
+	}
+	if d.RowsAffected == 0 {
+		return ErrRequestClaimed
+	}
+	return nil
+}
+
+// SavePushedRequest creates or updates the pushed authorization request p.
+func (q *GormStore) SavePushedRequest(p *PushedRequest) error {
+	return q.Save(p).Error
+}
+
+// DeletePushedRequest deletes the pushed authorization request p.
+func (q *GormStore) DeletePushedRequest(p *PushedRequest) error {
+	if p.ID == 0 {
+		return errBlankID
+	}
+	return q.Delete(p).Error
+}
+
+// SaveBackchannelRequest creates or updates the backchannel authentication
+// request b.
+func (q *GormStore) SaveBackchannelRequest(b *BackchannelRequest) error {
+	return q.Save(b).Error
+}
+
+// PollBackchannelRequest records the last poll and the interval of the
+// backchannel authentication request b, like PollDevice the other columns are
+// left alone.
+func (q *GormStore) PollBackchannelRequest(b *BackchannelRequest) error {
+	if b.ID == 0 {
+		return errBlankID
+	}
+	return q.Model(b).UpdateColumns(map[string]interface{}{
+		"last_poll": b.LastPoll,
+		"interval":  b.Interval,
+	}).Error
+}
+
+// DecideBackchannelRequest records the decision of the user about the backchannel
+// authentication request b. Only undecided requests are updated,
+// ErrNotFound is returned when b was decided or claimed meanwhile.
+func (q *GormStore) DecideBackchannelRequest(b *BackchannelRequest) error {
+	db := q.Model(&BackchannelRequest{}).
+		Where("id = ? AND approved = ? AND denied = ?", b.ID, false, false).
+		Updates(map[string]interface{}{
+			"approved": b.Approved,
+			"denied":   b.Denied,
+		})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteBackchannelRequest deletes the backchannel authentication request b.
+func (q *GormStore) DeleteBackchannelRequest(b *BackchannelRequest) error {
+	if b.ID == 0 {
+		return errBlankID
+	}
+	return q.Delete(b).Error
 }
 
-func (q *query) UpdateModel(model interface{}) error {
-	return q.Update(model).Error
+// SaveScope creates or updates the scope sc.
+func (q *GormStore) SaveScope(sc *Scope) error {
+	return q.Save(sc).Error
 }
 
-func (q *query) DeleteModel(model interface{}) error {
-	return q.Delete(model).Error
+// SaveResource creates or updates the resource res.
+func (q *GormStore) SaveResource(res *Resource) error {
+	return q.Save(res).Error
 }
 
-func (q *query) GetSessionByKey(key string) (*Session, error) {
+// SaveAuthorizationDetailType creates or updates the authorization details type t.
+func (q *GormStore) SaveAuthorizationDetailType(t *AuthorizationDetailType) error {
+	return q.Save(t).Error
+}
+
+func (q *GormStore) GetSessionByKey(key string) (*Session, error) {
 	ss := &Session{}
 	d := q.Where(&Session{Key: key}).First(ss)
 	if d.Error != nil {
-		return nil, d.Error
+		return nil, storeError(d.Error)
 	}
 	return ss, nil
 }
 
-func (q *query) UpdateSession(sess *Session) error {
+func (q *GormStore) UpdateSession(sess *Session) error {
 	ss, err := q.GetSessionByKey(sess.Key)
 	if err != nil {
 		return err
@@ -101,7 +346,7 @@ func (q *query) UpdateSession(sess *Session) error {
 	return q.Save(ss).Error
 }
 
-func (q *query) DeleteSession(key string) error {
+func (q *GormStore) DeleteSession(key string) error {
 	ss, err := q.GetSessionByKey(key)
 	if err != nil {
 		return err
@@ -109,46 +354,295 @@ func (q *query) DeleteSession(key string) error {
 	return q.Delete(ss).Error
 }
 
-func (q *query) SaveSession(ss *Session) error {
+func (q *GormStore) SaveSession(ss *Session) error {
 	return q.Save(ss).Error
 }
 
-func (q *query) UserByID(id int64) (*User, error) {
+func (q *GormStore) UserByID(id int64) (*User, error) {
 	usr := &User{}
 	d := q.Where(&User{ID: id}).First(usr)
 	if d.Error != nil {
-		return nil, d.Error
+		return nil, storeError(d.Error)
 	}
 	return usr, nil
 }
 
-func (q *query) UserByUserName(username string) (*User, error) {
+func (q *GormStore) ProfileByID(id int64) (*Profile, error) {
+	p := &Profile{}
+	d := q.Where(&Profile{ID: id}).First(p)
+	if d.Error != nil {
+		return nil, storeError(d.Error)
+	}
+	return p, nil
+}
+
+func (q *GormStore) UserByUserName(username string) (*User, error) {
 	usr := &User{}
 	d := q.Where(&User{UserName: username}).First(usr)
 	if d.Error != nil {
-		return nil, d.Error
+		return nil, storeError(d.Error)
 	}
 	return usr, nil
 }
 
-func (q *query) UserByEmail(email string) (*User, error) {
+func (q *GormStore) UserByEmail(email string) (*User, error) {
 	usr := &User{}
 	d := q.Where(&User{Email: email}).First(usr)
 	if d.Error != nil {
-		return nil, d.Error
+		return nil, storeError(d.Error)
 	}
 	return usr, nil
 }
 
-func (q *query) CreateUser(usr *User) error {
+func (q *GormStore) CreateUser(usr *User) error {
 	return q.Save(usr).Error
 }
 
-func (q *query) TokenByCode(code string) (*Token, error) {
+func (q *GormStore) TokenByCode(code string) (*Token, error) {
 	tok := &Token{}
 	d := q.Where(&Token{Code: code}).First(tok)
 	if d.Error != nil {
-		return nil, d.Error
+		return nil, storeError(d.Error)
 	}
 	return tok, nil
 }
+
+// UseToken marks the refresh token whose id is id as used, ErrTokenUsed is returned
+// when it was used before. It is a single conditional update so only one of
+// concurrent refreshes with the same token succeeds.
+func (q *GormStore) UseToken(id int64) error {
+	d := q.Model(&Token{}).Where("id = ? AND used = ?", id, false).Update("used", true)
+	if d.Error != nil {
+		return d.Error
+	}
+	if d.RowsAffected == 0 {
+		return ErrTokenUsed
+	}
+	return nil
+}
+
+// RevokeFamily deletes all the grants in the refresh token family, together with
+// their access and refresh tokens.
+func (q *GormStore) RevokeFamily(family string) error {
+	if family == "" {
+
+		// gorm ignores blank fields in the condition, this would match all grants.
+		return errors.New("hero: empty token family")
+	}
+	var grants []Grant
+	d := q.Where(&Grant{Family: family}).Find(&grants)
+	if d.Error != nil {
+		return d.Error
+	}
+	for i := range grants {
+		if err := q.RevokeGrant(&grants[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConsentByClient returns the consent given by the user to the client.
+func (q *GormStore) ConsentByClient(userID, clientID int64) (*Consent, error) {
+	c := &Consent{}
+	if userID == 0 || clientID == 0 {
+		return nil, ErrNotFound
+	}
+	d := q.Where(&Consent{UserID: userID, ClientID: clientID}).First(c)
+	if d.Error != nil {
+		return nil, storeError(d.Error)
+	}
+	return c, nil
+}
+
+// Scopes returns all the registered scopes.
+func (q *GormStore) Scopes() ([]Scope, error) {
+	var scopes []Scope
+	d := q.Order("name").Find(&scopes)
+	if d.Error != nil {
+		return nil, storeError(d.Error)
+	}
+	return scopes, nil
+}
+
+// ScopeByName returns the registered scope called name.
+func (q *GormStore) ScopeByName(name string) (*Scope, error) {
+	sc := &Scope{}
+	if name == "" {
+		return nil, ErrNotFound
+	}
+	d := q.Where(&Scope{Name: name}).First(sc)
+	if d.Error != nil {
+		return nil, storeError(d.Error)
+	}
+	return sc, nil
+}
+
+// DeviceByCode returns the device authorization with the device code.
+func (q *GormStore) DeviceByCode(code string) (*DeviceAuthorization, error) {
+	d := &DeviceAuthorization{}
+	if code == "" {
+		return nil, ErrNotFound
+	}
+	db := q.Where(&DeviceAuthorization{DeviceCode: code}).First(d)
+	if db.Error != nil {
+		return nil, storeError(db.Error)
+	}
+	return d, nil
+}
+
+// DeviceByUserCode returns the device authorization with the user code.
+func (q *GormStore) DeviceByUserCode(code string) (*DeviceAuthorization, error) {
+	d := &DeviceAuthorization{}
+	if code == "" {
+		return nil, ErrNotFound
+	}
+	db := q.Where(&DeviceAuthorization{UserCode: code}).First(d)
+	if db.Error != nil {
+		return nil, storeError(db.Error)
+	}
+	return d, nil
+}
+
+// UseJTI records that the client presented the JWT with the id jti which expires at
+// the unix time exp, ErrReplayedJWT is returned when it was presented before.
+// Records of expired JWTs are removed.
+func (q *GormStore) UseJTI(clientID int64, jti string, exp int64) error {
+	if jti == "" {
+		return ErrReplayedJWT
+	}
+	if err := q.Where("expires_at < ?", time.Now().Unix()).Delete(&Assertion{}).Error; err != nil {
+		return err
+	}
+	err := q.Create(&Assertion{ClientID: clientID, JTI: jti, ExpiresAt: exp}).Error
+	if err == nil {
+		return nil
+	}
+
+	// the unique index refused the insert when the JWT was recorded before, the
+	// dialects report it differently so the record is looked up instead.
+	if q.Where(&Assertion{ClientID: clientID, JTI: jti}).First(&Assertion{}).Error == nil {
+		return ErrReplayedJWT
+	}
+	return err
+}
+
+// DeleteClient deletes client together with its grants, tokens and the consents
+// users gave it.
+func (q *GormStore) DeleteClient(client *Client) error {
+	if client.ID == 0 {
+		return errors.New("invalid client")
+	}
+	tx := q.Begin()
+	for _, m := range []interface{}{&Grant{}, &Token{}, &Consent{}, &PushedRequest{}, &BackchannelRequest{}} {
+		if err := tx.Where("client_id = ?", client.ID).Delete(m).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Delete(client).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// ClientsByUser returns the clients of the user whose id is userID.
+func (q *GormStore) ClientsByUser(userID int64) ([]Client, error) {
+	var clients []Client
+	if userID == 0 {
+		return nil, errors.New("invalid user")
+	}
+	err := q.Where(&Client{UserID: userID}).Order("id").Find(&clients).Error
+	return clients, err
+}
+
+// PushedRequestByURI returns the pushed authorization request with the request_uri.
+func (q *GormStore) PushedRequestByURI(uri string) (*PushedRequest, error) {
+	p := &PushedRequest{}
+	if uri == "" {
+		return nil, ErrNotFound
+	}
+	db := q.Where(&PushedRequest{RequestURI: uri}).First(p)
+	if db.Error != nil {
+		return nil, storeError(db.Error)
+	}
+	return p, nil
+}
+
+// ResourceByIdentifier returns the registered resource with the identifier.
+func (q *GormStore) ResourceByIdentifier(identifier string) (*Resource, error) {
+	res := &Resource{}
+	if identifier == "" {
+		return nil, ErrNotFound
+	}
+	db := q.Where(&Resource{Identifier: identifier}).First(res)
+	if db.Error != nil {
+		return nil, storeError(db.Error)
+	}
+	return res, nil
+}
+
+// AuthorizationDetailTypes returns all the registered authorization details types.
+func (q *GormStore) AuthorizationDetailTypes() ([]AuthorizationDetailType, error) {
+	var types []AuthorizationDetailType
+	d := q.Order("type").Find(&types)
+	if d.Error != nil {
+		return nil, storeError(d.Error)
+	}
+	return types, nil
+}
+
+// BackchannelRequestByID returns the backchannel authentication request with the
+// auth_req_id.
+func (q *GormStore) BackchannelRequestByID(id string) (*BackchannelRequest, error) {
+	b := &BackchannelRequest{}
+	if id == "" {
+		return nil, ErrNotFound
+	}
+	db := q.Where(&BackchannelRequest{AuthReqID: id}).First(b)
+	if db.Error != nil {
+		return nil, storeError(db.Error)
+	}
+	return b, nil
+}
+
+// BackchannelRequestByUser returns the backchannel authentication request made for
+// the user whose id is userID.
+func (q *GormStore) BackchannelRequestByUser(userID, id int64) (*BackchannelRequest, error) {
+	b := &BackchannelRequest{}
+	if userID == 0 || id == 0 {
+		return nil, ErrNotFound
+	}
+	db := q.Where(&BackchannelRequest{ID: id, UserID: userID}).First(b)
+	if db.Error != nil {
+		return nil, storeError(db.Error)
+	}
+	return b, nil
+}
+
+// BackchannelRequestsByUser returns the backchannel authentication requests made
+// for the user whose id is userID.
+func (q *GormStore) BackchannelRequestsByUser(userID int64) ([]BackchannelRequest, error) {
+	var reqs []BackchannelRequest
+	if userID == 0 {
+		return nil, errors.New("invalid user")
+	}
+	err := q.Where(&BackchannelRequest{UserID: userID}).Order("id").Find(&reqs).Error
+	return reqs, err
+}
+
+// ClaimBackchannelRequest deletes the backchannel authentication request whose id
+// is id, ErrRequestClaimed is returned when it is already gone. It is a single
+// delete so only one of concurrent token requests with the same auth_req_id
+// succeeds.
+func (q *GormStore) ClaimBackchannelRequest(id int64) error {
+	d := q.Where("id = ?", id).Delete(&BackchannelRequest{})
+	if d.Error != nil {
+		return d.Error
+	}
+	if d.RowsAffected == 0 {
+		return ErrRequestClaimed
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package hero
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errInvalidAuthorizationDetails = errors.New("hero: invalid authorization_details")
+
+// detailsJSON is JSON encoded authorization details. It is embedded as is in JSON
+// responses and tokens, and sent as a string in redirects.
+type detailsJSON string
+
+// MarshalJSON implements json.Marshaler.
+func (d detailsJSON) MarshalJSON() ([]byte, error) {
+	return []byte(d), nil
+}
+
+func (d detailsJSON) String() string {
+	return string(d)
+}
+
+// authorizationDetails validates the authorization_details parameter value of RFC
+// 9396 section 2, a JSON array of objects whose type is registered. The details
+// are returned compactly encoded, the result is empty when value is.
+//
+// errInvalidAuthorizationDetails is returned when value is malformed or uses types
+// or fields that are not registered.
+func (s *Server) authorizationDetails(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	var details []map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &details); err != nil || len(details) == 0 {
+		return "", errInvalidAuthorizationDetails
+	}
+	types, err := s.q.AuthorizationDetailTypes()
+	if err != nil {
+		return "", err
+	}
+	reg := make(map[string]AuthorizationDetailType)
+	for _, t := range types {
+		reg[t.Type] = t
+	}
+	for _, d := range details {
+		typ, ok := d["type"].(string)
+		if !ok {
+			return "", errInvalidAuthorizationDetails
+		}
+		t, ok := reg[typ]
+		if !ok {
+			return "", errInvalidAuthorizationDetails
+		}
+		for k, v := range d {
+			if !validDetailField(t, k, v) {
+				return "", errInvalidAuthorizationDetails
+			}
+		}
+	}
+	b, err := json.Marshal(details)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// validDetailField returns true if the field k with the value v can be part of the
+// authorization details of type t. The common fields of RFC 9396 section 2.2 are
+// accepted for every type, identifier is a string and the others string arrays.
+func validDetailField(t AuthorizationDetailType, k string, v interface{}) bool {
+	switch k {
+	case "type":
+		return true
+	case "identifier":
+		_, ok := v.(string)
+		return ok
+	case "locations", "actions", "datatypes", "privileges":
+		a, ok := v.([]interface{})
+		if !ok {
+			return false
+		}
+		_, ok = stringValues(a)
+		return ok || len(a) == 0
+	}
+	return t.Fields == "" || hasScope(t.Fields, k)
+}
+
+// narrowDetails returns the authorization details of a token issued from a grant for
+// granted, value can only pick some of the granted details. granted is returned
+// when value is empty.
+func (s *Server) narrowDetails(granted, value string) (string, error) {
+	requested, err := s.authorizationDetails(value)
+	if err != nil || requested == "" {
+		return granted, err
+	}
+	var have, want []json.RawMessage
+	if granted != "" {
+		if err = json.Unmarshal([]byte(granted), &have); err != nil {
+			return "", err
+		}
+	}
+	if err = json.Unmarshal([]byte(requested), &want); err != nil {
+		return "", err
+	}
+
+	// details are compared in the canonical encoding of authorizationDetails, where
+	// object keys are sorted.
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if string(w) == string(h) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", errInvalidAuthorizationDetails
+		}
+	}
+	return requested, nil
+}
+
+// detailsError returns the error code for err returned while validating
+// authorization details.
+func detailsError(err error) string {
+	if err == errInvalidAuthorizationDetails {
+		return errorsKeys.InvalidAuthDetails
+	}
+	return errorsKeys.ServerError
+}
+
+// authorizationDetail is an authorization detail as shown on the consent screen.
+type authorizationDetail struct {
+	Type        string
+	Description string
+
+	// Fields are the other fields of the detail, arrays are comma separated.
+	Fields map[string]string
+}
+
+// describeDetails returns the JSON encoded authorization details for display, with
+// the description of their registered type.
+func (s *Server) describeDetails(details string) []authorizationDetail {
+	if details == "" {
+		return nil
+	}
+	var list []map[string]interface{}
+	if err := json.Unmarshal([]byte(details), &list); err != nil {
+		s.log.Println(err)
+		return nil
+	}
+	types, err := s.q.AuthorizationDetailTypes()
+	if err != nil {
+		s.log.Println(err)
+	}
+	var out []authorizationDetail
+	for _, d := range list {
+		typ, _ := d["type"].(string)
+		v := authorizationDetail{Type: typ, Fields: make(map[string]string)}
+		for _, t := range types {
+			if t.Type == typ {
+				v.Description = t.Description
+			}
+		}
+		for k, f := range d {
+			if k == "type" {
+				continue
+			}
+			v.Fields[k] = detailValue(f)
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// detailValue returns the authorization detail field value v as text.
+func detailValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []interface{}:
+		if strs, ok := stringValues(x); ok {
+			return strings.Join(strs, ", ")
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,512 @@
+package hero
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// grantTypeImplicit is the name of the implicit grant in client metadata.
+const grantTypeImplicit = "implicit"
+
+var (
+	errInvalidRedirectURI    = errors.New("hero: invalid redirect uri")
+	errInvalidClientMetadata = errors.New("hero: invalid client metadata")
+)
+
+// clientMetadata is the client metadata clients register with, as described in
+// RFC 7591 section 2, RFC 8705 section 2.1.2 and CIBA section 4.
+type clientMetadata struct {
+	RedirectURIs            []string        `json:"redirect_uris,omitempty"`
+	GrantTypes              []string        `json:"grant_types,omitempty"`
+	ResponseTypes           []string        `json:"response_types,omitempty"`
+	TokenEndpointAuthMethod string          `json:"token_endpoint_auth_method,omitempty"`
+	ClientName              string          `json:"client_name,omitempty"`
+	LogoURI                 string          `json:"logo_uri,omitempty"`
+	Scope                   string          `json:"scope,omitempty"`
+	JWKS                    json.RawMessage `json:"jwks,omitempty"`
+	TLSClientAuthSubjectDN  string          `json:"tls_client_auth_subject_dn,omitempty"`
+	TLSClientAuthSANDNS     string          `json:"tls_client_auth_san_dns,omitempty"`
+	TLSClientAuthSANURI     string          `json:"tls_client_auth_san_uri,omitempty"`
+	TLSClientAuthSANIP      string          `json:"tls_client_auth_san_ip,omitempty"`
+	TLSClientAuthSANEmail   string          `json:"tls_client_auth_san_email,omitempty"`
+	RequirePAR              bool            `json:"require_pushed_authorization_requests,omitempty"`
+	RequestURIs             []string        `json:"request_uris,omitempty"`
+	BackchannelMode         string          `json:"backchannel_token_delivery_mode,omitempty"`
+	BackchannelNotifyURI    string          `json:"backchannel_client_notification_endpoint,omitempty"`
+}
+
+// applyMetadata validates md and sets it on client. Omitted grant types, response
+// types and authentication method take the defaults of RFC 7591 section 2.
+func (s *Server) applyMetadata(client *Client, md *clientMetadata) error {
+	if len(md.GrantTypes) == 0 {
+		md.GrantTypes = []string{grantType.AuthorizationCode}
+	}
+	if len(md.ResponseTypes) == 0 {
+		md.ResponseTypes = []string{requestType.Code}
+	}
+	if md.TokenEndpointAuthMethod == "" {
+		md.TokenEndpointAuthMethod = authMethod.SecretBasic
+	}
+
+	// registered clients are not trusted, they only get the grants that need the
+	// user to authorize them in the browser unless configured otherwise.
+	for _, g := range md.GrantTypes {
+		if !hasScope(strings.Join(s.cfg.RegistrationGrants, " "), g) {
+			return errInvalidClientMetadata
+		}
+	}
+	if err := s.validGrantTypes(md.GrantTypes, md.ResponseTypes); err != nil {
+		return err
+	}
+	if err := s.validRedirectURIs(md.RedirectURIs, md.GrantTypes); err != nil {
+		return err
+	}
+	if md.LogoURI != "" {
+		if u, err := url.Parse(md.LogoURI); err != nil || !u.IsAbs() {
+			return errInvalidClientMetadata
+		}
+	}
+	for _, v := range md.RequestURIs {
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme != "https" || u.Host == "" || u.Fragment != "" || strings.ContainsAny(v, " ") {
+			return errInvalidClientMetadata
+		}
+	}
+	switch md.BackchannelMode {
+	case "", backchannelMode.Poll:
+		md.BackchannelNotifyURI = ""
+	case backchannelMode.Ping:
+		// notifications carry a bearer token so they are only sent over https.
+		u, err := url.Parse(md.BackchannelNotifyURI)
+		if err != nil || u.Scheme != "https" || u.Host == "" || u.Fragment != "" {
+			return errInvalidClientMetadata
+		}
+	default:
+		return errInvalidClientMetadata
+	}
+
+	scope, err := s.validClientScope(client, md.Scope)
+	if err != nil {
+		return err
+	}
+
+	var jwks string
+	if len(md.JWKS) != 0 {
+		keys, err := parseJWKS(string(md.JWKS))
+		if err != nil || len(keys) == 0 {
+			return errInvalidClientMetadata
+		}
+		jwks = string(md.JWKS)
+	}
+
+	client.TLSClientAuthSubjectDN = ""
+	client.TLSClientAuthSAN = ""
+	client.TLSClientAuthThumbprint = ""
+	switch md.TokenEndpointAuthMethod {
+	case authMethod.SecretBasic, authMethod.SecretPost, authMethod.SecretJWT, authMethod.None:
+	case authMethod.PrivateKeyJWT:
+		if jwks == "" {
+			return errInvalidClientMetadata
+		}
+	case authMethod.TLSClientAuth:
+		client.TLSClientAuthSubjectDN = md.TLSClientAuthSubjectDN
+		for _, san := range []string{md.TLSClientAuthSANDNS, md.TLSClientAuthSANURI, md.TLSClientAuthSANIP, md.TLSClientAuthSANEmail} {
+			if san != "" {
+				client.TLSClientAuthSAN = san
+				break
+			}
+		}
+		if client.TLSClientAuthSubjectDN == "" && client.TLSClientAuthSAN == "" {
+			return errInvalidClientMetadata
+		}
+	case authMethod.SelfSignedTLSClientAuth:
+		thumbprint, err := x5cThumbprint(jwks)
+		if err != nil {
+			return errInvalidClientMetadata
+		}
+		client.TLSClientAuthThumbprint = thumbprint
+	default:
+		return errInvalidClientMetadata
+	}
+
+	client.Name = md.ClientName
+	client.LogoURI = md.LogoURI
+	client.RedirectURL = strings.Join(md.RedirectURIs, s.cfg.RedirSeparator)
+	client.GrantTypes = strings.Join(md.GrantTypes, " ")
+	client.ResponseTypes = strings.Join(md.ResponseTypes, " ")
+	client.TokenEndpointAuthMethod = md.TokenEndpointAuthMethod
+	client.Public = md.TokenEndpointAuthMethod == authMethod.None
+	client.Scope = scope
+	client.JWKS = jwks
+	client.RequirePAR = md.RequirePAR
+	client.RequestURIs = strings.Join(md.RequestURIs, " ")
+	client.BackchannelMode = md.BackchannelMode
+	client.BackchannelNotifyURI = md.BackchannelNotifyURI
+	return nil
+}
+
+// validGrantTypes returns errInvalidClientMetadata if a client may not use the
+// grant types and response types together.
+func (s *Server) validGrantTypes(grants, responseTypes []string) error {
+	list := strings.Join(grants, " ")
+	for _, g := range grants {
+		if g != grantTypeImplicit && !s.cfg.AccessAllowed(g) {
+			return errInvalidClientMetadata
+		}
+	}
+	for _, typ := range responseTypes {
+		switch typ {
+		case requestType.Code:
+			if !hasScope(list, grantType.AuthorizationCode) {
+				return errInvalidClientMetadata
+			}
+		case requestType.Token:
+			if !hasScope(list, grantTypeImplicit) {
+				return errInvalidClientMetadata
+			}
+		default:
+			return errInvalidClientMetadata
+		}
+	}
+	return nil
+}
+
+// validRedirectURIs returns errInvalidRedirectURI if uris can not be the redirect
+// uris of a client using grants, clients using a redirect based grant must have at
+// least one.
+func (s *Server) validRedirectURIs(uris, grants []string) error {
+	list := strings.Join(grants, " ")
+	redirect := hasScope(list, grantType.AuthorizationCode) || hasScope(list, grantTypeImplicit)
+
+	// without a separator only one redirect uri can be stored.
+	sep := s.cfg.RedirSeparator
+	if (redirect && len(uris) == 0) || (sep == "" && len(uris) > 1) {
+		return errInvalidRedirectURI
+	}
+	for _, v := range uris {
+		u, err := url.Parse(v)
+		if err != nil || !validRedirectURI(u) || u.Fragment != "" || (sep != "" && strings.Contains(v, sep)) {
+			return errInvalidRedirectURI
+		}
+	}
+	return nil
+}
+
+// validRedirectURI returns true if codes and tokens can be sent to u. Those are
+// https uris, http uris of the loopback interface and the private-use uri schemes
+// of native apps, which contain a period as described in RFC 8252 section 7.1.
+func validRedirectURI(u *url.URL) bool {
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		switch u.Hostname() {
+		case "127.0.0.1", "::1", "localhost":
+			return true
+		}
+		return false
+	}
+	return strings.Contains(u.Scheme, ".")
+}
+
+// validClientScope returns the normalized scope a client may be allowed. Restricted
+// scopes are only given to clients by the administrators, so only the ones client
+// already has are kept.
+func (s *Server) validClientScope(client *Client, scope string) (string, error) {
+	var added []string
+	for _, name := range parseScope(scope) {
+		if !hasScope(client.Scope, name) {
+			added = append(added, name)
+		}
+	}
+	if _, err := s.validScope(&Client{}, strings.Join(added, " ")); len(added) != 0 && err != nil {
+		return "", errInvalidClientMetadata
+	}
+	return strings.Join(parseScope(scope), " "), nil
+}
+
+// x5cThumbprint returns the thumbprint of the first certificate in the x5c member
+// of the keys in jwks, it identifies the self signed certificate of a client.
+func x5cThumbprint(jwks string) (string, error) {
+	if jwks == "" {
+		return "", errInvalidClientMetadata
+	}
+	var set struct {
+		Keys []struct {
+			X5c []string `json:"x5c"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal([]byte(jwks), &set); err != nil {
+		return "", err
+	}
+	for _, k := range set.Keys {
+		if len(k.X5c) == 0 {
+			continue
+		}
+		der, err := base64.StdEncoding.DecodeString(k.X5c[0])
+		if err != nil {
+			return "", err
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return "", err
+		}
+		return certThumbprint(cert), nil
+	}
+	return "", errInvalidClientMetadata
+}
+
+// clientMetadataOf returns the registered metadata of client.
+func (s *Server) clientMetadataOf(client *Client) map[string]interface{} {
+	md := map[string]interface{}{
+		params.clientID:              client.UUID,
+		"client_id_issued_at":        client.CreatedAt.Unix(),
+		"client_name":                client.Name,
+		"grant_types":                strings.Fields(client.GrantTypes),
+		"response_types":             strings.Fields(client.ResponseTypes),
+		"token_endpoint_auth_method": client.TokenEndpointAuthMethod,
+	}
+	if client.RegistrationToken != "" {
+		md["registration_client_uri"] = s.cfg.EndpointURL(s.cfg.RegisterEndpoint + "/" + client.UUID)
+	}
+	if client.RedirectURL != "" {
+		md["redirect_uris"] = splitURIs(client.RedirectURL, s.cfg.RedirSeparator)
+	}
+	if client.LogoURI != "" {
+		md["logo_uri"] = client.LogoURI
+	}
+	if client.Scope != "" {
+		md[params.scope] = client.Scope
+	}
+	if client.JWKS != "" {
+		md["jwks"] = json.RawMessage(client.JWKS)
+	}
+	if client.TLSClientAuthSubjectDN != "" {
+		md["tls_client_auth_subject_dn"] = client.TLSClientAuthSubjectDN
+	}
+	if client.RequestURIs != "" {
+		md["request_uris"] = strings.Fields(client.RequestURIs)
+	}
+	if client.RequirePAR {
+		md["require_pushed_authorization_requests"] = true
+	}
+	if client.BackchannelMode != "" {
+		md["backchannel_token_delivery_mode"] = client.BackchannelMode
+	}
+	if client.BackchannelNotifyURI != "" {
+		md["backchannel_client_notification_endpoint"] = client.BackchannelNotifyURI
+	}
+	return md
+}
+
+// newClientSecret returns a random secret for a newly registered client.
+func newClientSecret() (string, error) {
+	b, err := generateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// registrationError sets the error of the failed registration to ctx.
+func registrationError(ctx *context, err error) {
+	ctx.StatusCode = http.StatusBadRequest
+	switch err {
+	case errInvalidRedirectURI:
+		ctx.SetError(errorsKeys.InvalidRedirectURI, "")
+	case errInvalidClientMetadata:
+		ctx.SetError(errorsKeys.InvalidClientMetadata, "")
+	default:
+		ctx.StatusCode = http.StatusInternalServerError
+		ctx.SetError(errorsKeys.ServerError, "")
+	}
+	ctx.InternalError = err
+}
+
+// registrationAllowed returns true if r may register a client. Unless
+// Config.OpenRegistration is set the client presents Config.RegistrationToken as
+// its initial access token, as described in RFC 7591 section 3.
+func (s *Server) registrationAllowed(r *http.Request) bool {
+	if s.cfg.OpenRegistration {
+		return true
+	}
+	bearer := checkBearerAuth(r)
+	return bearer != nil && s.cfg.RegistrationToken != "" &&
+		subtle.ConstantTimeCompare([]byte(bearer.Code), []byte(s.cfg.RegistrationToken)) == 1
+}
+
+// RegisterClient provide oauth 2.0 dynamic client registration as described in RFC
+// 7591.
+//
+// The client POSTs its metadata as JSON and gets back its client_id, the client
+// secret for confidential clients, and a registration access token it manages its
+// registration with at the registration client uri. The secret and the token are
+// only stored hashed, they can not be read again.
+//
+// Registration is closed unless Config.OpenRegistration is set or the client
+// presents Config.RegistrationToken, and clients only get the grant types in
+// Config.RegistrationGrants.
+func (s *Server) RegisterClient(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(w)
+	if r.Method != "POST" {
+		ctx.StatusCode = http.StatusMethodNotAllowed
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+	if !s.registrationAllowed(r) {
+		ctx.Headers.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errorsKeys.InvalidToken, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+	md := &clientMetadata{}
+	if err := json.NewDecoder(r.Body).Decode(md); err != nil {
+		registrationError(ctx, errInvalidClientMetadata)
+		_ = ctx.CommitJSON()
+		return
+	}
+	client := &Client{UUID: s.gen.Generate()}
+	if err := s.applyMetadata(client, md); err != nil {
+		registrationError(ctx, err)
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	var secret string
+	if !client.Public {
+		var err error
+		if secret, err = newClientSecret(); err != nil {
+			registrationError(ctx, err)
+			_ = ctx.CommitJSON()
+			return
+		}
+		if client.Secret, err = hashString(secret); err != nil {
+			registrationError(ctx, err)
+			_ = ctx.CommitJSON()
+			return
+		}
+
+		// client_secret_jwt signs with the secret so it must be kept as is.
+		if client.TokenEndpointAuthMethod == authMethod.SecretJWT {
+			client.JWTSecret = secret
+		}
+	}
+	token, err := newClientSecret()
+	if err != nil {
+		registrationError(ctx, err)
+		_ = ctx.CommitJSON()
+		return
+	}
+	if client.RegistrationToken, err = hashString(token); err != nil {
+		registrationError(ctx, err)
+		_ = ctx.CommitJSON()
+		return
+	}
+	if err = s.q.SaveClient(client); err != nil {
+		registrationError(ctx, err)
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	ctx.Data = s.clientMetadataOf(client)
+	if secret != "" {
+		ctx.SetData(params.clientSecret, secret)
+		ctx.SetData("client_secret_expires_at", 0)
+	}
+	ctx.SetData("registration_access_token", token)
+	ctx.StatusCode = http.StatusCreated
+	_ = ctx.CommitJSON()
+}
+
+// ClientConfiguration provide oauth 2.0 dynamic client registration management as
+// described in RFC 7592.
+//
+// Clients authenticate with their registration access token, GET reads the
+// registration, PUT replaces the metadata and DELETE removes the client together
+// with the tokens issued to it.
+func (s *Server) ClientConfiguration(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(w)
+	client := s.registeredClient(r)
+	if client == nil {
+		ctx.Headers.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errorsKeys.InvalidToken, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var md struct {
+			clientMetadata
+			ClientID string `json:"client_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&md); err != nil || md.ClientID != client.UUID {
+			registrationError(ctx, errInvalidClientMetadata)
+			_ = ctx.CommitJSON()
+			return
+		}
+		public := client.Public
+		if err := s.applyMetadata(client, &md.clientMetadata); err != nil {
+			registrationError(ctx, err)
+			_ = ctx.CommitJSON()
+			return
+		}
+
+		// the secret can not be issued again, so a client keeps being public
+		// or confidential for the life of its registration.
+		if client.Public != public {
+			registrationError(ctx, errInvalidClientMetadata)
+			_ = ctx.CommitJSON()
+			return
+		}
+		if err := s.q.SaveClient(client); err != nil {
+			registrationError(ctx, err)
+			_ = ctx.CommitJSON()
+			return
+		}
+	case "DELETE":
+		if err := s.q.DeleteClient(client); err != nil {
+			registrationError(ctx, err)
+			_ = ctx.CommitJSON()
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		ctx.StatusCode = http.StatusMethodNotAllowed
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+	ctx.Data = s.clientMetadataOf(client)
+	_ = ctx.CommitJSON()
+}
+
+// registeredClient returns the client whose registration is managed with r, nil is
+// returned when r does not carry the client's registration access token.
+func (s *Server) registeredClient(r *http.Request) *Client {
+	bearer := checkBearerAuth(r)
+	if bearer == nil || bearer.Code == "" || bearer.DPoP {
+		return nil
+	}
+	client, err := s.q.ClientByCode(mux.Vars(r)[params.clientID])
+	if err != nil || client.RegistrationToken == "" {
+		return nil
+	}
+	if compareHashedString(client.RegistrationToken, bearer.Code) != nil {
+		return nil
+	}
+	return client
+}
@@ -0,0 +1,36 @@
+package hero
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestValidRedirectURI(t *testing.T) {
+	sample := []struct {
+		uri   string
+		valid bool
+	}{
+		{"https://client.example.com/cb", true},
+		{"http://127.0.0.1:8080/cb", true},
+		{"http://[::1]:8080/cb", true},
+		{"http://localhost/cb", true},
+		{"com.example.app:/cb", true},
+		{"http://client.example.com/cb", false},
+		{"http://10.0.0.1/cb", false},
+		{"https:///cb", false},
+		{"javascript:alert(1)", false},
+		{"data:text/html,hello", false},
+		{"file:///etc/passwd", false},
+		{"myapp:/cb", false},
+		{"/relative", false},
+	}
+	for _, v := range sample {
+		u, err := url.Parse(v.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid := validRedirectURI(u); valid != v.valid {
+			t.Errorf("%s: expected %v got %v", v.uri, v.valid, valid)
+		}
+	}
+}
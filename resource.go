@@ -0,0 +1,105 @@
+package hero
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+var errInvalidTarget = errors.New("hero: invalid audience or resource")
+
+// resourceAudience returns the space delimited audience of a token requested for
+// the resource indicators in form, as described in RFC 8707 section 2. Resources
+// must be registered and scope, the requested scope, must be allowed by them.
+//
+// errInvalidTarget is returned for unknown resources and errInvalidScope when the
+// resources do not accept scope.
+func (s *Server) resourceAudience(form url.Values, scope string) (string, error) {
+	var (
+		audience []string
+		allowed  string
+		open     bool
+	)
+	for _, v := range form[params.resource] {
+		u, err := url.Parse(v)
+		if err != nil || !u.IsAbs() || u.Fragment != "" || strings.ContainsAny(v, " ") {
+			return "", errInvalidTarget
+		}
+		if hasScope(strings.Join(audience, " "), v) {
+			continue
+		}
+		res, err := s.q.ResourceByIdentifier(v)
+		if err != nil {
+			return "", errInvalidTarget
+		}
+		audience = append(audience, v)
+
+		// resources without scopes accept any.
+		if res.Scope == "" {
+			open = true
+		}
+		allowed = mergeScopes(allowed, res.Scope)
+	}
+	if len(audience) > 0 && !open && !coversScope(allowed, scope) {
+		return "", errInvalidScope
+	}
+	return strings.Join(audience, " "), nil
+}
+
+// narrowAudience returns the audience of a token issued from a grant for granted,
+// the resources in form can only restrict it further. An empty granted audience is
+// not restricted.
+func (s *Server) narrowAudience(granted string, form url.Values, scope string) (string, error) {
+	audience, err := s.resourceAudience(form, scope)
+	if err != nil || audience == "" {
+		return granted, err
+	}
+	if granted != "" && !coversScope(granted, audience) {
+		return "", errInvalidTarget
+	}
+	return audience, nil
+}
+
+// targetError returns the error code for err returned while resolving the audience
+// of a token.
+func targetError(err error) string {
+	switch err {
+	case errInvalidTarget:
+		return errorsKeys.InvalidTarget
+	case errInvalidScope:
+		return errorsKeys.InvalidScope
+	}
+	return errorsKeys.ServerError
+}
+
+// audienceClaim returns the aud claim of a token issued for the space delimited
+// audience, a single audience is a string.
+func audienceClaim(audience string) interface{} {
+	aud := strings.Fields(audience)
+	if len(aud) == 1 {
+		return aud[0]
+	}
+	return aud
+}
+
+// audienceOf returns true if client may be presented with tokens for the space
+// delimited audience, either because it is part of it or because it is the client
+// of one of the resources in it. Tokens without an audience are for any client.
+func (s *Server) audienceOf(audience string, client *Client) bool {
+	if audience == "" || hasScope(audience, client.UUID) {
+		return true
+	}
+	for _, v := range strings.Fields(audience) {
+		if res, err := s.q.ResourceByIdentifier(v); err == nil && res.ClientID == client.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// infoAudience returns true if tokens for the space delimited audience can be used
+// at the Info endpoint, the audience must name the issuer or the endpoint itself.
+func (s *Server) infoAudience(audience string) bool {
+	return audience == "" || hasScope(audience, s.cfg.Issuer) ||
+		hasScope(audience, s.cfg.EndpointURL(s.cfg.InfoEndpoint))
+}
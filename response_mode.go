@@ -0,0 +1,112 @@
+package hero
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// responseMode contains the ways authorization responses are returned to clients,
+// as described in OAuth 2.0 Multiple Response Type Encoding Practices, OAuth 2.0
+// Form Post Response Mode and JARM.
+var responseMode = struct {
+	Query, Fragment, FormPost string
+
+	// JWT is the default JWT mode for the response type, the others return the
+	// response JWT the same way their plain counterparts return the parameters.
+	JWT, QueryJWT, FragmentJWT, FormPostJWT string
+}{
+	"query", "fragment", "form_post",
+	"jwt", "query.jwt", "fragment.jwt", "form_post.jwt",
+}
+
+var errInvalidResponseMode = errors.New("hero: invalid response_mode")
+
+// authResponseMode returns the mode the authorization response for the response
+// type typ is returned with, mode is the requested response_mode. Tokens are never
+// put in the query so it can not be requested for them.
+//
+// When mode is invalid the default mode of typ is returned along with
+// errInvalidResponseMode, the error is reported with it.
+func authResponseMode(mode, typ string) (string, error) {
+	def := responseMode.Query
+	if typ == requestType.Token {
+		def = responseMode.Fragment
+	}
+	switch mode {
+	case "":
+		return def, nil
+	case responseMode.JWT:
+		return def + "." + responseMode.JWT, nil
+	case responseMode.Query, responseMode.QueryJWT:
+		if typ == requestType.Token {
+			return def, errInvalidResponseMode
+		}
+		return mode, nil
+	case responseMode.Fragment, responseMode.FragmentJWT, responseMode.FormPost, responseMode.FormPostJWT:
+		return mode, nil
+	}
+	return def, errInvalidResponseMode
+}
+
+// commitAuthorize sends the authorization response in ctx to client using mode.
+// Responses that are not redirects are sent as JSON.
+func (s *Server) commitAuthorize(ctx *context, mode string, client *Client) error {
+	if ctx.Type != responseRedirect {
+		return ctx.CommitJSON()
+	}
+	if strings.HasSuffix(mode, "."+responseMode.JWT) {
+		signed, err := s.responseJWT(ctx, client)
+		if err != nil {
+			ctx.Type = responseData
+			ctx.StatusCode = http.StatusInternalServerError
+			ctx.SetError(errorsKeys.ServerError, "")
+			ctx.InternalError = err
+			return ctx.CommitJSON()
+		}
+		ctx.ClearData()
+		ctx.SetData("response", signed)
+		mode = strings.TrimSuffix(mode, "."+responseMode.JWT)
+	}
+	ctx.SetRedirectFragment(mode == responseMode.Fragment)
+	if mode != responseMode.FormPost {
+		return ctx.CommitJSON()
+	}
+
+	// the parameters are posted to the redirect uri by the user agent, nothing
+	// ends up in its history or in referer headers.
+	values := make(map[string]string)
+	for k, v := range ctx.Data {
+		values[k] = fmt.Sprint(v)
+	}
+	data := make(map[string]interface{})
+	data["Config"] = s.cfg
+	data["Action"] = ctx.URL
+	data["Params"] = values
+	for k, h := range ctx.Headers {
+		for _, v := range h {
+			ctx.Response.Header().Add(k, v)
+		}
+	}
+	ctx.Response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return s.view.Render(ctx.Response, s.cfg.FormPostTemplate, data)
+}
+
+// responseJWT returns the authorization response in ctx as a JWT signed for client,
+// as described in JARM section 2.1.
+func (s *Server) responseJWT(ctx *context, client *Client) (string, error) {
+	claims := map[string]interface{}{
+		"iss": s.cfg.Issuer,
+		"aud": client.UUID,
+		"exp": time.Now().Add(time.Duration(s.cfg.AuthorizationExpire) * time.Second).Unix(),
+	}
+	for k, v := range ctx.Data {
+		if v == "" {
+			continue
+		}
+		claims[k] = v
+	}
+	return s.keys.Sign(claims)
+}
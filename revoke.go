@@ -0,0 +1,71 @@
+package hero
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Revoke provide oauth 2.0 token revocation as described in RFC 7009. The client
+// authenticates the same way it does on the token endpoint.
+//
+// Revoking either the access token or the refresh token deletes the whole grant, so
+// the access tokens minted from a revoked refresh token are revoked too.
+func (s *Server) Revoke(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(w)
+	if r.Method != "POST" {
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		ctx.InternalError = errors.New("request must be POST")
+		_ = ctx.CommitJSON()
+		return
+	}
+	_ = r.ParseForm()
+
+	auth, err := requestClientAuth(r)
+	if err != nil {
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errorsKeys.InvalidClient, "")
+		ctx.InternalError = err
+		_ = ctx.CommitJSON()
+		return
+	}
+	client := s.getClient(auth)
+	if client == nil {
+		ctx.StatusCode = http.StatusUnauthorized
+		ctx.SetError(errorsKeys.InvalidClient, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	token := r.Form.Get(params.token)
+	if token == "" {
+		ctx.StatusCode = http.StatusBadRequest
+		ctx.SetError(errorsKeys.InvalidRequest, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	// the hint only orders the lookup, unknown hints are ignored and all token types
+	// searched as required by RFC 7009 section 2.2.
+	grant, _, err := s.q.GrantByToken(token, r.Form.Get(params.tokenTypeHint))
+	if err != nil {
+
+		// Invalid tokens do not cause an error response, the client has nothing
+		// to do about it.
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	if grant.ClientID != client.ID {
+		ctx.StatusCode = http.StatusBadRequest
+		ctx.SetError(errorsKeys.UnauthorizedClient, "")
+		_ = ctx.CommitJSON()
+		return
+	}
+
+	if err = s.q.RevokeGrant(grant); err != nil {
+		ctx.StatusCode = http.StatusInternalServerError
+		ctx.SetError(errorsKeys.ServerError, "")
+		ctx.InternalError = err
+	}
+	_ = ctx.CommitJSON()
+}
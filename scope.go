@@ -0,0 +1,126 @@
+package hero
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var errInvalidScope = errors.New("hero: invalid scope")
+
+// builtinScopes are the scopes hero knows about without them being registered,
+// registering a scope with the same name overrides them.
+var builtinScopes = []Scope{
+	{Name: oidcScope.OpenID, Description: "Sign you in with your account"},
+	{Name: oidcScope.Profile, Description: "View your name, username and profile picture"},
+	{Name: oidcScope.Email, Description: "View your email address"},
+	{Name: "user", Description: "View your username, email address and avatar"},
+}
+
+// parseScope splits the space delimited scope string as described in RFC 6749
+// section 3.3, duplicate scopes are dropped.
+func parseScope(scope string) []string {
+	var names []string
+	for _, v := range strings.Fields(scope) {
+		if !hasScope(strings.Join(names, " "), v) {
+			names = append(names, v)
+		}
+	}
+	return names
+}
+
+// RegisterScope adds sc to the scopes clients can request, a registered scope with
+// the same name is updated.
+func (s *Server) RegisterScope(sc *Scope) error {
+	if sc.Name == "" || strings.ContainsAny(sc.Name, " \"\\") {
+		return errInvalidScope
+	}
+	old, err := s.q.ScopeByName(sc.Name)
+	if err != nil {
+		if err != ErrNotFound {
+			return err
+		}
+	} else {
+		sc.ID = old.ID
+		sc.CreatedAt = old.CreatedAt
+	}
+	return s.q.SaveScope(sc)
+}
+
+// scopeRegistry returns the known scopes by name.
+func (s *Server) scopeRegistry() (map[string]Scope, error) {
+	scopes, err := s.q.Scopes()
+	if err != nil {
+		return nil, err
+	}
+	reg := make(map[string]Scope)
+	for _, sc := range builtinScopes {
+		reg[sc.Name] = sc
+	}
+	for _, sc := range scopes {
+		reg[sc.Name] = sc
+	}
+	return reg, nil
+}
+
+// validScope returns the scopes client is granted when it requests scope. The
+// default scopes allowed to the client are granted when scope is empty.
+//
+// errInvalidScope is returned when a requested scope is not registered or the
+// client is not allowed to request it.
+func (s *Server) validScope(client *Client, scope string) (string, error) {
+	reg, err := s.scopeRegistry()
+	if err != nil {
+		return "", err
+	}
+	allowed := func(sc Scope) bool {
+		if client.Scope != "" {
+			return hasScope(client.Scope, sc.Name)
+		}
+		return !sc.Restricted
+	}
+
+	names := parseScope(scope)
+	if len(names) == 0 {
+		for _, sc := range reg {
+			if sc.Default && allowed(sc) {
+				names = append(names, sc.Name)
+			}
+		}
+		sort.Strings(names)
+		return strings.Join(names, " "), nil
+	}
+	for _, name := range names {
+		sc, ok := reg[name]
+		if !ok || !allowed(sc) {
+			return "", errInvalidScope
+		}
+	}
+	return strings.Join(names, " "), nil
+}
+
+// describeScopes returns the registered details of the scopes in scope, they are
+// shown to users so they know what they are granting.
+func (s *Server) describeScopes(scope string) []Scope {
+	reg, err := s.scopeRegistry()
+	if err != nil {
+		s.log.Println(err)
+	}
+	var scopes []Scope
+	for _, name := range parseScope(scope) {
+		sc, ok := reg[name]
+		if !ok {
+			sc = Scope{Name: name}
+		}
+		scopes = append(scopes, sc)
+	}
+	return scopes
+}
+
+// scopeError returns the oauth error key for err returned by validScope.
+func scopeError(err error) string {
+	if err == errInvalidScope {
+		return errorsKeys.InvalidScope
+	}
+	return errorsKeys.ServerError
+}
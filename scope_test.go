@@ -0,0 +1,98 @@
+package hero
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/antonholmquist/jason"
+)
+
+func TestParseScope(t *testing.T) {
+	sample := []struct {
+		scope  string
+		result []string
+	}{
+		{"", nil},
+		{"openid profile", []string{"openid", "profile"}},
+		{" openid  openid\tprofile ", []string{"openid", "profile"}},
+		{"openid,profile", []string{"openid,profile"}},
+	}
+	for _, v := range sample {
+		if r := parseScope(v.scope); !reflect.DeepEqual(r, v.result) {
+			t.Errorf("expected %v got %v scope: %q", v.result, r, v.scope)
+		}
+	}
+}
+
+func TestServer_ValidScope(t *testing.T) {
+	if !dbConn.isOpne {
+		t.Skip()
+	}
+	for _, sc := range []*Scope{
+		{Name: "read", Description: "Read your data", Default: true},
+		{Name: "admin", Description: "Manage everything", Restricted: true},
+	} {
+		if err := testServer.RegisterScope(sc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := testServer.RegisterScope(&Scope{Name: "bad scope"}); err != errInvalidScope {
+		t.Errorf("expected %v got %v", errInvalidScope, err)
+	}
+
+	client := &Client{}
+	sample := []struct {
+		allowed, scope, result string
+		err                    error
+	}{
+		{"", "", "read", nil},
+		{"", "openid  read openid", "openid read", nil},
+		{"", "unknown", "", errInvalidScope},
+		{"", "admin", "", errInvalidScope},
+		{"admin", "admin", "admin", nil},
+		{"admin", "read", "", errInvalidScope},
+		{"admin", "", "", nil},
+	}
+	for _, v := range sample {
+		client.Scope = v.allowed
+		r, err := testServer.validScope(client, v.scope)
+		if err != v.err {
+			t.Errorf("expected %v got %v scope: %s", v.err, err, v.scope)
+		}
+		if r != v.result {
+			t.Errorf("expected %s got %s scope: %s", v.result, r, v.scope)
+		}
+	}
+
+	//
+	// case requesting an unknown scope at the token endpoint
+	//
+	accessParams := url.Values{
+		params.clientID:     {genericClient.UUID},
+		params.clientSecret: {genericClient.Secret},
+		params.grantType:    {grantType.ClientCredentials},
+		params.scope:        {"unknown"},
+	}
+	req, err := http.NewRequest("POST", testServer.cfg.TokenEndpoint, strings.NewReader(accessParams.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", formURLEncoded)
+	w := httptest.NewRecorder()
+	testServer.ServeHTTP(w, req)
+	jObj, err := jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resErr, err := jObj.GetString("error")
+	if err != nil {
+		t.Error(err)
+	}
+	if resErr != errorsKeys.InvalidScope {
+		t.Errorf("expected %s got %s", errorsKeys.InvalidScope, resErr)
+	}
+}
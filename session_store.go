@@ -8,7 +8,6 @@ import (
 
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
-	"github.com/jinzhu/gorm"
 )
 
 const (
@@ -16,16 +15,16 @@ const (
 	defaultSessionPath   = "/"
 )
 
-// Store is a Store implementation for gorilla session. It support mysql, postgresql and
-// foundation databases
+// Store is a Store implementation for gorilla session. The sessions are kept in a
+// SessionStore.
 type Store struct {
-	q       *query
+	q       SessionStore
 	codecs  []securecookie.Codec
 	options *sessions.Options
 }
 
 // DefaultStore returns a *Store with default values.
-func DefaultStore(db *gorm.DB) *Store {
+func DefaultStore(q SessionStore) *Store {
 	keyPairs := [][]byte{
 		[]byte("ePAPW9vJv7gHoftvQTyNj5VkWB52mlza"),
 		[]byte("N8SmpJ00aSpepNrKoyYxmAJhwVuKEWZD"),
@@ -34,13 +33,11 @@ func DefaultStore(db *gorm.DB) *Store {
 		SessionMaxAge: defaultSessionMaxAge,
 		SessionPath:   defaultSessionPath,
 	}
-	return NewStore(db, cfg, keyPairs...)
+	return NewStore(q, cfg, keyPairs...)
 }
 
 // NewStore creates a new *Store instance.
-func NewStore(db *gorm.DB, config *Config, keyPairs ...[]byte) *Store {
-	q := &query{}
-	q.DB = db
+func NewStore(q SessionStore, config *Config, keyPairs ...[]byte) *Store {
 	return &Store{
 		q:      q,
 		codecs: securecookie.CodecsFromPairs(keyPairs...),
@@ -101,6 +98,10 @@ func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.S
 		return err
 	}
 
+	// the session is in the database now, saving it again in the same request
+	// must update it.
+	session.IsNew = false
+
 	// Keep the session ID key in a cookie so it can be looked up in DB later.
 	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
 	if err != nil {
@@ -30,7 +30,7 @@ func TestStore(t *testing.T) {
 		t.Skip()
 	}
 
-	ss := DefaultStore(dbConn.db)
+	ss := DefaultStore(NewGormStore(dbConn.db))
 
 	if ss == nil {
 		t.Fatal("This test requires a real database")
@@ -127,7 +127,7 @@ func TestSessionOptionsAreUniquePerSession(t *testing.T) {
 		t.Skip()
 	}
 
-	ss := DefaultStore(dbConn.db)
+	ss := DefaultStore(NewGormStore(dbConn.db))
 
 	if ss == nil {
 		t.Fatal("This test requires a real database")
@@ -0,0 +1,152 @@
+package hero
+
+import "errors"
+
+// The errors of a Storage, the handlers compare against them so implementations
+// must return these instead of their own.
+var (
+	// ErrNotFound is returned by the lookups when nothing matches.
+	ErrNotFound = errors.New("hero: record not found")
+
+	// ErrTokenUsed is returned by UseToken when the refresh token was used before.
+	ErrTokenUsed = errors.New("hero: the refresh token was used before")
+
+	// ErrRequestClaimed is returned by ClaimDevice and ClaimBackchannelRequest
+	// when the request was claimed before.
+	ErrRequestClaimed = errors.New("hero: the request was claimed before")
+
+	// ErrReplayedJWT is returned by UseJTI when the JWT was presented before.
+	ErrReplayedJWT = errors.New("hero: the JWT was used before")
+)
+
+// UserStore stores users, their profiles and the consents they give to clients.
+type UserStore interface {
+	CreateUser(usr *User) error
+	SaveUser(usr *User) error
+	UserByID(id int64) (*User, error)
+	UserByUserName(username string) (*User, error)
+	UserByEmail(email string) (*User, error)
+	ProfileByID(id int64) (*Profile, error)
+	ConsentByClient(userID, clientID int64) (*Consent, error)
+	SaveConsent(c *Consent) error
+}
+
+// ClientStore stores clients and the JWT assertions they present.
+type ClientStore interface {
+	ClientByCode(code string) (*Client, error)
+	ClientByID(id int64) (*Client, error)
+	ClientsByUser(userID int64) ([]Client, error)
+	SaveClient(client *Client) error
+	DeleteClient(client *Client) error
+
+	// UseJTI records that the client presented the JWT with the id jti which
+	// expires at the unix time exp, ErrReplayedJWT is returned when it was
+	// presented before.
+	UseJTI(clientID int64, jti string, exp int64) error
+}
+
+// GrantStore stores authorization and access grants.
+type GrantStore interface {
+	GrantByCode(code string) (*Grant, error)
+	GrantByClient(c *Client, code string) (*Grant, error)
+	GrantByBearer(bearerCode string) (*Grant, error)
+	GrantByRefreshToken(code string) (*Grant, error)
+	GrantByToken(code, hint string) (*Grant, string, error)
+	SaveGrant(g *Grant) error
+	DeleteGrant(g *Grant) error
+	RevokeGrant(g *Grant) error
+	RevokeFamily(family string) error
+}
+
+// TokenStore stores access and refresh tokens.
+type TokenStore interface {
+	TokenByCode(code string) (*Token, error)
+	SaveToken(tok *Token) error
+
+	// UseToken atomically marks the refresh token whose id is id as used,
+	// ErrTokenUsed is returned when it was used before.
+	UseToken(id int64) error
+}
+
+// SessionStore stores the server side state of cookie sessions.
+type SessionStore interface {
+	GetSessionByKey(key string) (*Session, error)
+	SaveSession(ss *Session) error
+	UpdateSession(ss *Session) error
+	DeleteSession(key string) error
+}
+
+// RequestStore stores the pending requests of the device, pushed authorization
+// and backchannel authentication flows.
+type RequestStore interface {
+	DeviceByCode(code string) (*DeviceAuthorization, error)
+	DeviceByUserCode(code string) (*DeviceAuthorization, error)
+	SaveDevice(d *DeviceAuthorization) error
+
+	// PollDevice updates only the last poll and the interval of d.
+	PollDevice(d *DeviceAuthorization) error
+
+	// DecideDevice updates only the user and the decision of d, ErrNotFound is
+	// returned when d was decided before.
+	DecideDevice(d *DeviceAuthorization) error
+
+	// ClaimDevice atomically deletes the device authorization request whose id
+	// is id, ErrRequestClaimed is returned when it was claimed before.
+	ClaimDevice(id int64) error
+
+	PushedRequestByURI(uri string) (*PushedRequest, error)
+	SavePushedRequest(p *PushedRequest) error
+	DeletePushedRequest(p *PushedRequest) error
+
+	BackchannelRequestByID(id string) (*BackchannelRequest, error)
+	BackchannelRequestByUser(userID, id int64) (*BackchannelRequest, error)
+	BackchannelRequestsByUser(userID int64) ([]BackchannelRequest, error)
+	SaveBackchannelRequest(b *BackchannelRequest) error
+	DeleteBackchannelRequest(b *BackchannelRequest) error
+
+	// PollBackchannelRequest updates only the last poll and the interval of b.
+	PollBackchannelRequest(b *BackchannelRequest) error
+
+	// DecideBackchannelRequest updates only the decision of b, ErrNotFound is
+	// returned when b was decided before.
+	DecideBackchannelRequest(b *BackchannelRequest) error
+
+	// ClaimBackchannelRequest atomically deletes the backchannel request whose
+	// id is id, ErrRequestClaimed is returned when it was claimed before.
+	ClaimBackchannelRequest(id int64) error
+}
+
+// RegistryStore stores the scopes, resources and authorization details types
+// registered with the server.
+type RegistryStore interface {
+	Scopes() ([]Scope, error)
+	ScopeByName(name string) (*Scope, error)
+	ResourceByIdentifier(identifier string) (*Resource, error)
+	AuthorizationDetailTypes() ([]AuthorizationDetailType, error)
+	SaveScope(sc *Scope) error
+	SaveResource(res *Resource) error
+	SaveAuthorizationDetailType(t *AuthorizationDetailType) error
+}
+
+// Storage is where *Server keeps its state, each of the embedded stores reads and
+// writes a group of related models. Lookups return ErrNotFound when nothing
+// matches.
+//
+// GormStore is the implementation used by NewServer, use NewServerWithStore to
+// provide another one.
+type Storage interface {
+	UserStore
+	ClientStore
+	GrantStore
+	TokenStore
+	SessionStore
+	RequestStore
+	RegistryStore
+
+	// Migrate prepares the storage for all the models used by hero, DropAll
+	// removes them.
+	Migrate() error
+	DropAll() error
+
+	Close() error
+}
@@ -0,0 +1,860 @@
+package hero
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antonholmquist/jason"
+)
+
+// memStore is a Storage keeping the models in memory, it lets the handlers be
+// tested without a database. Models are copied in and out like a database would.
+type memStore struct {
+	mu     sync.Mutex
+	lastID int64
+
+	users       []User
+	profiles    []Profile
+	consents    []Consent
+	clients     []Client
+	assertions  []Assertion
+	grants      []Grant
+	tokens      []Token
+	sessions    []Session
+	devices     []DeviceAuthorization
+	pushed      []PushedRequest
+	backchannel []BackchannelRequest
+	scopes      []Scope
+	resources   []Resource
+	detailTypes []AuthorizationDetailType
+}
+
+var _ Storage = (*memStore)(nil)
+
+// nextID returns the id of a new model, the caller holds m.mu.
+func (m *memStore) nextID() int64 {
+	m.lastID++
+	return m.lastID
+}
+
+func (m *memStore) CreateUser(usr *User) error {
+	return m.SaveUser(usr)
+}
+
+// SaveUser saves usr and, like gorm does with associations, the clients in
+// usr.Clients.
+func (m *memStore) SaveUser(usr *User) error {
+	m.mu.Lock()
+	if usr.ID == 0 {
+		usr.ID = m.nextID()
+	}
+	m.users = saveUser(m.users, *usr)
+	m.mu.Unlock()
+	for i := range usr.Clients {
+		usr.Clients[i].UserID = usr.ID
+		if err := m.SaveClient(&usr.Clients[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveUser(users []User, usr User) []User {
+	for i := range users {
+		if users[i].ID == usr.ID {
+			users[i] = usr
+			return users
+		}
+	}
+	return append(users, usr)
+}
+
+func (m *memStore) UserByID(id int64) (*User, error) {
+	return m.findUser(func(u *User) bool { return u.ID == id })
+}
+
+func (m *memStore) UserByUserName(username string) (*User, error) {
+	return m.findUser(func(u *User) bool { return u.UserName == username })
+}
+
+func (m *memStore) UserByEmail(email string) (*User, error) {
+	return m.findUser(func(u *User) bool { return u.Email == email })
+}
+
+func (m *memStore) findUser(match func(*User) bool) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.users {
+		if match(&m.users[i]) {
+			u := m.users[i]
+			return &u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) ProfileByID(id int64) (*Profile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.profiles {
+		if m.profiles[i].ID == id {
+			p := m.profiles[i]
+			return &p, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) ConsentByClient(userID, clientID int64) (*Consent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.consents {
+		if m.consents[i].UserID == userID && m.consents[i].ClientID == clientID {
+			c := m.consents[i]
+			return &c, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) SaveConsent(c *Consent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c.ID == 0 {
+		c.ID = m.nextID()
+		c.CreatedAt = time.Now()
+	}
+	c.UpdatedAt = time.Now()
+	for i := range m.consents {
+		if m.consents[i].ID == c.ID {
+			m.consents[i] = *c
+			return nil
+		}
+	}
+	m.consents = append(m.consents, *c)
+	return nil
+}
+
+func (m *memStore) ClientByCode(code string) (*Client, error) {
+	return m.findClient(func(c *Client) bool { return code != "" && c.UUID == code })
+}
+
+func (m *memStore) ClientByID(id int64) (*Client, error) {
+	return m.findClient(func(c *Client) bool { return c.ID == id })
+}
+
+func (m *memStore) findClient(match func(*Client) bool) (*Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.clients {
+		if match(&m.clients[i]) {
+			c := m.clients[i]
+			return &c, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) ClientsByUser(userID int64) ([]Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var clients []Client
+	for _, c := range m.clients {
+		if c.UserID == userID {
+			clients = append(clients, c)
+		}
+	}
+	return clients, nil
+}
+
+func (m *memStore) SaveClient(client *Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if client.ID == 0 {
+		client.ID = m.nextID()
+	}
+	for i := range m.clients {
+		if m.clients[i].ID == client.ID {
+			m.clients[i] = *client
+			return nil
+		}
+	}
+	m.clients = append(m.clients, *client)
+	return nil
+}
+
+// DeleteClient deletes client with its grants, tokens, consents and pending
+// requests.
+func (m *memStore) DeleteClient(client *Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := client.ID
+	var (
+		clients     []Client
+		grants      []Grant
+		tokens      []Token
+		consents    []Consent
+		pushed      []PushedRequest
+		backchannel []BackchannelRequest
+	)
+	for _, v := range m.clients {
+		if v.ID != id {
+			clients = append(clients, v)
+		}
+	}
+	for _, v := range m.grants {
+		if v.ClientID != id {
+			grants = append(grants, v)
+		}
+	}
+	for _, v := range m.tokens {
+		if v.ClientID != id {
+			tokens = append(tokens, v)
+		}
+	}
+	for _, v := range m.consents {
+		if v.ClientID != id {
+			consents = append(consents, v)
+		}
+	}
+	for _, v := range m.pushed {
+		if v.ClientID != id {
+			pushed = append(pushed, v)
+		}
+	}
+	for _, v := range m.backchannel {
+		if v.ClientID != id {
+			backchannel = append(backchannel, v)
+		}
+	}
+	m.clients, m.grants, m.tokens = clients, grants, tokens
+	m.consents, m.pushed, m.backchannel = consents, pushed, backchannel
+	return nil
+}
+
+func (m *memStore) UseJTI(clientID int64, jti string, exp int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if jti == "" {
+		return ErrReplayedJWT
+	}
+	for _, a := range m.assertions {
+		if a.ClientID == clientID && a.JTI == jti && a.ExpiresAt >= time.Now().Unix() {
+			return ErrReplayedJWT
+		}
+	}
+	m.assertions = append(m.assertions, Assertion{
+		ID: m.nextID(), ClientID: clientID, JTI: jti, ExpiresAt: exp, CreatedAt: time.Now(),
+	})
+	return nil
+}
+
+// findGrant returns a copy of the first grant matching, with its tokens loaded.
+func (m *memStore) findGrant(match func(*Grant) bool) (*Grant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.grants {
+		if match(&m.grants[i]) {
+			g := m.grants[i]
+			for _, tok := range m.tokens {
+				switch tok.ID {
+				case g.AccessTokenID:
+					g.AccessToken = tok
+				case g.RefreshTokenID:
+					g.RefreshToken = tok
+				}
+			}
+			return &g, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) GrantByCode(code string) (*Grant, error) {
+	return m.findGrant(func(g *Grant) bool { return code != "" && g.Code == code })
+}
+
+func (m *memStore) GrantByClient(c *Client, code string) (*Grant, error) {
+	return m.findGrant(func(g *Grant) bool {
+		return code != "" && g.Code == code && g.ClientID == c.ID
+	})
+}
+
+func (m *memStore) GrantByBearer(bearerCode string) (*Grant, error) {
+	tok, err := m.TokenByCode(bearerCode)
+	if err != nil {
+		return nil, err
+	}
+	return m.findGrant(func(g *Grant) bool { return g.AccessTokenID == tok.ID })
+}
+
+func (m *memStore) GrantByRefreshToken(code string) (*Grant, error) {
+	tok, err := m.TokenByCode(code)
+	if err != nil {
+		return nil, err
+	}
+	return m.findGrant(func(g *Grant) bool { return g.RefreshTokenID == tok.ID })
+}
+
+func (m *memStore) GrantByToken(code, hint string) (*Grant, string, error) {
+	if g, err := m.GrantByBearer(code); err == nil {
+		return g, tokenTypeHint.AccessToken, nil
+	}
+	g, err := m.GrantByRefreshToken(code)
+	if err != nil {
+		return nil, "", err
+	}
+	return g, tokenTypeHint.RefreshToken, nil
+}
+
+// SaveGrant saves g, like gorm the ids of the saved tokens of g are recorded.
+func (m *memStore) SaveGrant(g *Grant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if g.ID == 0 {
+		g.ID = m.nextID()
+		g.CreatedAt = time.Now()
+	}
+	if g.AccessToken.ID != 0 {
+		g.AccessTokenID = g.AccessToken.ID
+	}
+	if g.RefreshToken.ID != 0 {
+		g.RefreshTokenID = g.RefreshToken.ID
+	}
+	for i := range m.grants {
+		if m.grants[i].ID == g.ID {
+			m.grants[i] = *g
+			return nil
+		}
+	}
+	m.grants = append(m.grants, *g)
+	return nil
+}
+
+func (m *memStore) DeleteGrant(g *Grant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if g.ID == 0 {
+		return errBlankID
+	}
+	m.deleteGrants(func(v *Grant) bool { return v.ID == g.ID })
+	return nil
+}
+
+func (m *memStore) RevokeGrant(g *Grant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteGrants(func(v *Grant) bool { return v.ID == g.ID })
+	m.deleteTokens(g)
+	return nil
+}
+
+func (m *memStore) RevokeFamily(family string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if family == "" {
+		return errors.New("hero: empty token family")
+	}
+	for _, g := range m.deleteGrants(func(v *Grant) bool { return v.Family == family }) {
+		m.deleteTokens(&g)
+	}
+	return nil
+}
+
+// deleteGrants removes the grants matching and returns them, the caller holds
+// m.mu.
+func (m *memStore) deleteGrants(match func(*Grant) bool) []Grant {
+	var kept, deleted []Grant
+	for i := range m.grants {
+		if match(&m.grants[i]) {
+			deleted = append(deleted, m.grants[i])
+			continue
+		}
+		kept = append(kept, m.grants[i])
+	}
+	m.grants = kept
+	return deleted
+}
+
+// deleteTokens removes the access and refresh tokens of g, the caller holds m.mu.
+func (m *memStore) deleteTokens(g *Grant) {
+	var kept []Token
+	for _, tok := range m.tokens {
+		if tok.ID != 0 && (tok.ID == g.AccessTokenID || tok.ID == g.RefreshTokenID) {
+			continue
+		}
+		kept = append(kept, tok)
+	}
+	m.tokens = kept
+}
+
+func (m *memStore) TokenByCode(code string) (*Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.tokens {
+		if code != "" && m.tokens[i].Code == code {
+			tok := m.tokens[i]
+			return &tok, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) SaveToken(tok *Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if tok.ID == 0 {
+		tok.ID = m.nextID()
+		tok.CreatedAT = time.Now()
+	}
+	for i := range m.tokens {
+		if m.tokens[i].ID == tok.ID {
+			m.tokens[i] = *tok
+			return nil
+		}
+	}
+	m.tokens = append(m.tokens, *tok)
+	return nil
+}
+
+func (m *memStore) UseToken(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.tokens {
+		if m.tokens[i].ID == id && !m.tokens[i].Used {
+			m.tokens[i].Used = true
+			return nil
+		}
+	}
+	return ErrTokenUsed
+}
+
+func (m *memStore) GetSessionByKey(key string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.sessions {
+		if m.sessions[i].Key == key {
+			ss := m.sessions[i]
+			return &ss, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) SaveSession(ss *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ss.ID == 0 {
+		ss.ID = m.nextID()
+		ss.CreatedAt = time.Now()
+	}
+	for i := range m.sessions {
+		if m.sessions[i].ID == ss.ID {
+			m.sessions[i] = *ss
+			return nil
+		}
+	}
+	m.sessions = append(m.sessions, *ss)
+	return nil
+}
+
+func (m *memStore) UpdateSession(ss *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.sessions {
+		if m.sessions[i].Key == ss.Key {
+			m.sessions[i].Data = ss.Data
+			m.sessions[i].UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *memStore) DeleteSession(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.sessions {
+		if m.sessions[i].Key == key {
+			m.sessions = append(m.sessions[:i], m.sessions[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *memStore) DeviceByCode(code string) (*DeviceAuthorization, error) {
+	return m.findDevice(func(d *DeviceAuthorization) bool { return code != "" && d.DeviceCode == code })
+}
+
+func (m *memStore) DeviceByUserCode(code string) (*DeviceAuthorization, error) {
+	return m.findDevice(func(d *DeviceAuthorization) bool { return code != "" && d.UserCode == code })
+}
+
+func (m *memStore) findDevice(match func(*DeviceAuthorization) bool) (*DeviceAuthorization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.devices {
+		if match(&m.devices[i]) {
+			d := m.devices[i]
+			return &d, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) SaveDevice(d *DeviceAuthorization) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d.ID == 0 {
+		d.ID = m.nextID()
+		d.CreatedAt = time.Now()
+	}
+	d.UpdatedAt = time.Now()
+	for i := range m.devices {
+		if m.devices[i].ID == d.ID {
+			m.devices[i] = *d
+			return nil
+		}
+	}
+	m.devices = append(m.devices, *d)
+	return nil
+}
+
+func (m *memStore) PollDevice(d *DeviceAuthorization) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.devices {
+		if m.devices[i].ID == d.ID {
+			m.devices[i].LastPoll = d.LastPoll
+			m.devices[i].Interval = d.Interval
+		}
+	}
+	return nil
+}
+
+func (m *memStore) DecideDevice(d *DeviceAuthorization) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.devices {
+		v := &m.devices[i]
+		if v.ID == d.ID && !v.Approved && !v.Denied {
+			v.UserID, v.Approved, v.Denied = d.UserID, d.Approved, d.Denied
+			v.UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *memStore) ClaimDevice(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.devices {
+		if m.devices[i].ID == id {
+			m.devices = append(m.devices[:i], m.devices[i+1:]...)
+			return nil
+		}
+	}
+	return ErrRequestClaimed
+}
+
+func (m *memStore) PushedRequestByURI(uri string) (*PushedRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.pushed {
+		if uri != "" && m.pushed[i].RequestURI == uri {
+			p := m.pushed[i]
+			return &p, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) SavePushedRequest(p *PushedRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p.ID == 0 {
+		p.ID = m.nextID()
+		p.CreatedAt = time.Now()
+	}
+	p.UpdatedAt = time.Now()
+	for i := range m.pushed {
+		if m.pushed[i].ID == p.ID {
+			m.pushed[i] = *p
+			return nil
+		}
+	}
+	m.pushed = append(m.pushed, *p)
+	return nil
+}
+
+func (m *memStore) DeletePushedRequest(p *PushedRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.pushed {
+		if p.ID != 0 && m.pushed[i].ID == p.ID {
+			m.pushed = append(m.pushed[:i], m.pushed[i+1:]...)
+			return nil
+		}
+	}
+	return errBlankID
+}
+
+func (m *memStore) BackchannelRequestByID(id string) (*BackchannelRequest, error) {
+	return m.findBackchannel(func(b *BackchannelRequest) bool { return id != "" && b.AuthReqID == id })
+}
+
+func (m *memStore) BackchannelRequestByUser(userID, id int64) (*BackchannelRequest, error) {
+	return m.findBackchannel(func(b *BackchannelRequest) bool { return b.UserID == userID && b.ID == id })
+}
+
+func (m *memStore) findBackchannel(match func(*BackchannelRequest) bool) (*BackchannelRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.backchannel {
+		if match(&m.backchannel[i]) {
+			b := m.backchannel[i]
+			return &b, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) BackchannelRequestsByUser(userID int64) ([]BackchannelRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var reqs []BackchannelRequest
+	for _, b := range m.backchannel {
+		if b.UserID == userID {
+			reqs = append(reqs, b)
+		}
+	}
+	return reqs, nil
+}
+
+func (m *memStore) SaveBackchannelRequest(b *BackchannelRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b.ID == 0 {
+		b.ID = m.nextID()
+		b.CreatedAt = time.Now()
+	}
+	b.UpdatedAt = time.Now()
+	for i := range m.backchannel {
+		if m.backchannel[i].ID == b.ID {
+			m.backchannel[i] = *b
+			return nil
+		}
+	}
+	m.backchannel = append(m.backchannel, *b)
+	return nil
+}
+
+func (m *memStore) PollBackchannelRequest(b *BackchannelRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.backchannel {
+		if m.backchannel[i].ID == b.ID {
+			m.backchannel[i].LastPoll = b.LastPoll
+			m.backchannel[i].Interval = b.Interval
+		}
+	}
+	return nil
+}
+
+func (m *memStore) DecideBackchannelRequest(b *BackchannelRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.backchannel {
+		v := &m.backchannel[i]
+		if v.ID == b.ID && !v.Approved && !v.Denied {
+			v.Approved, v.Denied = b.Approved, b.Denied
+			v.UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *memStore) DeleteBackchannelRequest(b *BackchannelRequest) error {
+	if b.ID == 0 {
+		return errBlankID
+	}
+	return m.ClaimBackchannelRequest(b.ID)
+}
+
+func (m *memStore) ClaimBackchannelRequest(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.backchannel {
+		if m.backchannel[i].ID == id {
+			m.backchannel = append(m.backchannel[:i], m.backchannel[i+1:]...)
+			return nil
+		}
+	}
+	return ErrRequestClaimed
+}
+
+func (m *memStore) Scopes() ([]Scope, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	scopes := append([]Scope(nil), m.scopes...)
+	sort.Slice(scopes, func(i, j int) bool { return scopes[i].Name < scopes[j].Name })
+	return scopes, nil
+}
+
+func (m *memStore) ScopeByName(name string) (*Scope, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.scopes {
+		if name != "" && m.scopes[i].Name == name {
+			sc := m.scopes[i]
+			return &sc, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) SaveScope(sc *Scope) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sc.ID == 0 {
+		sc.ID = m.nextID()
+	}
+	for i := range m.scopes {
+		if m.scopes[i].ID == sc.ID {
+			m.scopes[i] = *sc
+			return nil
+		}
+	}
+	m.scopes = append(m.scopes, *sc)
+	return nil
+}
+
+func (m *memStore) ResourceByIdentifier(identifier string) (*Resource, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.resources {
+		if identifier != "" && m.resources[i].Identifier == identifier {
+			res := m.resources[i]
+			return &res, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) SaveResource(res *Resource) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if res.ID == 0 {
+		res.ID = m.nextID()
+	}
+	for i := range m.resources {
+		if m.resources[i].ID == res.ID {
+			m.resources[i] = *res
+			return nil
+		}
+	}
+	m.resources = append(m.resources, *res)
+	return nil
+}
+
+func (m *memStore) AuthorizationDetailTypes() ([]AuthorizationDetailType, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]AuthorizationDetailType(nil), m.detailTypes...), nil
+}
+
+func (m *memStore) SaveAuthorizationDetailType(t *AuthorizationDetailType) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t.ID == 0 {
+		t.ID = m.nextID()
+	}
+	for i := range m.detailTypes {
+		if m.detailTypes[i].ID == t.ID {
+			m.detailTypes[i] = *t
+			return nil
+		}
+	}
+	m.detailTypes = append(m.detailTypes, *t)
+	return nil
+}
+
+func (m *memStore) Migrate() error { return nil }
+func (m *memStore) DropAll() error { return nil }
+func (m *memStore) Close() error   { return nil }
+
+func TestMemStore_UseToken(t *testing.T) {
+	m := &memStore{}
+	tok := &Token{Code: "refresh"}
+	if err := m.SaveToken(tok); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.UseToken(tok.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.UseToken(tok.ID); err != ErrTokenUsed {
+		t.Errorf("expected %v got %v", ErrTokenUsed, err)
+	}
+}
+
+func TestNewServerWithStore(t *testing.T) {
+	cfg := DefaultConfig()
+	view, err := NewDefaultView(cfg.TemplatesDir, false)
+	if err != nil {
+		t.Skip(err)
+	}
+	store := &memStore{}
+	usr := &User{UserName: "gernest", Email: "gernest@example.com"}
+	if err = store.SaveUser(usr); err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{UUID: "client", UserID: usr.ID}
+	if err = store.SaveClient(client); err != nil {
+		t.Fatal(err)
+	}
+	tok := &Token{Code: "access", ClientID: client.ID}
+	if err = store.SaveToken(tok); err != nil {
+		t.Fatal(err)
+	}
+	grant := &Grant{
+		ClientID:    client.ID,
+		UserID:      usr.ID,
+		Scope:       "user",
+		ExpiresIn:   3600,
+		AccessToken: *tok,
+	}
+	if err = store.SaveGrant(grant); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServerWithStore(cfg, store, &SimpleTokenGen{}, view)
+	if s.keys.Current() == nil {
+		t.Fatal("expected a signing key for id tokens")
+	}
+
+	req, _ := http.NewRequest("GET", cfg.InfoEndpoint, nil)
+	req.Header.Set("Authorization", "Bearer access")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	jObj, err := jason.NewObjectFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email, err := jObj.GetString("email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email != usr.Email {
+		t.Errorf("expected %s got %s", usr.Email, email)
+	}
+}
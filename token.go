@@ -1,8 +1,11 @@
 package hero
 
 import (
-	"github.com/dgrijalva/jwt-go"
-	"github.com/jinzhu/now"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
 	"github.com/pborman/uuid"
 )
 
@@ -16,25 +19,139 @@ func (s *SimpleTokenGen) Generate() string {
 
 // JWTTokenGen implements TokenGenerator interface for JWT tokens.
 type JWTTokenGen struct {
-	publicKey  []byte
-	privateKey []byte
+	mu   sync.RWMutex
+	keys *KeySet
+
+	// expire is the lifetime of the tokens made by Generate, *Server sets it to
+	// Config.AccessExpire.
+	expire time.Duration
 }
 
 //NewJWTGen returns a new JWT token generater which signs the toke
 // with private key. This uses RSA keys.
+//
+// The public key is derived from private, public is only kept for compatibility. It
+// panics if private is not a valid PEM encoded key.
 func NewJWTGen(public, private []byte) *JWTTokenGen {
-	return &JWTTokenGen{publicKey: public, privateKey: private}
+	key, err := ParseSigningKey(private)
+	if err != nil {
+		panic(err)
+	}
+	return NewJWTGenWithKeys(NewKeySet(key))
 }
 
-// Generate generates new jwt tokens, only claim is expire date which is after one
-// year.
+// NewJWTGenWithKeys returns a new JWT token generator which signs the tokens with
+// the current key of keys. Supported algorithms are RS256, ES256 and EdDSA.
+func NewJWTGenWithKeys(keys *KeySet) *JWTTokenGen {
+	return &JWTTokenGen{
+		keys:   keys,
+		expire: time.Duration(DefaultConfig().AccessExpire) * time.Second,
+	}
+}
+
+// Keys returns the key set used to sign tokens.
+func (j *JWTTokenGen) Keys() *KeySet {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.keys
+}
+
+// SetKeys sets the key set used to sign tokens.
+func (j *JWTTokenGen) SetKeys(keys *KeySet) {
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+}
+
+// Generate generates new jwt tokens, only claims are a unique id and expire date
+// which is Config.AccessExpire from now. It is used for authorization codes and
+// refresh tokens, access tokens are made by GenerateAccess.
 func (j *JWTTokenGen) Generate() string {
-	exp := now.EndOfYear()
-	token := jwt.New(jwt.SigningMethodRS256)
-	token.Claims["exp"] = exp.Unix()
-	tok, err := token.SignedString(j.privateKey)
+	exp := time.Now().Add(j.expire)
+	tok, err := j.Keys().Sign(map[string]interface{}{
+		"jti": uuid.NewRandom().String(),
+		"exp": exp.Unix(),
+	})
 	if err != nil {
 		panic(err)
 	}
 	return tok
 }
+
+// GenerateAccess generates a JWT access token as described in RFC 9068. The token
+// expires together with its grant.
+func (j *JWTTokenGen) GenerateAccess(tc *TokenContext) (string, error) {
+	return j.Keys().sign(map[string]interface{}{"typ": "at+jwt"}, accessClaims(tc))
+}
+
+// accessClaims returns the claims of a JWT access token for tc.
+func accessClaims(tc *TokenContext) map[string]interface{} {
+	g := tc.Grant
+	iat := g.CreatedAt
+	if iat.IsZero() {
+		iat = time.Now()
+	}
+	claims := map[string]interface{}{
+		"jti":       uuid.NewRandom().String(),
+		"client_id": tc.Client.UUID,
+		"iat":       iat.Unix(),
+		"exp":       iat.Add(time.Duration(g.ExpiresIn) * time.Second).Unix(),
+	}
+	if tc.Issuer != "" {
+		claims["iss"] = tc.Issuer
+	}
+
+	// tokens issued through client credentials have the client as their subject,
+	// even when the grant carries the user owning the client.
+	claims["sub"] = tc.Client.UUID
+	if tc.User != nil && g.Type != grantType.ClientCredentials {
+		claims["sub"] = strconv.FormatInt(tc.User.ID, 10)
+	}
+	if g.Scope != "" {
+		claims["scope"] = g.Scope
+	}
+	if g.AuthTime != 0 {
+		claims["auth_time"] = g.AuthTime
+	}
+	if cnf := confirmation(g); cnf != nil {
+		claims["cnf"] = cnf
+	}
+
+	// RFC 9068 requires an audience, tokens for no resource in particular are for
+	// the issuer or, without one, the client.
+	switch {
+	case g.Audience != "":
+		claims["aud"] = audienceClaim(g.Audience)
+	case tc.Issuer != "":
+		claims["aud"] = tc.Issuer
+	default:
+		claims["aud"] = tc.Client.UUID
+	}
+	if g.Act != "" {
+		claims["act"] = json.RawMessage(g.Act)
+	}
+	if g.AuthorizationDetails != "" {
+		claims[params.authDetails] = detailsJSON(g.AuthorizationDetails)
+	}
+	return claims
+}
+
+// accessToken returns a new access token for the grant g, the generator is given
+// the client and user of g when it is an AccessTokenGenerator.
+func (s *Server) accessToken(g *Grant) (string, error) {
+	gen, ok := s.gen.(AccessTokenGenerator)
+	if !ok {
+		return s.gen.Generate(), nil
+	}
+	client, err := s.q.ClientByID(g.ClientID)
+	if err != nil {
+		return "", err
+	}
+	tc := &TokenContext{Issuer: s.cfg.Issuer, Grant: g, Client: client}
+	if g.UserID != 0 {
+		if tc.User, err = s.q.UserByID(g.UserID); err != nil {
+			return "", err
+		}
+	}
+	return gen.GenerateAccess(tc)
+}
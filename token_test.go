@@ -0,0 +1,66 @@
+package hero
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJWTTokenGen_GenerateAccess(t *testing.T) {
+	key, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := NewJWTGenWithKeys(NewKeySet(key))
+	iat := time.Now()
+	tc := &TokenContext{
+		Issuer: "https://hero.example.com",
+		Grant:  &Grant{Scope: "openid profile", ExpiresIn: 3600, CreatedAt: iat},
+		Client: &Client{UUID: "s6BhdRkqt3"},
+		User:   &User{ID: 7},
+	}
+	tok, err := gen.GenerateAccess(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := gen.Keys().Parse(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["typ"] != "at+jwt" {
+		t.Errorf("expected at+jwt got %v", parsed.Header["typ"])
+	}
+	sample := []struct {
+		key   string
+		value interface{}
+	}{
+		{"iss", tc.Issuer},
+		{"sub", "7"},
+		{"client_id", tc.Client.UUID},
+		{"scope", tc.Grant.Scope},
+		{"iat", float64(iat.Unix())},
+		{"exp", float64(iat.Unix() + 3600)},
+		{"aud", tc.Issuer},
+	}
+	for _, v := range sample {
+		if parsed.Claims[v.key] != v.value {
+			t.Errorf("%s: expected %v got %v", v.key, v.value, parsed.Claims[v.key])
+		}
+	}
+	if jti, _ := parsed.Claims["jti"].(string); jti == "" {
+		t.Error("expected a jti")
+	}
+
+	// the client is the subject of client credentials tokens, not its owner.
+	tc.Grant.Type = grantType.ClientCredentials
+	tok, err = gen.GenerateAccess(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err = gen.Keys().Parse(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Claims["sub"] != tc.Client.UUID {
+		t.Errorf("expected %s got %v", tc.Client.UUID, parsed.Claims["sub"])
+	}
+}
@@ -73,14 +73,17 @@ func validateURI(base, redir string) error {
 	return nil
 }
 
-func validateURIList(baseList, redir, sep string) error {
-	var list []string
+// splitURIs returns the urls in the list base, which is separated by sep. if sep is
+// an empty string base is the only url.
+func splitURIs(base, sep string) []string {
 	if sep != "" {
-		list = strings.Split(baseList, sep)
-	} else {
-		list = append(list, baseList)
+		return strings.Split(base, sep)
 	}
-	for _, item := range list {
+	return []string{base}
+}
+
+func validateURIList(baseList, redir, sep string) error {
+	for _, item := range splitURIs(baseList, sep) {
 		if err := validateURI(item, redir); err == nil {
 			return nil
 		}
@@ -89,25 +92,37 @@ func validateURIList(baseList, redir, sep string) error {
 
 }
 
-// checks whether refresh is contained in the acess string, access and refresh are
-// scope strings that is coma separated words(or group of utf-8 characters). Returns
-// true if refresh is in the cope of access and false otherwise.
-func extraScopes(access, refresh string) bool {
-	acessList := strings.Split(access, ",")
-	refreshList := strings.Split(refresh, ",")
-
-	var found bool
-END:
-	for _, rScope := range refreshList {
-
-		for _, aScope := range acessList {
-			if rScope != "" && aScope != "" && aScope == rScope {
-				found = true
-				break END
-			}
+// hasScope returns true if name is one of the scopes in the space delimited scope
+// string.
+func hasScope(scope, name string) bool {
+	for _, v := range strings.Fields(scope) {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// coversScope returns true if all the scopes in requested are in granted.
+func coversScope(granted, requested string) bool {
+	for _, v := range strings.Fields(requested) {
+		if !hasScope(granted, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeScopes returns a space delimited list of the scopes in either a or b.
+func mergeScopes(a, b string) string {
+	merged := strings.Fields(a)
+	for _, v := range strings.Fields(b) {
+		if !hasScope(a, v) {
+			merged = append(merged, v)
+			a += " " + v
 		}
 	}
-	return found
+	return strings.Join(merged, " ")
 }
 
 //isEmail returns true if the given string is meail
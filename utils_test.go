@@ -4,22 +4,6 @@ import (
 	"testing"
 )
 
-func TestExtraScopes(t *testing.T) {
-	sample := []struct {
-		access, refresh string
-		result          bool
-	}{
-		{"one,two,three", "one", true},
-		{"one,two,three", "none", false},
-	}
-
-	for _, scope := range sample {
-		if e := extraScopes(scope.access, scope.refresh); e != scope.result {
-			t.Errorf("expected %v got %v  aceess: %s refresh:: %s", scope.result, e, scope.access, scope.refresh)
-		}
-	}
-}
-
 func TestValidURL(t *testing.T) {
 
 	link := "http://www.example.com"
@@ -93,3 +77,42 @@ func TestRandGenerator(t *testing.T) {
 		}
 	}
 }
+
+func TestHasScope(t *testing.T) {
+	sample := []struct {
+		scope, name string
+		result      bool
+	}{
+		{"openid profile", "openid", true},
+		{"openid,profile", "profile", false},
+		{"openid profile", "email", false},
+		{"", "openid", false},
+	}
+	for _, v := range sample {
+		if r := hasScope(v.scope, v.name); r != v.result {
+			t.Errorf("expected %v got %v scope: %s name: %s", v.result, r, v.scope, v.name)
+		}
+	}
+}
+
+func TestCoversScope(t *testing.T) {
+	sample := []struct {
+		granted, requested string
+		result             bool
+	}{
+		{"openid profile", "profile", true},
+		{"openid profile", "", true},
+		{"openid", "openid email", false},
+		{"", "openid", false},
+	}
+	for _, v := range sample {
+		if r := coversScope(v.granted, v.requested); r != v.result {
+			t.Errorf("expected %v got %v granted: %s requested: %s", v.result, r, v.granted, v.requested)
+		}
+	}
+
+	merged := mergeScopes("openid  profile", "profile email email")
+	if merged != "openid profile email" {
+		t.Errorf("expected openid profile email got %s", merged)
+	}
+}